@@ -0,0 +1,165 @@
+// Package cli implements the vodga command line interface.
+// It doesn't depend on Gtk+, so it works on servers and over ssh
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/TheWeirdDev/Vodga/shared/client"
+	"github.com/TheWeirdDev/Vodga/shared/consts"
+	"github.com/TheWeirdDev/Vodga/shared/profiles"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+type command struct {
+	name string
+	args string
+	help string
+	// setup defines the flags of the command and returns the function that runs it
+	setup func(fs *flag.FlagSet) func(args []string) error
+}
+
+// The order of this list is the order of the usage text
+var commands = []command{
+	{name: "import", args: "[-name name] [-username user] [-password pass] [-key-password pass] <config>",
+		help: "import an openvpn config", setup: importCmd},
+	{name: "list", help: "list the imported configs", setup: listCmd},
+	{name: "remove", args: "<name>", help: "remove an imported config", setup: removeCmd},
+	{name: "connect", args: "[-no-wait] <name>", help: "connect to a config", setup: connectCmd},
+	{name: "reconnect", args: "[-attempts n] [-delay s] [-max-delay s] [-failover n] <name>",
+		help: "show or change the reconnect policy of a config", setup: reconnectCmd},
+	{name: "killswitch", args: "[-lan ranges] <name> on|off",
+		help: "block all traffic outside the tunnel when connected to a config", setup: killSwitchCmd},
+	{name: "dns", args: "[-servers ips | -pushed] [-stub on|off] <name>",
+		help: "show or change the DNS settings of a config", setup: dnsCmd},
+	{name: "split", args: "[-only rules | -except rules | -off] <name>",
+		help: "show or change the split tunneling rules of a config", setup: splitCmd},
+	{name: "namespace", args: "<name> on|off",
+		help: "keep the tunnel of a config in its own network namespace", setup: namespaceCmd},
+	{name: "users", args: "[-off] <name> [user | uid | @group ...]",
+		help: "show or change the users whose traffic goes through the tunnel", setup: usersCmd},
+	{name: "proxy", args: "[-socks port] [-http port] [-only] <name> on|off",
+		help: "run a local proxy whose connections go through the tunnel", setup: proxyCmd},
+	{name: "upstream", args: "[-http host:port | -socks host:port | -off] [-username user] [-password pass] <name>",
+		help: "show or change the proxy that openvpn reaches the server through", setup: upstreamCmd},
+	{name: "transport", args: "[-stunnel host:port | -obfs4 host:port -cert cert [-iat-mode n] | " +
+		"-ssh [user@]host:port [-identity file] [-socks] | -off] <name>",
+		help: "show or change the program that carries the connection to the server", setup: transportCmd},
+	{name: "totp", args: "[-set uri | -off] <name>",
+		help: "show the TOTP code of a config or change its secret", setup: totpCmd},
+	{name: "key", args: "[-file path | -module path -id id | -off] <name>",
+		help: "sign with a key file or a hardware token instead of the key of a config", setup: keyCmd},
+	{name: "exec", args: "<name> [--] <command> [arguments]",
+		help: "run a command in the network namespace of a config", setup: execCmd},
+	{name: "unblock", help: "remove the rules of the kill switch", setup: unblockCmd},
+	{name: "disconnect", help: "close the connection", setup: disconnectCmd},
+	{name: "status", help: "show the state of the connection", setup: statusCmd},
+	{name: "logs", args: "[-f]", help: "show the output of openvpn", setup: logsCmd},
+	{name: "stats", help: "show the traffic of the connection", setup: statsCmd},
+}
+
+// Run executes a subcommand, args don't include the program name
+func Run(args []string) error {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		usage()
+		return nil
+	}
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+		fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+		fs.Usage = func() {
+			fmt.Fprintf(os.Stderr, "usage: vodga %s %s\n", cmd.name, cmd.args)
+			fs.PrintDefaults()
+		}
+		run := cmd.setup(fs)
+		if err := fs.Parse(args[1:]); err != nil {
+			if err == flag.ErrHelp {
+				return nil
+			}
+			return err
+		}
+		return run(fs.Args())
+	}
+	usage()
+	return fmt.Errorf("unknown command \"%s\"", args[0])
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: vodga <command> [arguments]\n\ncommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-11s %s\n", cmd.name, cmd.help)
+	}
+}
+
+// dial connects to the daemon
+func dial() (*client.Client, error) {
+	c, err := client.Dial(consts.UnixSocket)
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to the daemon at %s, is it running? (%v)",
+			consts.UnixSocket, err)
+	}
+	return c, nil
+}
+
+// ExitError makes the program exit with a code without printing anything,
+// exec uses it to return the exit code of the command
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return "exit code " + strconv.Itoa(e.Code)
+}
+
+// loadSingle returns an imported config by its name
+func loadSingle(name string) (profiles.SingleCfg, error) {
+	appData, err := profiles.Load()
+	if err != nil {
+		return profiles.SingleCfg{}, err
+	}
+	i := appData.FindSingle(name)
+	if i < 0 {
+		return profiles.SingleCfg{}, fmt.Errorf("no config named \"%s\"", name)
+	}
+	return appData.Singles[i], nil
+}
+
+// oneArg returns the only positional argument of a command
+func oneArg(fs *flag.FlagSet, args []string) (string, error) {
+	if len(args) != 1 {
+		fs.Usage()
+		return "", errors.New("wrong number of arguments")
+	}
+	return args[0], nil
+}
+
+// prompt reads a line from the terminal, it's not shown if echo is false
+func prompt(text string, echo bool) (string, error) {
+	fmt.Fprint(os.Stderr, text)
+	if !echo {
+		if err := stty("-echo"); err == nil {
+			defer func() {
+				_ = stty("echo")
+				fmt.Fprintln(os.Stderr)
+			}()
+		}
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func stty(arg string) error {
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
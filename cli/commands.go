@@ -0,0 +1,904 @@
+package cli
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/TheWeirdDev/Vodga/shared/auth"
+	"github.com/TheWeirdDev/Vodga/shared/client"
+	"github.com/TheWeirdDev/Vodga/shared/consts"
+	"github.com/TheWeirdDev/Vodga/shared/messages"
+	"github.com/TheWeirdDev/Vodga/shared/profiles"
+	"github.com/TheWeirdDev/Vodga/shared/reconnect"
+	"github.com/TheWeirdDev/Vodga/shared/signer"
+	"github.com/TheWeirdDev/Vodga/shared/totp"
+	"github.com/TheWeirdDev/Vodga/shared/utils"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+func importCmd(fs *flag.FlagSet) func(args []string) error {
+	name := fs.String("name", "", "name of the config (default: the file name)")
+	username := fs.String("username", "", "username, if the config needs one")
+	password := fs.String("password", "", "password, asked when connecting if it's empty")
+	keyPassword := fs.String("key-password", "",
+		"passphrase of an encrypted private key, asked when connecting if it's empty")
+
+	return func(args []string) error {
+		file, err := oneArg(fs, args)
+		if err != nil {
+			return err
+		}
+		cfg, err := profiles.GetConfig(file, true)
+		if err != nil {
+			return err
+		}
+		if *name == "" {
+			*name = profiles.DefaultName(file)
+		}
+		creds := cfg.Creds
+		if *username != "" {
+			creds = auth.Credentials{Auth: auth.USER_PASS, Username: *username, Password: *password}
+		}
+		if _, err := profiles.ImportSingle(cfg, *name, creds); err != nil {
+			return err
+		}
+		if *keyPassword != "" {
+			err := profiles.UpdateSingle(*name, func(single *profiles.SingleCfg) {
+				single.KeyPassword = *keyPassword
+			})
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Printf("Imported \"%s\"\n", *name)
+		return nil
+	}
+}
+
+func listCmd(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		appData, err := profiles.Load()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tPORT\tPROTO\tCOUNTRY")
+		for _, single := range appData.Singles {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", single.Name, single.Port, single.Proto, single.Country)
+		}
+		return w.Flush()
+	}
+}
+
+func removeCmd(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		name, err := oneArg(fs, args)
+		if err != nil {
+			return err
+		}
+		return profiles.RemoveSingle(name)
+	}
+}
+
+func connectCmd(fs *flag.FlagSet) func(args []string) error {
+	noWait := fs.Bool("no-wait", false,
+		"don't wait until the connection is established, challenges of the server can't be answered")
+
+	return func(args []string) error {
+		name, err := oneArg(fs, args)
+		if err != nil {
+			return err
+		}
+		single, err := loadSingle(name)
+		if err != nil {
+			return err
+		}
+
+		// The codes answer the static challenges without asking
+		var key *totp.Key
+		if single.TOTP != "" {
+			if key, err = totp.ParseURI(single.TOTP); err != nil {
+				return fmt.Errorf("invalid TOTP secret: %v", err)
+			}
+		}
+
+		// The key is loaded before connecting, so a wrong passphrase doesn't start openvpn
+		var sig signer.Signer
+		if single.ExternalKey != nil {
+			if sig, err = loadSigner(*single.ExternalKey, single.KeyPassword); err != nil {
+				return fmt.Errorf("can't load the external key: %v", err)
+			}
+		}
+
+		creds := single.Creds
+		if creds.Auth == auth.USER_PASS {
+			if creds.Username == "" {
+				if creds.Username, err = prompt("Username: ", true); err != nil {
+					return err
+				}
+			}
+			if creds.Password == "" {
+				if creds.Password, err = prompt("Password: ", false); err != nil {
+					return err
+				}
+			}
+		}
+
+		c, err := dial()
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		if err := c.Connect(single, creds); err != nil {
+			return err
+		}
+		if *noWait {
+			return nil
+		}
+
+		for msg := range c.Events() {
+			switch msg.Command {
+			case consts.MsgStateChanged:
+				fmt.Printf("%s (%s)\n", msg.Args["state"], msg.Args["reason"])
+				switch msg.Args["state"] {
+				case consts.StateCONNECTED:
+					return nil
+				case consts.StateFailed:
+					return errors.New(msg.Args["reason"])
+				}
+			case consts.MsgReconnectScheduled:
+				fmt.Printf("Reconnecting in %ss (attempt %s/%s)\n", msg.Args["delay"],
+					msg.Args["attempt"], msg.Args["max_attempts"])
+			case consts.MsgPasswordRequest:
+				username, password, err := answerPassword(messages.ParsePasswordRequest(msg), single, key)
+				if err != nil {
+					return err
+				}
+				if err := c.AnswerPassword(username, password); err != nil {
+					return err
+				}
+			case consts.MsgPKCS11IDRequest:
+				id, err := chooseCertificate(msg)
+				if err != nil {
+					return err
+				}
+				if err := c.AnswerPKCS11ID(id); err != nil {
+					return err
+				}
+				// The token is asked for the same certificate next time
+				err = profiles.UpdateSingle(name, func(single *profiles.SingleCfg) {
+					single.PKCS11ID = id
+				})
+				if err != nil {
+					return err
+				}
+			case consts.MsgSignRequest:
+				signature, err := sign(sig, msg.Args["data"], msg.Args["algorithm"])
+				if err := c.AnswerSignature(signature, err); err != nil {
+					return err
+				}
+			case consts.MsgError:
+				return errors.New(msg.Args["error"])
+			case consts.MsgDisconnected:
+				return errors.New("openvpn closed before the connection was established")
+			}
+		}
+		return errors.New("lost connection to the daemon")
+	}
+}
+
+// answerPassword answers a password request from the secrets of a config, or asks for it
+func answerPassword(req messages.PasswordRequest, single profiles.SingleCfg,
+	key *totp.Key) (string, string, error) {
+	switch req.Kind {
+	case consts.PasswordChallenge:
+		if key != nil && !req.Dynamic {
+			fmt.Printf("%s: answered with the TOTP code\n", req.Text)
+			return "", key.Code(time.Now()), nil
+		}
+		response, err := prompt(req.Text+": ", req.Echo)
+		return "", response, err
+	case consts.PasswordPrivateKey:
+		if single.KeyPassword != "" {
+			return "", single.KeyPassword, nil
+		}
+	case consts.PasswordHTTPProxy, consts.PasswordSOCKSProxy:
+		// The daemon only asks when the password of the proxy isn't stored
+		if single.Upstream != nil && single.Upstream.Username != "" {
+			password, err := prompt(req.Type+" password for "+single.Upstream.Username+": ", false)
+			return single.Upstream.Username, password, err
+		}
+	case consts.PasswordToken:
+		if single.KeyPassword != "" {
+			return "", single.KeyPassword, nil
+		}
+		pin, err := prompt(req.Type+" PIN: ", false)
+		return "", pin, err
+	}
+	username := ""
+	if req.NeedUsername {
+		var err error
+		if username, err = prompt(req.Type+" username: ", true); err != nil {
+			return "", "", err
+		}
+	}
+	password, err := prompt(req.Type+" password: ", false)
+	return username, password, err
+}
+
+// chooseCertificate asks which certificate of the tokens is used
+func chooseCertificate(msg *messages.Message) (string, error) {
+	certs, err := messages.ParsePKCS11IDRequest(msg)
+	if err != nil {
+		return "", err
+	}
+	fmt.Println("Certificates in the tokens:")
+	for i, cert := range certs {
+		fmt.Printf("%3d) %s\n", i+1, cert.ID)
+		if cert.Subject != "" {
+			fmt.Printf("     %s, issued by %s, expires %s\n", cert.Subject, cert.Issuer,
+				cert.NotAfter.Format("2006-01-02"))
+		}
+	}
+	for {
+		answer, err := prompt("Certificate: ", true)
+		if err != nil {
+			return "", err
+		}
+		if i, err := strconv.Atoi(answer); err == nil && i >= 1 && i <= len(certs) {
+			return certs[i-1].ID, nil
+		}
+		fmt.Printf("Enter a number from 1 to %d\n", len(certs))
+	}
+}
+
+// loadSigner opens the external key of a config, the passphrase or the PIN is asked if it's not stored
+func loadSigner(key profiles.ExternalKey, password string) (signer.Signer, error) {
+	ask := func(text string) func() (string, error) {
+		return func() (string, error) {
+			if password != "" {
+				return password, nil
+			}
+			return prompt(text, false)
+		}
+	}
+	if key.Module != "" {
+		return signer.PKCS11(key.Module, key.ID, ask("PIN of the token: ")), nil
+	}
+	return signer.LoadKey(key.File, ask("Passphrase of the private key: "))
+}
+
+// sign answers a SIGN_REQUEST, the data and the signature are base64
+func sign(sig signer.Signer, data, algorithm string) (string, error) {
+	if sig == nil {
+		return "", errors.New("the config has no external key")
+	}
+	alg, err := signer.ParseAlgorithm(algorithm)
+	if err != nil {
+		return "", err
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", err
+	}
+	signature, err := sig.Sign(raw, alg)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+func reconnectCmd(fs *flag.FlagSet) func(args []string) error {
+	attempts := fs.Int("attempts", -1, "restarts of openvpn before giving up, 0 disables reconnecting")
+	delay := fs.Int("delay", -1, "seconds before the first restart, doubled for each attempt")
+	maxDelay := fs.Int("max-delay", -1, "maximum seconds between restarts")
+	failover := fs.Int("failover", -1, "failures before the next remote is used, 0 never skips")
+
+	return func(args []string) error {
+		name, err := oneArg(fs, args)
+		if err != nil {
+			return err
+		}
+		var policy reconnect.Policy
+		err = profiles.UpdateSingle(name, func(single *profiles.SingleCfg) {
+			policy = single.ReconnectPolicy()
+			for _, f := range []struct {
+				flag  int
+				value *int
+			}{
+				{*attempts, &policy.MaxAttempts},
+				{*delay, &policy.InitialDelay},
+				{*maxDelay, &policy.MaxDelay},
+				{*failover, &policy.FailoverAfter},
+			} {
+				if f.flag >= 0 {
+					*f.value = f.flag
+				}
+			}
+			single.Reconnect = &policy
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Attempts: %d, delay: %ds up to %ds, failover after: %d\n",
+			policy.MaxAttempts, policy.InitialDelay, policy.MaxDelay, policy.FailoverAfter)
+		return nil
+	}
+}
+
+func killSwitchCmd(fs *flag.FlagSet) func(args []string) error {
+	lan := fs.String("lan", "", "comma separated ranges that are allowed, like 192.168.1.0/24")
+
+	return func(args []string) error {
+		if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+			fs.Usage()
+			return errors.New("wrong arguments")
+		}
+		var lanRanges []string
+		if *lan != "" {
+			lanRanges = strings.Split(*lan, ",")
+			for _, cidr := range lanRanges {
+				if _, _, err := net.ParseCIDR(cidr); err != nil {
+					return fmt.Errorf("invalid range \"%s\"", cidr)
+				}
+			}
+		}
+		return profiles.UpdateSingle(args[0], func(single *profiles.SingleCfg) {
+			single.KillSwitch = args[1] == "on"
+			if *lan != "" {
+				single.LAN = lanRanges
+			}
+		})
+	}
+}
+
+func dnsCmd(fs *flag.FlagSet) func(args []string) error {
+	servers := fs.String("servers", "", "comma separated DNS servers that replace the pushed ones")
+	pushed := fs.Bool("pushed", false, "use the DNS servers that the server pushes again")
+	stub := fs.String("stub", "", "on or off, send all queries to the DNS stub of the daemon")
+
+	return func(args []string) error {
+		name, err := oneArg(fs, args)
+		if err != nil {
+			return err
+		}
+		var dns []string
+		if *servers != "" {
+			dns = strings.Split(*servers, ",")
+			for _, server := range dns {
+				if net.ParseIP(server) == nil {
+					return fmt.Errorf("invalid DNS server \"%s\"", server)
+				}
+			}
+		}
+		if *stub != "" && *stub != "on" && *stub != "off" {
+			fs.Usage()
+			return errors.New("-stub must be on or off")
+		}
+		var single profiles.SingleCfg
+		err = profiles.UpdateSingle(name, func(s *profiles.SingleCfg) {
+			if *pushed {
+				s.DNS = nil
+			} else if dns != nil {
+				s.DNS = dns
+			}
+			if *stub != "" {
+				s.DNSStub = *stub == "on"
+			}
+			single = *s
+		})
+		if err != nil {
+			return err
+		}
+		if len(single.DNS) > 0 {
+			fmt.Println("DNS servers:", strings.Join(single.DNS, ", "))
+		} else {
+			fmt.Println("DNS servers: pushed by the server")
+		}
+		fmt.Println("DNS stub:", single.DNSStub)
+		return nil
+	}
+}
+
+func splitCmd(fs *flag.FlagSet) func(args []string) error {
+	only := fs.String("only", "", "comma separated ranges, addresses or domains that go through the tunnel")
+	except := fs.String("except", "", "comma separated ranges, addresses or domains that don't go through the tunnel")
+	off := fs.Bool("off", false, "send everything through the tunnel")
+
+	return func(args []string) error {
+		name, err := oneArg(fs, args)
+		if err != nil {
+			return err
+		}
+		var split *profiles.SplitTunnel
+		switch {
+		case *only != "" && *except != "", (*only != "" || *except != "") && *off:
+			fs.Usage()
+			return errors.New("use only one of -only, -except and -off")
+		case *only != "":
+			split = &profiles.SplitTunnel{Mode: profiles.SplitOnly, Rules: strings.Split(*only, ",")}
+		case *except != "":
+			split = &profiles.SplitTunnel{Mode: profiles.SplitExcept, Rules: strings.Split(*except, ",")}
+		}
+		if split != nil {
+			if err := split.Check(); err != nil {
+				return err
+			}
+		}
+		var single profiles.SingleCfg
+		err = profiles.UpdateSingle(name, func(s *profiles.SingleCfg) {
+			if *off {
+				s.Split = nil
+			} else if split != nil {
+				s.Split = split
+			}
+			single = *s
+		})
+		if err != nil {
+			return err
+		}
+		if single.Split == nil {
+			fmt.Println("Split tunneling: off")
+		} else {
+			fmt.Printf("Split tunneling: %s %s\n", single.Split.Mode, strings.Join(single.Split.Rules, ", "))
+		}
+		return nil
+	}
+}
+
+func namespaceCmd(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+			fs.Usage()
+			return errors.New("wrong arguments")
+		}
+		return profiles.UpdateSingle(args[0], func(single *profiles.SingleCfg) {
+			single.Namespace = args[1] == "on"
+		})
+	}
+}
+
+func usersCmd(fs *flag.FlagSet) func(args []string) error {
+	off := fs.Bool("off", false, "send the traffic of all users through the tunnel")
+
+	return func(args []string) error {
+		if len(args) == 0 || (*off && len(args) > 1) {
+			fs.Usage()
+			return errors.New("wrong number of arguments")
+		}
+		users := args[1:]
+		if _, _, err := profiles.ResolveUsers(users); err != nil {
+			return err
+		}
+		var single profiles.SingleCfg
+		err := profiles.UpdateSingle(args[0], func(s *profiles.SingleCfg) {
+			if *off {
+				s.Users = nil
+			} else if len(users) > 0 {
+				s.Users = users
+			}
+			single = *s
+		})
+		if err != nil {
+			return err
+		}
+		if len(single.Users) == 0 {
+			fmt.Println("Users: everyone")
+		} else {
+			fmt.Println("Users:", strings.Join(single.Users, ", "))
+		}
+		return nil
+	}
+}
+
+func proxyCmd(fs *flag.FlagSet) func(args []string) error {
+	socks := fs.Uint("socks", 0, "SOCKS5 port on 127.0.0.1 (default: "+strconv.Itoa(consts.ProxySOCKSPort)+
+		" if -http is not given)")
+	httpPort := fs.Uint("http", 0, "HTTP CONNECT port on 127.0.0.1")
+	only := fs.Bool("only", false, "ignore the pushed routes, so only the proxy uses the tunnel")
+
+	return func(args []string) error {
+		if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+			fs.Usage()
+			return errors.New("wrong arguments")
+		}
+		if *socks > 65535 || *httpPort > 65535 {
+			return errors.New("invalid port")
+		}
+		return profiles.UpdateSingle(args[0], func(single *profiles.SingleCfg) {
+			if args[1] == "off" {
+				single.Proxy = nil
+				return
+			}
+			single.Proxy = &profiles.LocalProxy{SOCKSPort: uint16(*socks), HTTPPort: uint16(*httpPort),
+				Only: *only}
+		})
+	}
+}
+
+func upstreamCmd(fs *flag.FlagSet) func(args []string) error {
+	httpProxy := fs.String("http", "", "an HTTP proxy, like proxy.example.com:3128")
+	socksProxy := fs.String("socks", "", "a SOCKS proxy, like 10.0.0.1:1080")
+	username := fs.String("username", "", "username of the proxy")
+	password := fs.String("password", "", "password of the proxy, asked when connecting if it's empty")
+	off := fs.Bool("off", false, "connect to the server directly")
+
+	return func(args []string) error {
+		name, err := oneArg(fs, args)
+		if err != nil {
+			return err
+		}
+		var proxy *profiles.UpstreamProxy
+		switch {
+		case *httpProxy != "" && *socksProxy != "", (*httpProxy != "" || *socksProxy != "") && *off:
+			fs.Usage()
+			return errors.New("use only one of -http, -socks and -off")
+		case *httpProxy != "" || *socksProxy != "":
+			typ, addr := profiles.ProxyHTTP, *httpProxy
+			if *socksProxy != "" {
+				typ, addr = profiles.ProxySOCKS, *socksProxy
+			}
+			host, portText, err := net.SplitHostPort(addr)
+			if err != nil {
+				return err
+			}
+			port, err := strconv.ParseUint(portText, 10, 16)
+			if err != nil || port == 0 || host == "" {
+				return fmt.Errorf("invalid proxy address \"%s\"", addr)
+			}
+			proxy = &profiles.UpstreamProxy{Type: typ, Host: host, Port: uint16(port),
+				Auth: *username != "", Username: *username, Password: *password}
+		}
+		var single profiles.SingleCfg
+		err = profiles.UpdateSingle(name, func(s *profiles.SingleCfg) {
+			if *off {
+				s.Upstream = nil
+			} else if proxy != nil {
+				s.Upstream = proxy
+			}
+			single = *s
+		})
+		if err != nil {
+			return err
+		}
+		if single.Upstream == nil {
+			fmt.Println("Upstream proxy: none")
+		} else {
+			fmt.Println("Upstream proxy:", single.Upstream)
+		}
+		return nil
+	}
+}
+
+func transportCmd(fs *flag.FlagSet) func(args []string) error {
+	stunnel := fs.String("stunnel", "", "an stunnel server, like vpn.example.com:443")
+	obfs4 := fs.String("obfs4", "", "an obfs4 bridge, like 192.0.2.1:443")
+	cert := fs.String("cert", "", "the cert of the obfs4 bridge")
+	iatMode := fs.Int("iat-mode", 0, "the iat-mode of the obfs4 bridge")
+	ssh := fs.String("ssh", "", "an SSH server, like user@ssh.example.com:22")
+	identity := fs.String("identity", "", "the private key of the SSH server")
+	socks := fs.Bool("socks", false, "use the SSH server as a SOCKS proxy instead of forwarding to the first remote")
+	off := fs.Bool("off", false, "connect to the server directly")
+
+	return func(args []string) error {
+		name, err := oneArg(fs, args)
+		if err != nil {
+			return err
+		}
+		given := 0
+		for _, set := range []bool{*stunnel != "", *obfs4 != "", *ssh != "", *off} {
+			if set {
+				given++
+			}
+		}
+		if given > 1 {
+			fs.Usage()
+			return errors.New("use only one of -stunnel, -obfs4, -ssh and -off")
+		}
+		var transport *profiles.Transport
+		switch {
+		case *stunnel != "":
+			transport = &profiles.Transport{Type: profiles.TransportStunnel, Server: *stunnel}
+		case *obfs4 != "":
+			transport = &profiles.Transport{Type: profiles.TransportObfs4, Server: *obfs4, Cert: *cert,
+				IATMode: *iatMode}
+		case *ssh != "":
+			transport = &profiles.Transport{Type: profiles.TransportSSH, Server: *ssh, Identity: *identity,
+				Dynamic: *socks}
+			if i := strings.LastIndex(*ssh, "@"); i >= 0 {
+				transport.User, transport.Server = (*ssh)[:i], (*ssh)[i+1:]
+			}
+		}
+		if transport != nil {
+			if err := transport.Check(); err != nil {
+				return err
+			}
+		}
+		var single profiles.SingleCfg
+		err = profiles.UpdateSingle(name, func(s *profiles.SingleCfg) {
+			if *off {
+				s.Transport = nil
+			} else if transport != nil {
+				s.Transport = transport
+			}
+			single = *s
+		})
+		if err != nil {
+			return err
+		}
+		if single.Transport == nil {
+			fmt.Println("Transport: none")
+		} else {
+			fmt.Println("Transport:", single.Transport)
+		}
+		return nil
+	}
+}
+
+func totpCmd(fs *flag.FlagSet) func(args []string) error {
+	set := fs.String("set", "", "an otpauth://totp/ URI, like the ones in the QR codes of the providers")
+	off := fs.Bool("off", false, "forget the secret, static challenges are asked again")
+
+	return func(args []string) error {
+		name, err := oneArg(fs, args)
+		if err != nil {
+			return err
+		}
+		if *set != "" && *off {
+			fs.Usage()
+			return errors.New("-set and -off can't be used together")
+		}
+		if *set != "" {
+			if _, err := totp.ParseURI(*set); err != nil {
+				return err
+			}
+		}
+		if *set != "" || *off {
+			return profiles.UpdateSingle(name, func(single *profiles.SingleCfg) {
+				single.TOTP = *set
+			})
+		}
+
+		single, err := loadSingle(name)
+		if err != nil {
+			return err
+		}
+		if single.TOTP == "" {
+			return errors.New("the config has no TOTP secret")
+		}
+		key, err := totp.ParseURI(single.TOTP)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		fmt.Printf("%s (valid for %v)\n", key.Code(now), key.Remaining(now))
+		return nil
+	}
+}
+
+func keyCmd(fs *flag.FlagSet) func(args []string) error {
+	file := fs.String("file", "", "a PEM private key that only the user can read")
+	module := fs.String("module", "", "the PKCS#11 module of a hardware token, like opensc-pkcs11.so")
+	id := fs.String("id", "", "the id of the key in the token, see pkcs11-tool --list-objects")
+	off := fs.Bool("off", false, "use the key of the config again")
+
+	return func(args []string) error {
+		name, err := oneArg(fs, args)
+		if err != nil {
+			return err
+		}
+		var key *profiles.ExternalKey
+		switch {
+		case *off && (*file != "" || *module != ""), *file != "" && *module != "":
+			fs.Usage()
+			return errors.New("-file, -module and -off can't be used together")
+		case (*module == "") != (*id == ""):
+			fs.Usage()
+			return errors.New("-module and -id must be used together")
+		case *file != "":
+			path, err := filepath.Abs(*file)
+			if err != nil {
+				return err
+			}
+			key = &profiles.ExternalKey{File: path}
+		case *module != "":
+			key = &profiles.ExternalKey{Module: *module, ID: *id}
+		case !*off:
+			single, err := loadSingle(name)
+			if err != nil {
+				return err
+			}
+			switch {
+			case single.ExternalKey == nil:
+				fmt.Println("The key of the config is used")
+			case single.ExternalKey.Module != "":
+				fmt.Printf("Key %s of %s\n", single.ExternalKey.ID, single.ExternalKey.Module)
+			default:
+				fmt.Println(single.ExternalKey.File)
+			}
+			return nil
+		}
+		return profiles.UpdateSingle(name, func(single *profiles.SingleCfg) {
+			single.ExternalKey = key
+		})
+	}
+}
+
+func execCmd(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		if len(args) > 1 && args[1] == "--" {
+			args = append(args[:1], args[2:]...)
+		}
+		if len(args) < 2 {
+			fs.Usage()
+			return errors.New("wrong number of arguments")
+		}
+		single, err := loadSingle(args[0])
+		if err != nil {
+			return err
+		}
+		dir, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+
+		c, err := dial()
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		pid, err := c.Exec(single, args[1:], os.Environ(), dir, [3]*os.File{os.Stdin, os.Stdout, os.Stderr})
+		if err != nil {
+			return err
+		}
+
+		// The command is not our child, but it runs as our user so it can get our signals
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+		defer signal.Stop(sigs)
+		for {
+			select {
+			case sig := <-sigs:
+				_ = syscall.Kill(pid, sig.(syscall.Signal))
+			case msg, ok := <-c.Events():
+				if !ok || msg.Command == client.EventDisconnected {
+					return errors.New("lost connection to the daemon")
+				}
+				if msg.Command != consts.MsgExecExited || msg.Args["pid"] != strconv.Itoa(pid) {
+					continue
+				}
+				if code, _ := strconv.Atoi(msg.Args["code"]); code != 0 {
+					return &ExitError{Code: code}
+				}
+				return nil
+			}
+		}
+	}
+}
+
+func unblockCmd(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		c, err := dial()
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		return c.DisableKillSwitch()
+	}
+}
+
+func disconnectCmd(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		c, err := dial()
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		return c.Disconnect()
+	}
+}
+
+func statusCmd(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		c, err := dial()
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		status, err := c.Status()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "State:\t%s\n", status.State)
+		if status.Profile != "" {
+			fmt.Fprintf(w, "Profile:\t%s\n", status.Profile)
+		}
+		if !status.ConnectedSince.IsZero() {
+			fmt.Fprintf(w, "Connected since:\t%s (%s)\n", status.ConnectedSince.Format(time.RFC1123),
+				time.Since(status.ConnectedSince).Round(time.Second))
+		}
+		if status.LocalIP != "" {
+			fmt.Fprintf(w, "Tunnel IP:\t%s\n", status.LocalIP)
+		}
+		if status.LocalIPv6 != "" {
+			fmt.Fprintf(w, "Tunnel IPv6:\t%s\n", status.LocalIPv6)
+		}
+		if status.KillSwitch {
+			fmt.Fprintln(w, "Kill switch:\tactive")
+		}
+		if status.Namespace != "" {
+			fmt.Fprintf(w, "Namespace:\t%s\n", status.Namespace)
+		}
+		if status.SOCKSPort != 0 {
+			fmt.Fprintf(w, "SOCKS5 proxy:\t127.0.0.1:%d\n", status.SOCKSPort)
+		}
+		if status.HTTPPort != 0 {
+			fmt.Fprintf(w, "HTTP proxy:\t127.0.0.1:%d\n", status.HTTPPort)
+		}
+		if status.RemoteIP != "" {
+			fmt.Fprintf(w, "Server:\t%s port %s\n", status.RemoteIP, status.RemotePort)
+		}
+		fmt.Fprintf(w, "Traffic:\t%s received, %s sent\n", utils.FormatSize(status.Bytecount.In),
+			utils.FormatSize(status.Bytecount.Out))
+		return w.Flush()
+	}
+}
+
+func logsCmd(fs *flag.FlagSet) func(args []string) error {
+	follow := fs.Bool("f", false, "keep printing new lines")
+
+	return func(args []string) error {
+		c, err := dial()
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		lines, err := c.Logs()
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+		if !*follow {
+			return nil
+		}
+		for msg := range c.Events() {
+			if msg.Command == consts.MsgLog {
+				fmt.Println(msg.Args["log"])
+			}
+		}
+		return nil
+	}
+}
+
+func statsCmd(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		c, err := dial()
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		bytecount, err := c.Bytecount()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "\tSESSION\tTOTAL")
+		fmt.Fprintf(w, "Received\t%s\t%s\n", utils.FormatSize(bytecount.In), utils.FormatSize(bytecount.TotalIn))
+		fmt.Fprintf(w, "Sent\t%s\t%s\n", utils.FormatSize(bytecount.Out), utils.FormatSize(bytecount.TotalOut))
+		fmt.Fprintf(w, "Total bytes\t%s\t%s\n", strconv.FormatUint(bytecount.In+bytecount.Out, 10),
+			strconv.FormatUint(bytecount.TotalIn+bytecount.TotalOut, 10))
+		return w.Flush()
+	}
+}
@@ -4,14 +4,17 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"github.com/TheWeirdDev/Vodga/daemon/mgmt"
 	"github.com/TheWeirdDev/Vodga/shared/auth"
 	"github.com/TheWeirdDev/Vodga/shared/consts"
 	"github.com/TheWeirdDev/Vodga/shared/messages"
+	"github.com/TheWeirdDev/Vodga/shared/reconnect"
 	"log"
 	"net"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,18 +22,43 @@ import (
 	"time"
 )
 
+// Options are the settings of the daemon that are given on the command line
+type Options struct {
+	ScriptPolicy ScriptPolicy
+	DNS          DNSMode
+}
+
 type Daemon struct {
-	quit    chan struct{}
-	ln      net.Listener
-	conns   []net.Conn
-	mtx     sync.Mutex
-	openvpn Openvpn
+	quit         chan struct{}
+	ln           net.Listener
+	conns        []net.Conn
+	mtx          sync.Mutex
+	openvpn      Openvpn
+	scriptPolicy ScriptPolicy
+	// The active kill switch, nil if it's disabled
+	killSwitch *killSwitch
+	dns        dnsState
+	split      splitState
+	netns      namespace
+	users      userRouting
+	proxy      proxyState
+	ipv6       ipv6Guard
+	passwords  passwordState
+	transport  transportState
+	// Connections that said HELLO only get broadcasts after SUBSCRIBE,
+	// the ones that are not in this map are old clients that get everything
+	subs   map[net.Conn]bool
+	subMtx sync.Mutex
+	// The last lines of openvpn output, for clients that ask for it later
+	logs   []string
+	logMtx sync.Mutex
 }
 
-func NewDaemon() *Daemon {
-	instance := &Daemon{}
+func NewDaemon(opts Options) *Daemon {
+	instance := &Daemon{scriptPolicy: opts.ScriptPolicy, subs: make(map[net.Conn]bool)}
+	instance.dns.backend = newDNSBackend(opts.DNS)
 	instance.quit = make(chan struct{})
-	instance.openvpn = Openvpn{connected: false, bytesIn: 0, bytesOut: 0,
+	instance.openvpn = Openvpn{state: Idle, bytesIn: 0, bytesOut: 0,
 		totalIn: 0, totalOut: 0}
 
 	ln, err := net.Listen("unix", consts.UnixSocket)
@@ -39,8 +67,22 @@ func NewDaemon() *Daemon {
 	}
 	instance.ln = ln
 
-	// Make the socket accessible to all users
-	if err := os.Chmod(consts.UnixSocket, os.FileMode(0777)); err != nil {
+	// A backup means that the daemon crashed while the tunnel was up
+	restoreStaleDNS()
+
+	// The rules outlive the daemon, install them again in case they were lost
+	if ks, err := loadKillSwitch(); err != nil {
+		log.Printf("Can't read the kill switch state: %v\n", err)
+	} else if ks != nil {
+		if err := ks.apply(); err != nil {
+			log.Printf("Can't restore the kill switch: %v\n", err)
+		}
+		instance.killSwitch = ks
+	}
+
+	// Make the socket accessible to all users,
+	// every command is authorized by the credentials of its sender
+	if err := os.Chmod(consts.UnixSocket, os.FileMode(0666)); err != nil {
 		log.Fatalf("Failed to set socket permissions: %v", err)
 	}
 	return instance
@@ -56,12 +98,17 @@ func (d *Daemon) StartServer() {
 		// Waits for signals
 		err := <-sigchan
 		log.Printf("Server Killed by: '%v', closing openvpn\n", err)
+		if d.openvpn.getState().isActive() {
+			d.setState(Disconnecting, "the daemon is shutting down", "")
+		}
 		d.openvpn.closeConnection()
 		time.Sleep(1500 * time.Millisecond)
 		close(*kill)
 		ln.Close()
 	}(d.ln, &d.quit)
 
+	go d.watchNetwork()
+
 loop:
 	for {
 		// Waits for new client connection
@@ -80,34 +127,60 @@ loop:
 			break loop
 		}
 
+		d.subMtx.Lock()
 		d.conns = append(d.conns, conn)
-		go d.daemonServer(conn, len(d.conns)-1)
+		id := len(d.conns) - 1
+		d.subMtx.Unlock()
+		go d.daemonServer(conn, id)
 	}
 }
 
 func (d *Daemon) daemonServer(c net.Conn, id int) {
 	defer func(c *net.Conn) {
 		(*c).Close()
+		d.subMtx.Lock()
 		d.conns[id] = nil
+		delete(d.subs, *c)
+		d.subMtx.Unlock()
+		d.dropPasswordClient(*c)
 	}(&c)
 
-	log.Printf("Client #%d connected", id)
-	scanner := bufio.NewScanner(c)
+	p, err := getPeer(c)
+	if err != nil {
+		log.Printf("Client #%d rejected, can't get peer credentials: %v\n", id, err)
+		return
+	}
+	log.Printf("Client #%d connected (uid=%d pid=%d)", id, p.uid, p.pid)
+	// EXEC requests come with descriptors
+	reader := &rightsReader{conn: c.(*net.UnixConn)}
+	defer func() {
+		closeFiles(reader.take())
+	}()
+	scanner := bufio.NewScanner(reader)
 	for scanner.Scan() {
 		text := strings.TrimSpace(scanner.Text())
 		if len(text) == 0 {
 			continue
 		}
-
-		//TODO: Remove this later , or use it for --verbose flag
-		log.Printf("Client %d: %s\n", id, text)
 		msg, err := messages.UnmarshalMsg(text)
 		if err != nil {
 			log.Printf("Got invalid message: %v", err)
-			messages.SendMessage(messages.SimpleMsg(consts.UnknownCmd), c)
+			d.send(messages.SimpleMsg(consts.UnknownCmd), c)
+			continue
+		}
+		// Only the command, the arguments have passwords and the environment of EXEC
+		log.Printf("Client #%d: %s\n", id, msg.Command)
+		if !p.authorize(msg.Command) {
+			d.reply(msg, messages.DeniedMsg(msg.Command, "permission denied for uid "+
+				strconv.FormatUint(uint64(p.uid), 10)), c)
+			continue
+		}
+		if msg.Command == consts.MsgExec {
+			// It runs as the user of the client
+			d.execCommand(msg, c, p, reader.take())
 			continue
 		}
-		d.processMessage(msg, c)
+		d.processMessage(msg, c, p)
 	}
 	if err := scanner.Err(); err != nil {
 		log.Printf("Server error: %v\n", err)
@@ -124,21 +197,45 @@ func (d *Daemon) stopServer(c net.Conn) {
 	}
 }
 
-func (d *Daemon) startOpenVPN(c net.Conn) {
-	cmd := exec.Command("openvpn", "--config", d.openvpn.config,
+func (d *Daemon) startOpenVPN() {
+	// openvpn connects through the transport, it must be ready first
+	if err := d.startTransport(); err != nil {
+		d.broadcastMessage(messages.ErrorMsg("Can't start the transport: " + err.Error()))
+		d.resetOpenvpn()
+		d.setState(Failed, "can't start the transport: "+err.Error(), "")
+		return
+	}
+	args := []string{"--config", d.openvpn.launchConfig,
 		"--management", consts.MgmtSocket, "unix", "--management-query-passwords",
-		"--management-hold")
+		"--management-hold", "--management-query-remote",
+		// Failed credentials are asked again, dynamic challenges are answered this way
+		"--auth-retry", "interact",
+		// The pushed options are only logged with verb 3 or more
+		"--verb", "3"}
+	if !d.openvpn.trusted {
+		// Options after --config override the ones in it
+		args = append(args, "--script-security", "1")
+	}
+	args = append(args, d.splitArgs()...)
+	args = append(args, d.namespaceArgs()...)
+	args = append(args, d.usersArgs()...)
+	args = append(args, d.proxyArgs()...)
+	args = append(args, d.externalKeyArgs()...)
+	args = append(args, d.upstreamArgs()...)
+	args = append(args, d.transportArgs()...)
+	cmd := exec.Command("openvpn", args...)
+	// Relative paths in the config are relative to its directory
+	cmd.Dir = filepath.Dir(d.openvpn.config)
 
 	// Kill other openvpn instances before starting this one
 	d.killOpenvpn()
 
-	// Reset openvpn state after it's closed
-	defer d.resetOpenvpn()
-
 	// create a pipe for the output of the script
 	cmdReader, err := cmd.StdoutPipe()
 	if err != nil {
-		messages.SendMessage(messages.ErrorMsg("Can't open StdoutPipe for OpenVPN"), c)
+		d.broadcastMessage(messages.ErrorMsg("Can't open StdoutPipe for OpenVPN"))
+		d.resetOpenvpn()
+		d.setState(Failed, "can't open the output of openvpn: "+err.Error(), "")
 		return
 	}
 
@@ -147,17 +244,25 @@ func (d *Daemon) startOpenVPN(c net.Conn) {
 
 	go func() {
 		for scanner.Scan() {
+			d.addLog(scanner.Text())
+			d.processLogLine(scanner.Text())
 			d.broadcastMessage(messages.LogMsg(scanner.Text()))
 		}
 	}()
 
 	err = cmd.Start()
 	if err != nil {
-		messages.SendMessage(messages.ErrorMsg("Can't start OpenVPN"), c)
+		d.broadcastMessage(messages.ErrorMsg("Can't start OpenVPN"))
+		d.resetOpenvpn()
+		d.setState(Failed, "can't start openvpn: "+err.Error(), "")
 		return
 	}
-	go d.connectToMgmt()
 	d.openvpn.process = cmd
+	// A DISCONNECT may have come before the process existed
+	if d.openvpn.getState() == Disconnecting {
+		_ = d.openvpn.closeConnection()
+	}
+	go d.connectToMgmt()
 
 	err = cmd.Wait()
 	if err != nil {
@@ -166,63 +271,206 @@ func (d *Daemon) startOpenVPN(c net.Conn) {
 		log.Println("OpenVPN Closed")
 	}
 
+	d.openvpn.process = nil
+	d.openvpn.mgmt = nil
+	// Nobody can answer the requests of the exited process
+	d.cancelRequests()
+	// The servers of the tunnel are unreachable now
+	d.restoreDNS()
+	d.removeSplitRoutes()
+	state := d.openvpn.getState()
+	if state != Disconnecting && state != Failed {
+		reason := "openvpn exited unexpectedly"
+		if err != nil {
+			reason += ": " + err.Error()
+		}
+		if d.scheduleReconnect(reason) {
+			return
+		}
+		d.resetOpenvpn()
+		d.setState(Failed, reason, "")
+	} else {
+		// Reset before the state changes, so a new connection doesn't get reset
+		d.resetOpenvpn()
+		if state == Disconnecting {
+			d.setState(Idle, "openvpn exited", "")
+		}
+	}
 	d.broadcastMessage(messages.SimpleMsg(consts.MsgDisconnected))
 }
 
-func (d *Daemon) processMessage(msg *messages.Message, c net.Conn) {
+func (d *Daemon) processMessage(msg *messages.Message, c net.Conn, p *peer) {
 	d.mtx.Lock()
 	defer d.mtx.Unlock()
 
 	switch msg.Command {
+	case consts.MsgHello:
+		version, err := strconv.Atoi(msg.Args["version"])
+		if err != nil || version != consts.ProtocolVersion {
+			d.reply(msg, messages.ErrorCodeMsg(consts.ErrVersionMismatch,
+				fmt.Sprintf("protocol version %q is not supported, the daemon speaks version %d",
+					msg.Args["version"], consts.ProtocolVersion)), c)
+			return
+		}
+		d.subMtx.Lock()
+		if _, ok := d.subs[c]; !ok {
+			d.subs[c] = false
+		}
+		d.subMtx.Unlock()
+		d.reply(msg, messages.HelloMsg(), c)
+
+	case consts.MsgSubscribe:
+		// The snapshot is sent before any broadcast that comes after it
+		d.subMtx.Lock()
+		d.reply(msg, messages.StatusMsg(d.status()), c)
+		d.subs[c] = true
+		d.subMtx.Unlock()
+
+	case consts.MsgGetStatus:
+		d.reply(msg, messages.StatusMsg(d.status()), c)
+
+	case consts.MsgKillSwitchOff:
+		if err := disableKillSwitch(); err != nil {
+			log.Printf("Error: %v\n", err)
+			d.reply(msg, messages.ErrorMsg(err.Error()), c)
+			return
+		}
+		d.killSwitch = nil
+		d.replyOK(msg, c)
+
 	case consts.MsgStop:
+		d.replyOK(msg, c)
 		d.stopServer(c)
 
 	case consts.MsgConnect:
-		if err := d.prepareOpenvpn(msg, c); err != nil {
+		// The previous process may still be exiting after a failure
+		if state := d.openvpn.getState(); state.isActive() || d.openvpn.isRunning() {
+			d.reply(msg, invalidStateMsg(msg.Command, state), c)
+			return
+		}
+		if err := d.prepareOpenvpn(msg, c, p); err != nil {
 			log.Printf("Error: %v\n", err)
 			return
 		}
-		go d.startOpenVPN(c)
+		d.setPasswordClient(c)
+		d.setState(Starting, "connecting to "+filepath.Base(d.openvpn.config), "")
+		d.replyOK(msg, c)
+		go d.startOpenVPN()
 
 	case consts.MsgDisconnect:
-		if !d.openvpn.isRunning() {
-			messages.SendMessage(messages.ErrorMsg("OpenVPN is not running"), c)
+		switch state := d.openvpn.getState(); state {
+		case Idle, Disconnecting:
+			d.reply(msg, invalidStateMsg(msg.Command, state), c)
+			return
+		case Failed:
+			// Acknowledge the failure
+			d.setState(Idle, "failure dismissed", "")
+			d.replyOK(msg, c)
 			return
 		}
+		d.setState(Disconnecting, "disconnect requested", "")
 		if err := d.openvpn.closeConnection(); err != nil {
 			log.Println("Can't close openvpn")
-			messages.SendMessage(messages.ErrorMsg("Can't close openvpn"), c)
+			d.reply(msg, messages.ErrorMsg("Can't close openvpn"), c)
+			return
 		}
+		// Cancel a scheduled reconnect
+		d.wakeReconnect()
+		d.replyOK(msg, c)
 
 	case consts.MsgKillOpenvpn:
+		if d.openvpn.getState().isActive() {
+			d.setState(Disconnecting, "openvpn killed", "")
+		}
 		d.killOpenvpn()
+		d.replyOK(msg, c)
 
 	case consts.MsgGetBytecount:
-		messages.SendMessage(messages.BytecountMsg(d.openvpn.bytesIn, d.openvpn.bytesOut,
-			d.openvpn.totalIn, d.openvpn.bytesOut), c)
+		d.reply(msg, messages.BytecountMsg(d.openvpn.bytesIn, d.openvpn.bytesOut,
+			d.openvpn.totalIn, d.openvpn.totalOut), c)
+
+	case consts.MsgPasswordResponse, consts.MsgSignResponse, consts.MsgPKCS11IDResponse:
+		d.answerClient(msg, c)
+
+	case consts.MsgGetLogs:
+		d.logMtx.Lock()
+		logs := messages.LogsMsg(d.logs)
+		d.logMtx.Unlock()
+		d.reply(msg, logs, c)
 
 	default:
 		log.Printf("Unknown command: %v\n", msg.Command)
-		messages.SendMessage(messages.ErrorMsg(consts.UnknownCmd), c)
+		d.reply(msg, messages.ErrorMsg(consts.UnknownCmd), c)
+	}
+}
+
+// status returns the snapshot for GET_STATUS and SUBSCRIBE
+func (d *Daemon) status() messages.Status {
+	status := d.openvpn.status()
+	status.KillSwitch = d.killSwitch != nil
+	if d.netns.isEnabled() {
+		status.Namespace = consts.Netns
 	}
+	status.SOCKSPort, status.HTTPPort = d.proxyPorts()
+	return status
 }
 
-func (d *Daemon) writeToMgmt(text string, c net.Conn) {
-	text += "\n"
-	if _, err := c.Write([]byte(text)); err != nil {
-		log.Println("Error: can't write to openvpn management")
+// reply sends the response of a request with the same id
+func (d *Daemon) reply(req, resp *messages.Message, c net.Conn) {
+	d.send(resp.Reply(req), c)
+}
+
+// send writes a message to a client. Anyone can connect and close the socket before the reply,
+// a client that can't take the message is disconnected instead of stopping the daemon
+func (d *Daemon) send(msg *messages.Message, c net.Conn) bool {
+	if err := messages.WriteMessage(msg, c); err != nil {
+		log.Printf("Can't send %s, closing the connection: %v\n", msg.Command, err)
+		c.Close()
+		return false
+	}
+	return true
+}
+
+// setState changes the state of the connection and broadcasts the transition.
+// detail is the openvpn state that caused it, if any
+func (d *Daemon) setState(to State, reason, detail string) bool {
+	from, err := d.openvpn.setState(to)
+	if err != nil {
+		if from != to {
+			log.Printf("Ignoring state change: %v (%s)\n", err, reason)
+		}
+		return false
+	}
+	log.Printf("State: %v -> %v (%s)\n", from, to, reason)
+	d.broadcastMessage(messages.StateChangeMsg(to.String(), from.String(), reason, detail))
+	return true
+}
+
+// invalidStateMsg is the reply to commands that are not allowed in the current state
+func invalidStateMsg(cmd string, state State) *messages.Message {
+	resp := messages.ErrorCodeMsg(consts.ErrInvalidState,
+		fmt.Sprintf("%s is not allowed while the connection is %v", cmd, state))
+	resp.Args["state"] = state.String()
+	return resp
+}
+
+// replyOK confirms a successful request.
+// Requests without an id come from old clients that don't expect it
+func (d *Daemon) replyOK(req *messages.Message, c net.Conn) {
+	if req.ID != "" {
+		d.reply(req, messages.OkMsg(), c)
 	}
 }
 
 func (d *Daemon) connectToMgmt() {
 	tries := 10
-	var c net.Conn
+	var m Management
 
 	// Try connecting to mgmt socket until it's connected
 	// Maximum tries: 10 times
 	for {
 		var err error
-		c, err = net.Dial("unix", consts.MgmtSocket)
+		m, err = dialMgmt(consts.MgmtSocket)
 		if err != nil {
 			time.Sleep(300 * time.Millisecond)
 			if tries == 0 {
@@ -234,23 +482,26 @@ func (d *Daemon) connectToMgmt() {
 			break
 		}
 	}
-	defer c.Close()
+	defer m.Close()
+	d.openvpn.mgmt = m
 
 	// Starts the show
-	d.writeToMgmt("hold release", c)
-	d.writeToMgmt("state on", c)
-	d.writeToMgmt("bytecount 1", c)
+	go func() {
+		if err := m.State(true); err != nil {
+			d.mgmtError(err)
+		}
+		if err := m.ByteCount(1); err != nil {
+			d.mgmtError(err)
+		}
+		if err := m.HoldRelease(); err != nil {
+			d.mgmtError(err)
+		}
+	}()
 
-	scanner := bufio.NewScanner(c)
-	for scanner.Scan() {
-		txt := scanner.Text()
-		//TODO: Remove all debug lines after it's done
-		log.Println("MGMT: ", txt)
-		d.processMgmtCommand(txt, c)
-	}
-	if err := scanner.Err(); err != nil {
-		log.Printf("Management error: %v\n", err)
+	for ev := range m.Events() {
+		d.processMgmtEvent(ev)
 	}
+	log.Println("Management connection closed")
 }
 
 func (d *Daemon) killOpenvpn() {
@@ -261,115 +512,323 @@ func (d *Daemon) killOpenvpn() {
 }
 
 func (d *Daemon) resetOpenvpn() {
+	// Remove the private copy of the config
+	if d.openvpn.launchCopy {
+		if err := os.Remove(d.openvpn.launchConfig); err != nil {
+			log.Printf("Can't remove %s: %v\n", d.openvpn.launchConfig, err)
+		}
+	}
 	d.openvpn.config = ""
+	d.openvpn.launchConfig = ""
+	d.openvpn.trusted = false
+	d.openvpn.launchCopy = false
+	d.openvpn.externalKey = false
+	d.openvpn.pkcs11ID = ""
+	d.openvpn.upstream = nil
+	d.openvpn.upstreamInConfig = false
 	d.openvpn.bytesOut = 0
 	d.openvpn.bytesIn = 0
-	d.openvpn.connected = false
-	d.openvpn.state = ""
+	d.openvpn.process = nil
+	d.openvpn.mgmt = nil
+	d.openvpn.clearAddresses()
+	d.stopDNS()
+	d.stopSplit()
+	d.stopNamespace()
+	d.stopUsers()
+	d.stopProxy()
+	d.stopIPv6()
+	d.stopTransport()
+	d.cancelPasswords()
 	d.openvpn.creds = auth.Credentials{}
 }
 
+func (d *Daemon) addLog(line string) {
+	d.logMtx.Lock()
+	defer d.logMtx.Unlock()
+	d.logs = append(d.logs, line)
+	if len(d.logs) > consts.MaxLogLines {
+		d.logs = d.logs[len(d.logs)-consts.MaxLogLines:]
+	}
+}
+
 func (d *Daemon) broadcastMessage(msg *messages.Message) {
-	for _, conn := range d.conns {
-		if conn != nil {
-			messages.SendMessage(msg, conn)
+	d.subMtx.Lock()
+	defer d.subMtx.Unlock()
+	for i, conn := range d.conns {
+		if subscribed, ok := d.subs[conn]; ok && !subscribed {
+			continue
+		}
+		if conn != nil && !d.send(msg, conn) {
+			d.conns[i] = nil
+			delete(d.subs, conn)
 		}
 	}
 }
 
-func (d *Daemon) prepareOpenvpn(msg *messages.Message, c net.Conn) error {
-	if !d.openvpn.connected {
-		config, ok := msg.Args["config"]
+func (d *Daemon) prepareOpenvpn(msg *messages.Message, c net.Conn, p *peer) error {
+	config, ok := msg.Args["config"]
+	if !ok {
+		d.reply(msg, messages.ErrorMsg("Config is needed to start openvpn"), c)
+		return errors.New("no config was given")
+	}
+	authMethod, ok := msg.Args["authMethod"]
+	if !ok {
+		d.reply(msg, messages.ErrorMsg("Auth method is needed to start openvpn"), c)
+		return errors.New("no authMethod method was given")
+	}
+	d.openvpn.config = config
+	switch authMethod {
+	case consts.AuthNoAuth:
+		d.openvpn.creds = auth.Credentials{Auth: auth.NO_AUTH}
+	case consts.AuthUserPass:
+		username, ok := msg.Args["username"]
 		if !ok {
-			messages.SendMessage(messages.ErrorMsg("Config is needed to start openvpn"), c)
+			d.reply(msg, messages.ErrorMsg("Username is needed to start openvpn"), c)
 			return errors.New("no config was given")
 		}
-		authMethod, ok := msg.Args["authMethod"]
+		password, ok := msg.Args["password"]
 		if !ok {
-			messages.SendMessage(messages.ErrorMsg("Auth method is needed to start openvpn"), c)
-			return errors.New("no authMethod method was given")
-		}
-		d.openvpn.config = config
-		switch authMethod {
-		case consts.AuthNoAuth:
-			d.openvpn.creds = auth.Credentials{Auth: auth.NO_AUTH}
-		case consts.AuthUserPass:
-			username, ok := msg.Args["username"]
-			if !ok {
-				messages.SendMessage(messages.ErrorMsg("Username is needed to start openvpn"), c)
-				return errors.New("no config was given")
-			}
-			password, ok := msg.Args["password"]
-			if !ok {
-				messages.SendMessage(messages.ErrorMsg("Password is needed to start openvpn"), c)
-				return errors.New("no config was given")
-			}
-			d.openvpn.creds = auth.Credentials{Auth: auth.USER_PASS, Username: username, Password: password}
-		default:
-			d.resetOpenvpn()
-			messages.SendMessage(messages.ErrorMsg("Unknown authMethod type"), c)
-			return errors.New("unknown authMethod type")
+			d.reply(msg, messages.ErrorMsg("Password is needed to start openvpn"), c)
+			return errors.New("no config was given")
 		}
-	} else {
-		messages.SendMessage(messages.ErrorMsg("OpenVPN is already running"), c)
+		d.openvpn.creds = auth.Credentials{Auth: auth.USER_PASS, Username: username, Password: password}
+	default:
+		d.resetOpenvpn()
+		d.reply(msg, messages.ErrorMsg("Unknown authMethod type"), c)
+		return errors.New("unknown authMethod type")
 	}
-	return nil
-}
 
-func (d *Daemon) processMgmtCommand(cmd string, c net.Conn) {
-	if len(cmd) < 1 {
-		return
-	} else if cmd[0] != '>' {
-		if strings.HasPrefix(cmd, "ERROR:") {
-			colonIndex := strings.IndexRune(cmd, ':')
-			errstr := cmd[colonIndex+1:]
-			log.Println("Mgmt error: ", cmd[colonIndex+1:])
-			d.broadcastMessage(messages.ErrorMsg(errstr))
-			return
+	policy, err := reconnect.FromArgs(msg.Args)
+	if err != nil {
+		d.resetOpenvpn()
+		d.reply(msg, messages.ErrorMsg(err.Error()), c)
+		return err
+	}
+	d.openvpn.policy = policy
+	d.openvpn.attempt = 0
+	d.openvpn.failover = newFailover(policy.FailoverAfter)
+	d.openvpn.wake = make(chan struct{}, 1)
+
+	// Check the config before it's given to openvpn
+	launchConfig, trusted, err := prepareConfig(config, d.scriptPolicy, p)
+	if err != nil {
+		d.resetOpenvpn()
+		d.reply(msg, messages.ErrorMsg(err.Error()), c)
+		return err
+	}
+	d.openvpn.launchConfig = launchConfig
+	d.openvpn.trusted = trusted
+	d.openvpn.launchCopy = !trusted
+	d.openvpn.pkcs11ID = msg.Args["pkcs11_id"]
+
+	if err := d.prepareExternalKey(msg.Args); err != nil {
+		d.resetOpenvpn()
+		d.reply(msg, messages.ErrorMsg("Can't use the external key: "+err.Error()), c)
+		return err
+	}
+
+	if err := d.prepareUpstream(msg.Args); err != nil {
+		d.resetOpenvpn()
+		d.reply(msg, messages.ErrorMsg("Can't use the proxy: "+err.Error()), c)
+		return err
+	}
+
+	if err := d.prepareTransport(msg.Args, p); err != nil {
+		d.resetOpenvpn()
+		d.reply(msg, messages.ErrorMsg("Can't use the transport: "+err.Error()), c)
+		return err
+	}
+
+	if err := d.prepareKillSwitch(msg.Args); err != nil {
+		d.resetOpenvpn()
+		if err == errKillSwitchActive {
+			d.reply(msg, messages.ErrorCodeMsg(consts.ErrKillSwitchActive, err.Error()), c)
+		} else {
+			d.reply(msg, messages.ErrorMsg("Can't enable the kill switch: "+err.Error()), c)
 		}
+		return err
 	}
 
-	fieldsFunc := func(r rune) bool {
-		return r == ','
+	if err := d.prepareDNS(msg.Args); err != nil {
+		d.resetOpenvpn()
+		d.reply(msg, messages.ErrorMsg(err.Error()), c)
+		return err
 	}
-	colonIndex := strings.IndexRune(cmd, ':')
 
-	switch cmd[1:colonIndex] {
-	case "PASSWORD":
-		const errstr = "Verification Failed"
-		if strings.Contains(cmd, errstr) {
-			log.Println("Invalid credentials")
-			d.broadcastMessage(messages.ErrorMsg(consts.MsgAuthFailed))
-			return
+	if err := d.prepareSplit(msg.Args); err != nil {
+		d.resetOpenvpn()
+		d.reply(msg, messages.ErrorMsg(err.Error()), c)
+		return err
+	}
+
+	if err := d.prepareNamespace(msg.Args); err != nil {
+		d.resetOpenvpn()
+		d.reply(msg, messages.ErrorMsg("Can't create the namespace: "+err.Error()), c)
+		return err
+	}
+
+	if err := d.prepareUsers(msg.Args); err != nil {
+		d.resetOpenvpn()
+		d.reply(msg, messages.ErrorMsg(err.Error()), c)
+		return err
+	}
+
+	if err := d.prepareProxy(msg.Args); err != nil {
+		d.resetOpenvpn()
+		d.reply(msg, messages.ErrorMsg(err.Error()), c)
+		return err
+	}
+
+	if err := d.prepareIPv6(msg.Args); err != nil {
+		d.resetOpenvpn()
+		d.reply(msg, messages.ErrorMsg("Can't prepare the IPv6 block: "+err.Error()), c)
+		return err
+	}
+	return nil
+}
+
+func (d *Daemon) mgmtError(err error) {
+	log.Println("Mgmt error: ", err)
+	if cmdErr, ok := err.(*mgmt.CommandError); ok {
+		d.broadcastMessage(messages.ErrorMsg(cmdErr.Message))
+	}
+}
+
+func (d *Daemon) processMgmtEvent(ev mgmt.Event) {
+	switch ev := ev.(type) {
+	case mgmt.PasswordEvent:
+		switch ev.Kind {
+		case mgmt.PasswordFailed:
+			if ev.Dynamic != nil {
+				// openvpn asks for the credentials again, the response goes with them
+				log.Println("The server sent a challenge")
+				d.setDynamicChallenge(ev.Dynamic)
+				return
+			}
+			if ev.Type == "Auth" {
+				log.Println("Invalid credentials")
+				d.broadcastMessage(messages.ErrorMsg(consts.MsgAuthFailed))
+				d.setState(Failed, "authentication failed", "")
+			} else {
+				log.Printf("Invalid %s password\n", ev.Type)
+				d.broadcastMessage(messages.ErrorMsg("Wrong " + ev.Type + " password"))
+				d.setState(Failed, "the "+ev.Type+" password is wrong", "")
+			}
+			// With --auth-retry interact openvpn would wait for other credentials
+			_ = d.openvpn.closeConnection()
+		case mgmt.PasswordNeed:
+			d.setState(Authenticating, "openvpn asked for the "+ev.Type+" credentials", "")
+			// Don't block the event loop while waiting for the replies
+			go func(m Management) {
+				username, password, err := d.credentials(ev)
+				if err == errPasswordCanceled {
+					return
+				} else if err != nil {
+					d.passwordFailed(err)
+					return
+				}
+				if ev.NeedUsername {
+					if err := m.Username(ev.Type, username); err != nil {
+						d.mgmtError(err)
+						return
+					}
+				}
+				if err := m.Password(ev.Type, password); err != nil {
+					d.mgmtError(err)
+				}
+			}(d.openvpn.mgmt)
 		}
-		userpass := fmt.Sprintf(`username "Auth" %s
-								 password "Auth" %s`,
-			d.openvpn.creds.Username, d.openvpn.creds.Password)
 
-		d.writeToMgmt(userpass, c)
+	case mgmt.PkSignEvent:
+		// The request is canceled when openvpn exits, the signature is dropped then
+		go func(m Management) {
+			signature, err := d.signature(ev)
+			if err == errPasswordCanceled {
+				return
+			} else if err != nil {
+				d.passwordFailed(err)
+				return
+			}
+			if err := m.PkSig(signature); err != nil {
+				d.mgmtError(err)
+			}
+		}(d.openvpn.mgmt)
+
+	case mgmt.StateEvent:
+		d.openvpn.setAddresses(ev)
+		if state, ok := stateFromOpenvpn(ev.Name); ok {
+			if state == Connected {
+				d.openvpn.attempt = 0
+				d.openvpn.failover.connected()
+				d.applyNamespace()
+				d.applyUsers()
+				d.applyProxy()
+			}
+			reason := ev.Description
+			if reason == "" {
+				reason = "openvpn is " + strings.ToLower(ev.Name)
+			}
+			d.setState(state, reason, ev.Name)
+			if state == Connected {
+				d.applyDNS()
+				d.applyIPv6Block()
+				// Resolving the domains of the rules takes time
+				go d.applySplit()
+			}
+		}
 
-	case "STATE":
-		state := cmd[colonIndex+1:]
-		states := strings.FieldsFunc(state, fieldsFunc)
-		if len(state) < 2 {
-			return
+	case mgmt.RemoteEvent:
+		accept := d.openvpn.failover.offer(remoteKey(ev.Host, ev.Port, ev.Proto))
+		if !accept {
+			log.Printf("Skipping remote %s:%d\n", ev.Host, ev.Port)
+		}
+		go func(m Management) {
+			if err := m.Remote(accept); err != nil {
+				d.mgmtError(err)
+			}
+		}(d.openvpn.mgmt)
+
+	case mgmt.ProxyEvent:
+		proxy := d.openvpn.upstream
+		if proxy != nil {
+			log.Printf("Connecting through the proxy %s\n", proxy)
 		}
-		state = states[1]
-		d.broadcastMessage(messages.StateMsg(state))
+		go func(m Management) {
+			var err error
+			if proxy == nil {
+				err = m.Proxy("", "", 0)
+			} else {
+				err = m.Proxy(upstreamType(proxy), proxy.Host, proxy.Port)
+			}
+			if err != nil {
+				d.mgmtError(err)
+			}
+		}(d.openvpn.mgmt)
 
-	case "BYTECOUNT":
-		data := cmd[colonIndex+1:]
-		inout := strings.FieldsFunc(data, fieldsFunc)
-		if len(inout) < 2 {
+	case mgmt.NeedStrEvent:
+		if ev.Name != "pkcs11-id-request" {
+			log.Printf("Unknown string request %q: %s\n", ev.Name, ev.Message)
 			return
 		}
+		d.setState(Authenticating, "openvpn asked for the certificate of the token", "")
+		go func(m Management) {
+			id, err := d.pkcs11ID(m)
+			if err == errPasswordCanceled {
+				return
+			} else if err != nil {
+				d.passwordFailed(err)
+				return
+			}
+			if err := m.NeedStr(ev.Name, id); err != nil {
+				d.mgmtError(err)
+			}
+		}(d.openvpn.mgmt)
 
-		in, _ := strconv.ParseUint(inout[0], 10, 64)
-		out, _ := strconv.ParseUint(inout[1], 10, 64)
-		d.openvpn.totalIn += in - d.openvpn.bytesIn
-		d.openvpn.totalOut += out - d.openvpn.bytesOut
-		d.openvpn.bytesIn = in
-		d.openvpn.bytesOut = out
-	}
+	case mgmt.ByteCountEvent:
+		d.openvpn.addByteCount(ev.In, ev.Out)
 
+	case mgmt.FatalEvent:
+		d.broadcastMessage(messages.ErrorMsg(ev.Message))
+		d.setState(Failed, ev.Message, "")
+	}
 }
@@ -0,0 +1,32 @@
+package daemon
+
+import (
+	"bufio"
+	"github.com/TheWeirdDev/Vodga/shared/consts"
+	"github.com/TheWeirdDev/Vodga/shared/messages"
+	"net"
+	"testing"
+)
+
+func TestBroadcastToClosedClient(t *testing.T) {
+	gone, goneServer := unixPair(t)
+	client, server := unixPair(t)
+	defer client.Close()
+	defer server.Close()
+	d := &Daemon{conns: []net.Conn{goneServer, server}, subs: map[net.Conn]bool{goneServer: true}}
+
+	// The client closes the socket before the daemon answers
+	gone.Close()
+	d.reply(messages.SimpleMsg(consts.MsgHello), messages.OkMsg(), goneServer)
+	d.broadcastMessage(messages.SimpleMsg(consts.MsgKilled))
+	if d.conns[0] != nil || len(d.subs) != 0 {
+		t.Error("the closed client is still subscribed")
+	}
+	scanner := bufio.NewScanner(client)
+	if !scanner.Scan() {
+		t.Fatal(scanner.Err())
+	}
+	if msg, err := messages.UnmarshalMsg(scanner.Text()); err != nil || msg.Command != consts.MsgKilled {
+		t.Errorf("wrong message %q", scanner.Text())
+	}
+}
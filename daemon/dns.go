@@ -0,0 +1,413 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/TheWeirdDev/Vodga/shared/consts"
+	"github.com/TheWeirdDev/Vodga/shared/messages"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DNSMode selects how the DNS servers pushed by the server are applied
+type DNSMode int
+
+const (
+	// DNSAuto uses systemd-resolved if it manages /etc/resolv.conf
+	DNSAuto DNSMode = iota
+	DNSResolved
+	DNSResolvConf
+	DNSOff
+)
+
+// ParseDNSMode converts a command line value into a mode
+func ParseDNSMode(s string) (DNSMode, error) {
+	switch s {
+	case "auto":
+		return DNSAuto, nil
+	case "resolved":
+		return DNSResolved, nil
+	case "resolvconf":
+		return DNSResolvConf, nil
+	case "off":
+		return DNSOff, nil
+	default:
+		return DNSAuto, fmt.Errorf("unknown dns mode \"%s\"", s)
+	}
+}
+
+const resolvConf = "/etc/resolv.conf"
+
+var (
+	// The original resolv.conf, or the target of the link if it was a symlink
+	resolvConfBackup = filepath.Join(consts.StateDir, "resolv.conf.backup")
+	resolvConfLink   = filepath.Join(consts.StateDir, "resolv.conf.link")
+	// The link that systemd-resolved was configured for
+	resolvedState = filepath.Join(consts.StateDir, "resolved.json")
+)
+
+// dnsConfig is the DNS part of the options that the server pushed
+type dnsConfig struct {
+	Servers []string
+	Domains []string
+}
+
+// pushOptions returns the options of a line like
+// "PUSH: Received control message: 'PUSH_REPLY,dhcp-option DNS 10.8.0.1,...'"
+func pushOptions(line string) ([]string, bool) {
+	i := strings.Index(line, "PUSH_REPLY,")
+	if i < 0 {
+		return nil, false
+	}
+	reply := strings.TrimSuffix(line[i+len("PUSH_REPLY,"):], "'")
+	return strings.Split(reply, ","), true
+}
+
+// parsePushReply reads the dhcp-options of a PUSH_REPLY line
+func parsePushReply(line string) (dnsConfig, bool) {
+	options, ok := pushOptions(line)
+	if !ok {
+		return dnsConfig{}, false
+	}
+	cfg := dnsConfig{}
+	for _, option := range options {
+		fields := strings.Fields(option)
+		if len(fields) != 3 || fields[0] != "dhcp-option" {
+			continue
+		}
+		switch fields[1] {
+		case "DNS", "DNS6":
+			if net.ParseIP(fields[2]) != nil {
+				cfg.Servers = append(cfg.Servers, fields[2])
+			}
+		case "DOMAIN", "DOMAIN-SEARCH":
+			cfg.Domains = append(cfg.Domains, fields[2])
+		}
+	}
+	return cfg, true
+}
+
+// parseTunDevice reads the device of a line like "TUN/TAP device tun0 opened"
+func parseTunDevice(line string) (string, bool) {
+	i := strings.Index(line, "TUN/TAP device ")
+	if i < 0 || !strings.HasSuffix(line, " opened") {
+		return "", false
+	}
+	dev := strings.TrimSuffix(line[i+len("TUN/TAP device "):], " opened")
+	return dev, dev != "" && !strings.Contains(dev, " ")
+}
+
+type dnsBackend interface {
+	apply(dev string, cfg dnsConfig) error
+	// restore undoes apply, it's also used for the state of a daemon that crashed
+	restore() error
+}
+
+func newDNSBackend(mode DNSMode) dnsBackend {
+	switch mode {
+	case DNSResolved:
+		return &resolvedBackend{}
+	case DNSResolvConf:
+		return &resolvConfBackend{}
+	case DNSOff:
+		return nil
+	}
+	if target, err := filepath.EvalSymlinks(resolvConf); err == nil && strings.Contains(target, "systemd/resolve") {
+		return &resolvedBackend{}
+	}
+	return &resolvConfBackend{}
+}
+
+// resolvedBackend configures the tunnel link with the D-Bus API of systemd-resolved
+type resolvedBackend struct{}
+
+func busctl(method, signature string, args ...string) error {
+	cmdArgs := append([]string{"call", "org.freedesktop.resolve1", "/org/freedesktop/resolve1",
+		"org.freedesktop.resolve1.Manager", method, signature}, args...)
+	if out, err := exec.Command("busctl", cmdArgs...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %v: %s", method, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (r *resolvedBackend) apply(dev string, cfg dnsConfig) error {
+	iface, err := net.InterfaceByName(dev)
+	if err != nil {
+		return err
+	}
+	link := strconv.Itoa(iface.Index)
+
+	// a(iay): address family and the bytes of each address
+	dnsArgs := []string{link, strconv.Itoa(len(cfg.Servers))}
+	for _, server := range cfg.Servers {
+		ip := net.ParseIP(server)
+		family, addr := "10", ip.To16()
+		if ip4 := ip.To4(); ip4 != nil {
+			family, addr = "2", ip4
+		}
+		dnsArgs = append(dnsArgs, family, strconv.Itoa(len(addr)))
+		for _, b := range addr {
+			dnsArgs = append(dnsArgs, strconv.Itoa(int(b)))
+		}
+	}
+	// a(sb): search domains, and "." as a routing domain so every query goes through the tunnel
+	domainArgs := []string{link, strconv.Itoa(len(cfg.Domains) + 1)}
+	for _, domain := range cfg.Domains {
+		domainArgs = append(domainArgs, domain, "false")
+	}
+	domainArgs = append(domainArgs, ".", "true")
+
+	data, err := json.Marshal(iface.Index)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(consts.StateDir, 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(resolvedState, data, 0600); err != nil {
+		return err
+	}
+	if err := busctl("SetLinkDNS", "ia(iay)", dnsArgs...); err != nil {
+		return err
+	}
+	if err := busctl("SetLinkDomains", "ia(sb)", domainArgs...); err != nil {
+		return err
+	}
+	// Older versions of systemd-resolved don't have it
+	if err := busctl("SetLinkDefaultRoute", "ib", link, "true"); err != nil {
+		log.Printf("DNS: %v\n", err)
+	}
+	return nil
+}
+
+func (r *resolvedBackend) restore() error {
+	data, err := ioutil.ReadFile(resolvedState)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var link int
+	if err := json.Unmarshal(data, &link); err != nil {
+		return err
+	}
+	// The link is gone if openvpn exited, there's nothing to revert then
+	if _, err := net.InterfaceByIndex(link); err == nil {
+		if err := busctl("RevertLink", "i", strconv.Itoa(link)); err != nil {
+			return err
+		}
+	}
+	return os.Remove(resolvedState)
+}
+
+// resolvConfBackend replaces /etc/resolv.conf and keeps a backup of it
+type resolvConfBackend struct{}
+
+func (r *resolvConfBackend) apply(dev string, cfg dnsConfig) error {
+	if err := os.MkdirAll(consts.StateDir, 0700); err != nil {
+		return err
+	}
+	// Don't take our own file as the original after a crash
+	if !fileExists(resolvConfBackup) && !fileExists(resolvConfLink) {
+		if target, err := os.Readlink(resolvConf); err == nil {
+			if err := ioutil.WriteFile(resolvConfLink, []byte(target), 0600); err != nil {
+				return err
+			}
+		} else {
+			data, err := ioutil.ReadFile(resolvConf)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := ioutil.WriteFile(resolvConfBackup, data, 0644); err != nil {
+				return err
+			}
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("# Generated by vodga for " + dev + ", the original is restored on disconnect\n")
+	for _, server := range cfg.Servers {
+		b.WriteString("nameserver " + server + "\n")
+	}
+	if len(cfg.Domains) > 0 {
+		b.WriteString("search " + strings.Join(cfg.Domains, " ") + "\n")
+	}
+	// Write a new file instead of following a symlink
+	tmp := resolvConf + ".vodga"
+	if err := ioutil.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, resolvConf)
+}
+
+func (r *resolvConfBackend) restore() error {
+	if target, err := ioutil.ReadFile(resolvConfLink); err == nil {
+		tmp := resolvConf + ".vodga"
+		os.Remove(tmp)
+		if err := os.Symlink(string(target), tmp); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, resolvConf); err != nil {
+			return err
+		}
+		return os.Remove(resolvConfLink)
+	}
+	data, err := ioutil.ReadFile(resolvConfBackup)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(resolvConf, data, 0644); err != nil {
+		return err
+	}
+	return os.Remove(resolvConfBackup)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// dnsState follows the output of openvpn and applies its DNS servers once it's connected
+type dnsState struct {
+	mtx     sync.Mutex
+	backend dnsBackend
+	dev     string
+	pushed  dnsConfig
+	applied bool
+	// The servers of the profile that replace the pushed ones
+	override []string
+	// The stub that the system uses when the profile enables it
+	stub *dnsStub
+}
+
+// servers returns the servers of the connection, the ones of the profile take precedence
+func (s *dnsState) servers() []string {
+	if len(s.override) > 0 {
+		return s.override
+	}
+	return s.pushed.Servers
+}
+
+// restoreStaleDNS undoes the changes of a daemon that didn't exit cleanly
+func restoreStaleDNS() {
+	for _, backend := range []dnsBackend{&resolvedBackend{}, &resolvConfBackend{}} {
+		if err := backend.restore(); err != nil {
+			log.Printf("Can't restore the DNS configuration: %v\n", err)
+		}
+	}
+}
+
+// processLogLine picks the device and the pushed options from the output of openvpn
+func (d *Daemon) processLogLine(line string) {
+	if dev, ok := parseTunDevice(line); ok {
+		d.dns.mtx.Lock()
+		d.dns.dev = dev
+		d.dns.mtx.Unlock()
+	} else if cfg, ok := parsePushReply(line); ok {
+		d.dns.mtx.Lock()
+		d.dns.pushed = cfg
+		d.dns.mtx.Unlock()
+		ipv6, _ := parsePushIPv6(line)
+		d.openvpn.setPushedIPv6(ipv6.Address)
+		d.ipv6.setPushed(ipv6)
+		// The line may come after openvpn says it's connected
+		d.applyDNS()
+		if d.openvpn.getState() == Connected {
+			d.applyNamespace()
+			d.applyIPv6Block()
+		}
+	}
+}
+
+// applyDNS configures the pushed DNS servers when the tunnel is up
+func (d *Daemon) applyDNS() {
+	d.dns.mtx.Lock()
+	defer d.dns.mtx.Unlock()
+	servers := d.dns.servers()
+	// The DNS of the host is not changed in namespace mode
+	if d.dns.backend == nil || d.netns.isEnabled() || d.dns.applied || d.dns.dev == "" || len(servers) == 0 ||
+		d.openvpn.getState() != Connected {
+		return
+	}
+	cfg := dnsConfig{Servers: servers, Domains: d.dns.pushed.Domains}
+	if d.dns.stub != nil {
+		// The stub forwards to the servers
+		cfg.Servers = []string{consts.DNSStubIP}
+	}
+	if err := d.dns.backend.apply(d.dns.dev, cfg); err != nil {
+		log.Printf("Can't apply the DNS servers: %v\n", err)
+		d.broadcastMessage(messages.ErrorMsg("Can't apply the DNS servers: " + err.Error()))
+		return
+	}
+	d.dns.applied = true
+	log.Printf("DNS servers of %s: %s\n", d.dns.dev, strings.Join(servers, ", "))
+}
+
+// restoreDNS undoes applyDNS and forgets the options of the connection
+func (d *Daemon) restoreDNS() {
+	d.dns.mtx.Lock()
+	defer d.dns.mtx.Unlock()
+	if d.dns.applied {
+		if err := d.dns.backend.restore(); err != nil {
+			log.Printf("Can't restore the DNS configuration: %v\n", err)
+		}
+	}
+	d.dns.applied = false
+	d.dns.dev = ""
+	d.dns.pushed = dnsConfig{}
+}
+
+// prepareDNS reads the DNS settings of a profile and starts the stub if it's enabled
+func (d *Daemon) prepareDNS(args map[string]string) error {
+	var override []string
+	if args["dns"] != "" {
+		for _, server := range strings.Split(args["dns"], ",") {
+			if net.ParseIP(server) == nil {
+				return fmt.Errorf("invalid DNS server %q", server)
+			}
+			override = append(override, server)
+		}
+	}
+	var stub *dnsStub
+	if args["dns_stub"] == "true" {
+		var err error
+		stub, err = startDNSStub(net.JoinHostPort(consts.DNSStubIP, "53"), d.dnsUpstream)
+		if err != nil {
+			return fmt.Errorf("can't start the DNS stub: %v", err)
+		}
+	}
+	d.dns.mtx.Lock()
+	d.dns.override = override
+	d.dns.stub = stub
+	d.dns.mtx.Unlock()
+	return nil
+}
+
+// dnsUpstream gives the stub the servers of the tunnel, only when it's connected
+func (d *Daemon) dnsUpstream() (string, []string, bool) {
+	d.dns.mtx.Lock()
+	defer d.dns.mtx.Unlock()
+	return d.dns.dev, d.dns.servers(), d.dns.dev != "" && d.openvpn.getState() == Connected
+}
+
+// stopDNS forgets the DNS settings of the profile
+func (d *Daemon) stopDNS() {
+	d.dns.mtx.Lock()
+	stub := d.dns.stub
+	d.dns.stub = nil
+	d.dns.override = nil
+	d.dns.mtx.Unlock()
+	// The stub calls dnsUpstream until it's closed
+	if stub != nil {
+		stub.close()
+	}
+}
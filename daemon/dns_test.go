@@ -0,0 +1,65 @@
+package daemon
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParsePushReply(t *testing.T) {
+	line := "2019-10-10 10:10:10 PUSH: Received control message: 'PUSH_REPLY,redirect-gateway def1," +
+		"dhcp-option DNS 10.8.0.1,dhcp-option DNS6 fd00::1,dhcp-option DOMAIN corp.example," +
+		"dhcp-option DNS not-an-ip,route-gateway 10.8.0.1,ifconfig 10.8.0.2 255.255.255.0'"
+	cfg, ok := parsePushReply(line)
+	if !ok {
+		t.Fatal("the push reply wasn't found")
+	}
+	want := dnsConfig{Servers: []string{"10.8.0.1", "fd00::1"}, Domains: []string{"corp.example"}}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got %+v, want %+v", cfg, want)
+	}
+	if _, ok := parsePushReply("2019-10-10 10:10:10 Initialization Sequence Completed"); ok {
+		t.Error("a line without a push reply was parsed")
+	}
+}
+
+func TestParseTunDevice(t *testing.T) {
+	if dev, ok := parseTunDevice("2019-10-10 10:10:10 TUN/TAP device tun0 opened"); !ok || dev != "tun0" {
+		t.Errorf("got %q %v", dev, ok)
+	}
+	if _, ok := parseTunDevice("2019-10-10 10:10:10 TUN/TAP TX queue length set to 100"); ok {
+		t.Error("a line without a device was parsed")
+	}
+}
+
+func TestDNSStubRefusesWhileDown(t *testing.T) {
+	stub, err := startDNSStub("127.0.0.1:0", func() (string, []string, bool) {
+		return "", nil, false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stub.close()
+
+	conn, err := net.Dial("udp", stub.udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// A query for "example.com A" with the id 0x1234 and RD set
+	query := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0,
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1}
+	if _, err := conn.Write(query); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp := make([]byte, 512)
+	n, err := conn.Read(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 12 || resp[0] != 0x12 || resp[1] != 0x34 || resp[2]&0x80 == 0 || resp[3]&0x0f != 5 {
+		t.Errorf("expected a REFUSED response, got % x", resp[:n])
+	}
+}
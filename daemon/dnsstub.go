@@ -0,0 +1,181 @@
+package daemon
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	dnsTimeout = 3 * time.Second
+	// Big enough for EDNS responses
+	maxDNSPacket = 4096
+)
+
+// dnsUpstream returns the device of the tunnel and the servers to forward to.
+// ok is false while the tunnel is down
+type dnsUpstream func() (dev string, servers []string, ok bool)
+
+// dnsStub is a DNS forwarder on a loopback address.
+// Queries only leave through the tunnel device, they are refused while the tunnel is down
+type dnsStub struct {
+	udp      *net.UDPConn
+	tcp      net.Listener
+	upstream dnsUpstream
+	wg       sync.WaitGroup
+}
+
+func startDNSStub(addr string, upstream dnsUpstream) (*dnsStub, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		return nil, err
+	}
+	stub := &dnsStub{udp: udp, tcp: tcp, upstream: upstream}
+	stub.wg.Add(2)
+	go stub.serveUDP()
+	go stub.serveTCP()
+	return stub, nil
+}
+
+func (s *dnsStub) close() {
+	s.udp.Close()
+	s.tcp.Close()
+	s.wg.Wait()
+}
+
+func (s *dnsStub) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, maxDNSPacket)
+	for {
+		n, client, err := s.udp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := s.resolve("udp", query); resp != nil {
+				_, _ = s.udp.WriteToUDP(resp, client)
+			}
+		}()
+	}
+}
+
+func (s *dnsStub) serveTCP() {
+	defer s.wg.Done()
+	for {
+		c, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			_ = c.SetDeadline(time.Now().Add(2 * dnsTimeout))
+			for {
+				query, err := readTCPMessage(c)
+				if err != nil {
+					return
+				}
+				resp := s.resolve("tcp", query)
+				if resp == nil || writeTCPMessage(c, resp) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// resolve forwards a query, nil is returned for packets that are not queries
+func (s *dnsStub) resolve(network string, query []byte) []byte {
+	if len(query) < 12 || query[2]&0x80 != 0 {
+		return nil
+	}
+	dev, servers, ok := s.upstream()
+	if !ok || len(servers) == 0 {
+		return refusedResponse(query)
+	}
+	for _, server := range servers {
+		resp, err := forwardDNS(network, dev, server, query)
+		if err == nil {
+			return resp
+		}
+		log.Printf("DNS stub: %s: %v\n", server, err)
+	}
+	return refusedResponse(query)
+}
+
+// forwardDNS sends a query to a server through a device
+func forwardDNS(network, dev, server string, query []byte) ([]byte, error) {
+	dialer := deviceDialer(dev, dnsTimeout)
+	conn, err := dialer.Dial(network, net.JoinHostPort(server, "53"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(dnsTimeout))
+
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxDNSPacket)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore responses that are not for this query
+		if n >= 12 && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// refusedResponse answers a query with REFUSED and no records
+func refusedResponse(query []byte) []byte {
+	resp := make([]byte, 12)
+	// Same id, QR set, same opcode and RD, RA set, RCODE 5
+	copy(resp, query[:2])
+	resp[2] = 0x80 | query[2]&0x79
+	resp[3] = 0x80 | 5
+	return resp
+}
+
+// TCP messages have a two byte length prefix
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size < 12 {
+		return nil, errors.New("message is too short")
+	}
+	msg := make([]byte, size)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,169 @@
+package daemon
+
+import (
+	"errors"
+	"github.com/TheWeirdDev/Vodga/shared/consts"
+	"github.com/TheWeirdDev/Vodga/shared/messages"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Descriptors that a client can pass with one read, stdin, stdout and stderr
+const maxPassedFds = 3
+
+// rightsReader reads a client connection and keeps the descriptors that come with the data
+type rightsReader struct {
+	conn *net.UnixConn
+	mtx  sync.Mutex
+	fds  []int
+}
+
+func (r *rightsReader) Read(b []byte) (int, error) {
+	oob := make([]byte, syscall.CmsgSpace(maxPassedFds*4))
+	n, oobn, _, _, err := r.conn.ReadMsgUnix(b, oob)
+	if oobn > 0 {
+		if cmsgs, err := syscall.ParseSocketControlMessage(oob[:oobn]); err == nil {
+			for i := range cmsgs {
+				if fds, err := syscall.ParseUnixRights(&cmsgs[i]); err == nil {
+					r.add(fds)
+				}
+			}
+		}
+	}
+	return n, err
+}
+
+// add keeps the descriptors for the next EXEC, older ones are closed
+// so a client can't make the daemon hold any number of them
+func (r *rightsReader) add(fds []int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.fds = append(r.fds, fds...)
+	for len(r.fds) > maxPassedFds {
+		syscall.Close(r.fds[0])
+		r.fds = r.fds[1:]
+	}
+}
+
+// take returns the descriptors that were received so far
+func (r *rightsReader) take() []*os.File {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	files := make([]*os.File, len(r.fds))
+	for i, fd := range r.fds {
+		files[i] = os.NewFile(uintptr(fd), "fd"+strconv.Itoa(fd))
+	}
+	r.fds = nil
+	return files
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// The environment of ip and setpriv, they run as root and must not see the one of the client
+var rootEnv = []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}
+
+// execCmd returns the command that runs argv in the namespace.
+// setpriv drops root after "ip netns exec" has entered the namespace and mounted its resolv.conf,
+// the environment and the directory of the client are only used after that
+func execCmd(uid, gid, dir string, env, argv []string) *exec.Cmd {
+	args := []string{"netns", "exec", consts.Netns, "setpriv", "--reuid=" + uid, "--regid=" + gid,
+		"--init-groups", "--", "env", "-i"}
+	for _, v := range env {
+		if validEnvVar(v) {
+			args = append(args, v)
+		}
+	}
+	args = append(args, "sh", "-c", `if [ -n "$1" ]; then cd "$1" || exit 126; fi; shift; exec "$@"`, "sh", dir)
+	cmd := exec.Command("ip", append(args, argv...)...)
+	cmd.Env = rootEnv
+	cmd.Dir = "/"
+	return cmd
+}
+
+// validEnvVar tells if a NAME=value can be given to env, other words would be read as its options or the command
+func validEnvVar(v string) bool {
+	eq := strings.IndexByte(v, '=')
+	if eq <= 0 {
+		return false
+	}
+	for i, c := range v[:eq] {
+		if !(c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// execCommand runs a command of a client in the namespace of the tunnel, as the user of the client.
+// The reply has the pid of the command, EXEC_EXITED is sent to the client when it exits
+func (d *Daemon) execCommand(msg *messages.Message, c net.Conn, p *peer, stdio []*os.File) {
+	defer closeFiles(stdio)
+	if len(stdio) != 3 {
+		d.reply(msg, messages.ErrorMsg("EXEC needs the stdin, stdout and stderr of the command"), c)
+		return
+	}
+	argv, env, err := messages.ParseExec(msg)
+	if err != nil {
+		d.reply(msg, messages.ErrorMsg(err.Error()), c)
+		return
+	}
+
+	d.mtx.Lock()
+	err = d.checkExec(msg.Args["config"])
+	d.mtx.Unlock()
+	if err != nil {
+		d.reply(msg, messages.ErrorCodeMsg(consts.ErrInvalidState, err.Error()), c)
+		return
+	}
+
+	usr, err := user.LookupId(strconv.FormatUint(uint64(p.uid), 10))
+	if err != nil {
+		d.reply(msg, messages.ErrorMsg("Can't find the user of the client: "+err.Error()), c)
+		return
+	}
+	cmd := execCmd(usr.Uid, strconv.FormatUint(uint64(p.gid), 10), msg.Args["dir"], env, argv)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdio[0], stdio[1], stdio[2]
+	// Not a child of the daemon's session, it stays when the daemon restarts
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		d.reply(msg, messages.ErrorMsg("Can't run the command: "+err.Error()), c)
+		return
+	}
+	pid := cmd.Process.Pid
+	log.Printf("Started %q in %s for uid %d (pid %d)\n", argv[0], consts.Netns, p.uid, pid)
+	d.reply(msg, messages.ExecStartedMsg(pid), c)
+
+	go func() {
+		code := 0
+		if err := cmd.Wait(); err != nil {
+			code = -1
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				code = exitErr.ExitCode()
+			}
+		}
+		// The client may be gone already
+		_ = messages.WriteMessage(messages.ExecExitedMsg(pid, code), c)
+	}()
+}
+
+// checkExec returns an error if commands can't run in the namespace of a config
+func (d *Daemon) checkExec(config string) error {
+	if !d.openvpn.getState().isActive() || d.openvpn.config != config {
+		return errors.New("not connected to this config")
+	}
+	if !d.netns.isEnabled() {
+		return errors.New("the connection is not in namespace mode")
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package daemon
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func unixPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns [2]*net.UnixConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = c.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+func TestRightsReader(t *testing.T) {
+	client, server := unixPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	rights := syscall.UnixRights(int(w.Fd()), int(w.Fd()), int(w.Fd()), int(w.Fd()))
+	if _, _, err := client.WriteMsgUnix([]byte("{\"cmd\":\"EXEC\"}\n"), rights, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := &rightsReader{conn: server}
+	scanner := bufio.NewScanner(reader)
+	if !scanner.Scan() || scanner.Text() != "{\"cmd\":\"EXEC\"}" {
+		t.Fatalf("wrong message: %q, %v", scanner.Text(), scanner.Err())
+	}
+	files := reader.take()
+	defer closeFiles(files)
+	// Only the last maxPassedFds are kept
+	if len(files) != maxPassedFds {
+		t.Fatalf("got %d descriptors, want %d", len(files), maxPassedFds)
+	}
+	if _, err := files[1].Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	if _, err := r.Read(buf); err != nil || buf[0] != 'x' {
+		t.Errorf("the descriptor is not the pipe: %q, %v", buf, err)
+	}
+	if len(reader.take()) != 0 {
+		t.Error("take didn't clear the descriptors")
+	}
+}
+
+func TestExecCmd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vodga-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	env := []string{"LD_PRELOAD=", "LD_LIBRARY_PATH=/nonexistent", "HOME=/home/alice", "-u=PATH", "=x", "PATH=/usr/bin:/bin"}
+	cmd := execCmd("1000", "1000", dir, env, []string{"sh", "-c", "pwd; env"})
+
+	for _, v := range cmd.Env {
+		if strings.HasPrefix(v, "LD_") {
+			t.Errorf("%q is in the environment of ip", v)
+		}
+	}
+	if cmd.Dir != "/" {
+		t.Errorf("ip runs in %q", cmd.Dir)
+	}
+	user := 0
+	for i, arg := range cmd.Args {
+		if arg == "--" {
+			user = i + 1
+			break
+		}
+		if strings.HasPrefix(arg, "LD_") || arg == dir {
+			t.Errorf("%q is an argument of the root part", arg)
+		}
+	}
+	if user == 0 || cmd.Args[user-2] != "--init-groups" || cmd.Args[user] != "env" || cmd.Args[user+1] != "-i" {
+		t.Fatalf("the command doesn't drop root before env: %q", cmd.Args)
+	}
+
+	// Run the part after setpriv
+	out, err := exec.Command(cmd.Args[user], cmd.Args[user+1:]...).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if lines[0] != dir {
+		t.Errorf("the command ran in %q, want %q", lines[0], dir)
+	}
+	got := map[string]bool{}
+	for _, line := range lines[1:] {
+		got[line] = true
+	}
+	for _, v := range []string{"LD_LIBRARY_PATH=/nonexistent", "HOME=/home/alice", "PATH=/usr/bin:/bin"} {
+		if !got[v] {
+			t.Errorf("%q isn't in the environment of the command: %q", v, lines)
+		}
+	}
+	if got["-u=PATH"] || got["=x"] {
+		t.Errorf("invalid variables were passed: %q", lines)
+	}
+}
@@ -0,0 +1,223 @@
+package daemon
+
+import (
+	"fmt"
+	"github.com/TheWeirdDev/Vodga/shared/messages"
+	"github.com/TheWeirdDev/Vodga/shared/ovpn"
+	"github.com/TheWeirdDev/Vodga/shared/profiles"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const ipv6BlockTable = "vodga_ipv6"
+
+// ipv6Config is the IPv6 part of the options that the server pushed
+type ipv6Config struct {
+	// The address of ifconfig-ipv6 without the prefix length
+	Address string
+	// The server routes IPv6 through the tunnel, or tells openvpn to block it
+	Routes bool
+}
+
+// parsePushIPv6 reads the IPv6 options of a PUSH_REPLY line
+func parsePushIPv6(line string) (ipv6Config, bool) {
+	options, ok := pushOptions(line)
+	if !ok {
+		return ipv6Config{}, false
+	}
+	cfg := ipv6Config{}
+	for _, option := range options {
+		fields := strings.Fields(option)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "ifconfig-ipv6":
+			if len(fields) >= 2 {
+				cfg.Address = strings.SplitN(fields[1], "/", 2)[0]
+			}
+		case "route-ipv6", "block-ipv6":
+			cfg.Routes = true
+		case "redirect-gateway":
+			for _, flag := range fields[1:] {
+				if flag == "ipv6" {
+					cfg.Routes = true
+				}
+			}
+		}
+	}
+	return cfg, true
+}
+
+// ipv6Guard blocks IPv6 egress outside the tunnel when neither the profile nor the server route IPv6.
+// Otherwise the host keeps its IPv6 default route and that traffic leaks while IPv4 goes through the tunnel.
+// The block stays while reconnecting and is removed on disconnect
+type ipv6Guard struct {
+	mtx sync.Mutex
+	// The profile takes the default route and doesn't route IPv6 itself
+	enabled bool
+	// The IPv6 addresses of the remotes, openvpn can still connect to them
+	remotes []killSwitchRemote
+	pushed  ipv6Config
+	blocked bool
+}
+
+func (g *ipv6Guard) setPushed(cfg ipv6Config) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.pushed = cfg
+}
+
+// ipv6BlockRules returns the nftables script that rejects IPv6 egress
+// except for loopback, the tunnel, neighbor discovery and the remotes
+func ipv6BlockRules(dev string, remotes []killSwitchRemote) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table ip6 %s\ndelete table ip6 %s\n", ipv6BlockTable, ipv6BlockTable)
+	fmt.Fprintf(&b, "table ip6 %s {\n", ipv6BlockTable)
+	b.WriteString("\tchain output {\n")
+	b.WriteString("\t\ttype filter hook output priority 0; policy accept;\n")
+	b.WriteString("\t\toifname \"lo\" accept\n")
+	if dev != "" {
+		fmt.Fprintf(&b, "\t\toifname %s accept\n", strconv.Quote(dev))
+	}
+	b.WriteString("\t\tip6 daddr { fe80::/10, ff00::/8 } accept\n")
+	for _, rmt := range remotes {
+		fmt.Fprintf(&b, "\t\tip6 daddr %s %s dport %d accept\n", rmt.IP, rmt.Proto, rmt.Port)
+	}
+	b.WriteString("\t\treject\n")
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// hasIPv6Routes tells if a config routes IPv6 by itself
+func hasIPv6Routes(config string) (bool, error) {
+	f, err := os.Open(config)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	file, err := ovpn.Parse(f)
+	if err != nil {
+		return false, err
+	}
+	for _, d := range file.Flatten() {
+		switch d.Name {
+		case "route-ipv6", "block-ipv6":
+			return true, nil
+		case "redirect-gateway":
+			for _, flag := range d.Args {
+				if flag == "ipv6" {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// prepareIPv6 decides if the session needs the block and finds the IPv6 remotes of the config
+func (d *Daemon) prepareIPv6(args map[string]string) error {
+	// These modes leave the default route alone, the IPv6 traffic of the host is not a leak
+	if args["namespace"] == "true" || args["split_mode"] == string(profiles.SplitOnly) ||
+		args["users"] != "" || args["proxy_only"] == "true" {
+		return nil
+	}
+	routes, err := hasIPv6Routes(d.openvpn.launchConfig)
+	if err != nil || routes {
+		return err
+	}
+	remotes, _, err := readRemotes(d.openvpn.launchConfig)
+	if err != nil {
+		return err
+	}
+
+	var allowed []killSwitchRemote
+	for _, rmt := range remotes {
+		ips := rmt.IPs
+		if rmt.Hostname != "" {
+			ips = resolveRemote(rmt.Hostname, d.killSwitch)
+		}
+		for _, ip := range ips {
+			if addr := net.ParseIP(ip); addr != nil && addr.To4() == nil && rmt.Proto.Allows(addr) {
+				allowed = append(allowed, killSwitchRemote{Host: rmt.Hostname, IP: ip,
+					Port: rmt.Port, Proto: rmt.Proto.Transport()})
+			}
+		}
+	}
+	for _, rmt := range append(d.upstreamRemotes(d.killSwitch), d.transportRemotes()...) {
+		if addr := net.ParseIP(rmt.IP); addr != nil && addr.To4() == nil {
+			allowed = append(allowed, rmt)
+		}
+	}
+	// Left by a daemon that didn't exit cleanly
+	removeIPv6Block()
+	d.ipv6.mtx.Lock()
+	defer d.ipv6.mtx.Unlock()
+	d.ipv6.enabled = true
+	d.ipv6.remotes = allowed
+	return nil
+}
+
+// applyIPv6Block installs the block when the tunnel is up and the server didn't route IPv6,
+// it's called again when the options of a reconnect arrive
+func (d *Daemon) applyIPv6Block() {
+	d.ipv6.mtx.Lock()
+	defer d.ipv6.mtx.Unlock()
+	if !d.ipv6.enabled || d.openvpn.getState() != Connected {
+		return
+	}
+	if d.ipv6.pushed.Routes {
+		if d.ipv6.blocked {
+			removeIPv6Block()
+			d.ipv6.blocked = false
+			log.Println("IPv6 goes through the tunnel, the block is removed")
+		}
+		return
+	}
+	d.dns.mtx.Lock()
+	dev := d.dns.dev
+	d.dns.mtx.Unlock()
+
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(ipv6BlockRules(dev, d.ipv6.remotes))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("Can't block IPv6: nft failed: %v: %s\n", err, strings.TrimSpace(string(out)))
+		d.broadcastMessage(messages.ErrorMsg("Can't block IPv6 outside the tunnel: " + err.Error()))
+		return
+	}
+	if !d.ipv6.blocked {
+		log.Println("The tunnel has no IPv6 routes, IPv6 outside the tunnel is blocked")
+	}
+	d.ipv6.blocked = true
+}
+
+// removeIPv6Block deletes the table, including the one of a daemon that crashed
+func removeIPv6Block() {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("table ip6 %s\ndelete table ip6 %s\n",
+		ipv6BlockTable, ipv6BlockTable))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("Can't remove the IPv6 block: nft failed: %v: %s\n", err, strings.TrimSpace(string(out)))
+	}
+}
+
+// stopIPv6 removes the block on disconnect and forgets the session
+func (d *Daemon) stopIPv6() {
+	d.ipv6.mtx.Lock()
+	defer d.ipv6.mtx.Unlock()
+	if d.ipv6.blocked {
+		removeIPv6Block()
+		log.Println("IPv6 block removed")
+	}
+	d.ipv6.enabled = false
+	d.ipv6.remotes = nil
+	d.ipv6.pushed = ipv6Config{}
+	d.ipv6.blocked = false
+}
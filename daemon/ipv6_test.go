@@ -0,0 +1,62 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParsePushIPv6(t *testing.T) {
+	line := "2019-10-10 10:10:10 PUSH: Received control message: 'PUSH_REPLY,redirect-gateway def1," +
+		"ifconfig 10.8.0.2 255.255.255.0,ifconfig-ipv6 fd00::1000/64 fd00::1'"
+	cfg, ok := parsePushIPv6(line)
+	if !ok || cfg.Address != "fd00::1000" || cfg.Routes {
+		t.Errorf("got %+v %v", cfg, ok)
+	}
+	cfg, _ = parsePushIPv6(line[:len(line)-1] + ",route-ipv6 2000::/3'")
+	if !cfg.Routes {
+		t.Error("route-ipv6 is not a route")
+	}
+	cfg, _ = parsePushIPv6("PUSH: Received control message: 'PUSH_REPLY,redirect-gateway def1 ipv6'")
+	if !cfg.Routes {
+		t.Error("redirect-gateway ipv6 is not a route")
+	}
+}
+
+func TestIPv6BlockRules(t *testing.T) {
+	rules := ipv6BlockRules("tun0", []killSwitchRemote{{IP: "2001:db8::7", Port: 1194, Proto: "udp"}})
+	for _, want := range []string{
+		"delete table ip6 vodga_ipv6\n",
+		"oifname \"lo\" accept\n",
+		"oifname \"tun0\" accept\n",
+		"ip6 daddr { fe80::/10, ff00::/8 } accept\n",
+		"ip6 daddr 2001:db8::7 udp dport 1194 accept\n",
+		"reject\n",
+	} {
+		if !strings.Contains(rules, want) {
+			t.Errorf("rules don't contain %q:\n%s", want, rules)
+		}
+	}
+}
+
+func TestHasIPv6Routes(t *testing.T) {
+	for config, want := range map[string]bool{
+		"client\n<ca>\nroute-ipv6 2000::/3\n</ca>\n":             false,
+		"client\n\"redirect-gateway\" def1 ipv6\n":               true,
+		"client\n<connection>\nblock-ipv6\n</connection>\n":      true,
+		"client\nredirect-gateway def1 # ipv6\nroute 10.0.0.0\n": false,
+	} {
+		f, err := ioutil.TempFile("", "vodgad-test-*.ovpn")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(config)
+		f.Close()
+		got, err := hasIPv6Routes(f.Name())
+		os.Remove(f.Name())
+		if err != nil || got != want {
+			t.Errorf("hasIPv6Routes(%q) = %v, %v, want %v", config, got, err, want)
+		}
+	}
+}
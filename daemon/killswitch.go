@@ -0,0 +1,330 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TheWeirdDev/Vodga/shared/consts"
+	"github.com/TheWeirdDev/Vodga/shared/ovpn"
+	"github.com/TheWeirdDev/Vodga/shared/profiles"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const killSwitchTable = "vodga_killswitch"
+
+var errKillSwitchActive = errors.New("the kill switch of another profile is blocking the traffic, " +
+	"disable it before connecting to a profile without a kill switch")
+
+// The rules are saved here, so they are installed again if the daemon crashes or the system reboots
+var killSwitchState = filepath.Join(consts.StateDir, "killswitch.json")
+
+type killSwitchRemote struct {
+	// The hostname in the config, empty if it's an IP
+	Host  string `json:"host,omitempty"`
+	IP    string `json:"ip"`
+	Port  uint   `json:"port"`
+	Proto string `json:"proto"`
+}
+
+// killSwitch blocks all traffic that doesn't go through the tunnel.
+// Only loopback, the tunnel device, the remotes of the config, DHCP and the LAN ranges are allowed.
+// The rules stay until they are removed explicitly with KILLSWITCH_DISABLE
+type killSwitch struct {
+	Profile string             `json:"profile"`
+	Dev     string             `json:"dev"`
+	Remotes []killSwitchRemote `json:"remotes"`
+	LAN     []string           `json:"lan"`
+}
+
+// newKillSwitch reads the remotes of a config and resolves them.
+// If a hostname can't be resolved, which happens when the rules of a previous
+// connection block DNS, its addresses in the previous rules are used
+func newKillSwitch(profile, config string, lan []string, previous *killSwitch) (*killSwitch, error) {
+	for _, cidr := range lan {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("invalid LAN range %q", cidr)
+		}
+	}
+	remotes, dev, err := readRemotes(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(remotes) == 0 {
+		return nil, errors.New("config has no remotes")
+	}
+
+	ks := &killSwitch{Profile: profile, Dev: dev, LAN: lan}
+	for _, rmt := range remotes {
+		ips := rmt.IPs
+		if rmt.Hostname != "" {
+			ips = resolveRemote(rmt.Hostname, previous)
+			if len(ips) == 0 {
+				return nil, fmt.Errorf("can't resolve %s", rmt.Hostname)
+			}
+		}
+		for _, ip := range ips {
+			if !rmt.Proto.Allows(net.ParseIP(ip)) {
+				continue
+			}
+			ks.Remotes = append(ks.Remotes, killSwitchRemote{Host: rmt.Hostname, IP: ip,
+				Port: rmt.Port, Proto: rmt.Proto.Transport()})
+		}
+	}
+	if len(ks.Remotes) == 0 {
+		return nil, errors.New("no address of the remotes matches their protocol")
+	}
+	return ks, nil
+}
+
+func resolveRemote(host string, previous *killSwitch) []string {
+	var ips []string
+	if addrs, err := net.LookupIP(host); err == nil {
+		for _, ip := range addrs {
+			ips = append(ips, ip.String())
+		}
+		return ips
+	}
+	if previous != nil {
+		for _, rmt := range previous.Remotes {
+			if rmt.Host == host {
+				ips = append(ips, rmt.IP)
+			}
+		}
+	}
+	return ips
+}
+
+// readRemotes returns the remotes of a config and its device.
+// Ports and protocols that are not in the remote lines are filled from the
+// port and proto options, or the defaults of openvpn
+func readRemotes(config string) ([]profiles.Remote, string, error) {
+	f, err := os.Open(config)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	file, err := ovpn.Parse(f)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var remotes []profiles.Remote
+	var port uint = 1194
+	proto := profiles.UDP
+	dev := "tun"
+	for _, d := range file.Flatten() {
+		if d.Inline || len(d.Args) == 0 {
+			continue
+		}
+		switch d.Name {
+		case "remote":
+			rmt, err := profiles.ParseRemote(d.String())
+			if err != nil {
+				return nil, "", err
+			}
+			remotes = append(remotes, rmt)
+		case "port":
+			p, err := strconv.ParseUint(d.Args[0], 10, 16)
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid port %q", d.Args[0])
+			}
+			port = uint(p)
+		case "proto":
+			if proto = profiles.ParseProto(strings.TrimSuffix(d.Args[0], "-client")); proto == "" {
+				return nil, "", fmt.Errorf("unknown protocol %q", d.Args[0])
+			}
+		case "dev":
+			dev = d.Args[0]
+		}
+	}
+	for i := range remotes {
+		if remotes[i].Port == 0 {
+			remotes[i].Port = port
+		}
+		if remotes[i].Proto == "" {
+			remotes[i].Proto = proto
+		}
+	}
+	return remotes, dev, nil
+}
+
+// pinRemotes replaces the hostnames of the remotes in a config with the addresses
+// that the kill switch allows, openvpn can't resolve them while DNS is blocked
+func pinRemotes(data []byte, ks *killSwitch) ([]byte, error) {
+	var pin func(d ovpn.Directive) ([]string, bool)
+	pin = func(d ovpn.Directive) ([]string, bool) {
+		if d.Name == "connection" {
+			// The remotes of <connection> blocks are pinned too
+			content, err := ovpn.Rewrite([]byte(d.Content), pin)
+			if err != nil {
+				return nil, true
+			}
+			d.Content = string(content)
+			return []string{d.String()}, false
+		}
+		if d.Name != "remote" || len(d.Args) == 0 {
+			return nil, true
+		}
+		var pinned []string
+		for _, rmt := range ks.Remotes {
+			if rmt.Host == d.Args[0] {
+				args := append([]string{rmt.IP}, d.Args[1:]...)
+				pinned = append(pinned, ovpn.Directive{Name: "remote", Args: args}.String())
+			}
+		}
+		return pinned, len(pinned) == 0
+	}
+	return ovpn.Rewrite(data, pin)
+}
+
+// prepareKillSwitch installs the kill switch if the profile enables it
+// and pins the remotes of the launch config to the allowed addresses
+func (d *Daemon) prepareKillSwitch(args map[string]string) error {
+	if args["kill_switch"] != "true" {
+		if d.killSwitch != nil {
+			return errKillSwitchActive
+		}
+		return nil
+	}
+	var lan []string
+	if args["lan"] != "" {
+		lan = strings.Split(args["lan"], ",")
+	}
+	ks, err := newKillSwitch(d.openvpn.config, d.openvpn.launchConfig, lan, d.killSwitch)
+	if err != nil {
+		return err
+	}
+	// openvpn connects to the proxy instead of the remotes, and the sidecar to its server
+	ks.Remotes = append(ks.Remotes, d.upstreamRemotes(d.killSwitch)...)
+	ks.Remotes = append(ks.Remotes, d.transportRemotes()...)
+
+	data, err := ioutil.ReadFile(d.openvpn.launchConfig)
+	if err != nil {
+		return err
+	}
+	if data, err = pinRemotes(data, ks); err != nil {
+		return err
+	}
+	launchConfig, err := writeLaunchCopy(data)
+	if err != nil {
+		return err
+	}
+	if d.openvpn.launchCopy {
+		os.Remove(d.openvpn.launchConfig)
+	}
+	d.openvpn.launchConfig = launchConfig
+	d.openvpn.launchCopy = true
+
+	if err := ks.apply(); err != nil {
+		return err
+	}
+	d.killSwitch = ks
+	log.Printf("Kill switch enabled for %s\n", ks.Profile)
+	return nil
+}
+
+// devPattern matches the device of the tunnel, a type like "tun" matches any tun device
+func devPattern(dev string) string {
+	if dev == "tun" || dev == "tap" {
+		return dev + "*"
+	}
+	return dev
+}
+
+// rules returns the nftables script that replaces the table atomically
+func (ks *killSwitch) rules() string {
+	var b strings.Builder
+	dev := strconv.Quote(devPattern(ks.Dev))
+	// Creating the table before deleting it makes the script work when it doesn't exist
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n", killSwitchTable, killSwitchTable)
+	fmt.Fprintf(&b, "table inet %s {\n", killSwitchTable)
+
+	b.WriteString("\tchain output {\n")
+	b.WriteString("\t\ttype filter hook output priority 0; policy drop;\n")
+	b.WriteString("\t\toifname \"lo\" accept\n")
+	fmt.Fprintf(&b, "\t\toifname %s accept\n", dev)
+	b.WriteString("\t\tudp sport 68 udp dport 67 accept\n")
+	for _, rmt := range ks.Remotes {
+		fmt.Fprintf(&b, "\t\t%s daddr %s %s dport %d accept\n", ipFamily(rmt.IP), rmt.IP, rmt.Proto, rmt.Port)
+	}
+	for _, cidr := range ks.LAN {
+		fmt.Fprintf(&b, "\t\t%s daddr %s accept\n", ipFamily(cidr), cidr)
+	}
+	b.WriteString("\t\treject\n")
+	b.WriteString("\t}\n")
+
+	b.WriteString("\tchain input {\n")
+	b.WriteString("\t\ttype filter hook input priority 0; policy drop;\n")
+	b.WriteString("\t\tiifname \"lo\" accept\n")
+	fmt.Fprintf(&b, "\t\tiifname %s accept\n", dev)
+	b.WriteString("\t\tct state established,related accept\n")
+	b.WriteString("\t\tudp sport 67 udp dport 68 accept\n")
+	for _, cidr := range ks.LAN {
+		fmt.Fprintf(&b, "\t\t%s saddr %s accept\n", ipFamily(cidr), cidr)
+	}
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func ipFamily(addr string) string {
+	if strings.Contains(addr, ":") {
+		return "ip6"
+	}
+	return "ip"
+}
+
+// apply installs the rules and saves them
+func (ks *killSwitch) apply() error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(ks.rules())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	data, err := json.Marshal(ks)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(consts.StateDir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(killSwitchState, data, 0600)
+}
+
+// loadKillSwitch returns the saved rules, nil if the kill switch is not enabled
+func loadKillSwitch() (*killSwitch, error) {
+	data, err := ioutil.ReadFile(killSwitchState)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ks := &killSwitch{}
+	if err := json.Unmarshal(data, ks); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// disableKillSwitch removes the rules and the saved state
+func disableKillSwitch() error {
+	// Add the table first, so deleting it doesn't fail if it's not there
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("table inet %s\ndelete table inet %s\n",
+		killSwitchTable, killSwitchTable))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	if err := os.Remove(killSwitchState); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	log.Println("Kill switch disabled")
+	return nil
+}
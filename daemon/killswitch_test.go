@@ -0,0 +1,79 @@
+package daemon
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const killSwitchConfig = `client
+dev tun
+proto tcp-client
+port 443
+remote 203.0.113.1
+remote vpn.example.com 1194 udp
+<ca>
+remote 198.51.100.1
+</ca>
+`
+
+func TestKillSwitchRules(t *testing.T) {
+	f, err := ioutil.TempFile("", "vodgad-test-*.ovpn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(killSwitchConfig); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	remotes, dev, err := readRemotes(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev != "tun" || len(remotes) != 2 {
+		t.Fatalf("wrong remotes: %s %+v", dev, remotes)
+	}
+	if remotes[0].Port != 443 || remotes[0].Proto != "tcp" || remotes[1].Port != 1194 || remotes[1].Proto != "udp" {
+		t.Errorf("defaults are not applied correctly: %+v", remotes)
+	}
+
+	// The hostname can't be resolved here, the previous rules are used
+	previous := &killSwitch{Remotes: []killSwitchRemote{{Host: "vpn.example.com", IP: "192.0.2.7"}}}
+	ks, err := newKillSwitch("test", f.Name(), []string{"192.168.1.0/24"}, previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := ks.rules()
+	for _, want := range []string{
+		"policy drop;",
+		`oifname "tun*" accept`,
+		"ip daddr 203.0.113.1 tcp dport 443 accept",
+		"ip daddr 192.0.2.7 udp dport 1194 accept",
+		"ip daddr 192.168.1.0/24 accept",
+		"ip saddr 192.168.1.0/24 accept",
+	} {
+		if !strings.Contains(rules, want) {
+			t.Errorf("rules don't contain %q:\n%s", want, rules)
+		}
+	}
+	if strings.Contains(rules, "198.51.100.1") {
+		t.Errorf("lines in inline files are not remotes")
+	}
+
+	pinned, err := pinRemotes([]byte(killSwitchConfig+"<connection>\nremote vpn.example.com 443\n</connection>\n"), ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(pinned), "remote 192.0.2.7 1194 udp\n") ||
+		!strings.Contains(string(pinned), "<connection>\nremote 192.0.2.7 443\n</connection>\n") ||
+		strings.Contains(string(pinned), "vpn.example.com") {
+		t.Errorf("the hostname is not pinned:\n%s", pinned)
+	}
+
+	if _, err := newKillSwitch("test", f.Name(), []string{"192.168.1.0"}, previous); err == nil {
+		t.Errorf("invalid LAN ranges should be rejected")
+	}
+}
@@ -0,0 +1,381 @@
+package mgmt
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is a real-time notification sent by openvpn.
+// Every notification line starts with '>' followed by its type and a colon
+type Event interface {
+	// Notification returns the notification type without the leading '>', e.g. "STATE"
+	Notification() string
+}
+
+// HoldEvent is sent when openvpn waits for 'hold release'
+type HoldEvent struct {
+	Message string
+}
+
+// LogEvent is a real-time log line (only sent after 'log on')
+type LogEvent struct {
+	Time    time.Time
+	Flags   string
+	Message string
+}
+
+// InfoEvent is an informational message, like the greeting
+type InfoEvent struct {
+	Message string
+}
+
+// FatalEvent is sent right before openvpn exits because of a fatal error
+type FatalEvent struct {
+	Message string
+}
+
+// NeedOkEvent asks for a confirmation through 'needok'
+type NeedOkEvent struct {
+	Name    string
+	Message string
+}
+
+// NeedStrEvent asks for a string through 'needstr'
+type NeedStrEvent struct {
+	Name    string
+	Message string
+}
+
+// RemoteEvent asks whether a remote should be used (--management-query-remote)
+type RemoteEvent struct {
+	Host  string
+	Port  uint
+	Proto string
+}
+
+// ProxyEvent asks for a proxy for a connection entry (--management-query-proxy)
+type ProxyEvent struct {
+	Index int
+	Proto string
+	Host  string
+}
+
+// PkSignEvent asks the management client to sign data (--management-external-key)
+type PkSignEvent struct {
+	// Data is base64 encoded, just like openvpn sends it
+	Data      string
+	Algorithm string
+}
+
+// EchoEvent is an 'echo' option pushed by the server
+type EchoEvent struct {
+	Time  time.Time
+	Param string
+}
+
+// StateEvent is sent on every state change after 'state on'
+type StateEvent struct {
+	Time        time.Time
+	Name        string
+	Description string
+	LocalIP     string
+	RemoteIP    string
+	RemotePort  string
+	LocalAddr   string
+	LocalPort   string
+	LocalIPv6   string
+}
+
+// ByteCountEvent is sent periodically after 'bytecount n'
+type ByteCountEvent struct {
+	In  uint64
+	Out uint64
+}
+
+// UnknownEvent holds notifications that this package doesn't understand
+type UnknownEvent struct {
+	Kind string
+	Data string
+}
+
+type PasswordKind int
+
+const (
+	// PasswordNeed means openvpn is asking for credentials
+	PasswordNeed PasswordKind = iota
+	// PasswordFailed means the given credentials were rejected
+	PasswordFailed
+	// PasswordAuthToken means the server pushed an auth token
+	PasswordAuthToken
+)
+
+// StaticChallenge is parsed from the 'SC:' part of a password request
+type StaticChallenge struct {
+	Echo bool
+	Text string
+}
+
+// DynamicChallenge is parsed from a 'CRV1' authentication failure
+type DynamicChallenge struct {
+	Flags    string
+	StateID  string
+	Username string
+	Text     string
+}
+
+// Echo reports whether the response can be shown while it's being typed
+func (dc *DynamicChallenge) Echo() bool {
+	for _, flag := range strings.Split(dc.Flags, ",") {
+		if flag == "E" {
+			return true
+		}
+	}
+	return false
+}
+
+// PasswordEvent is any of the >PASSWORD notifications
+type PasswordEvent struct {
+	Kind PasswordKind
+	// Type is what the password is for: 'Auth', 'Private Key', 'HTTP Proxy', ...
+	Type string
+	// NeedUsername is true if both the username and password are requested
+	NeedUsername bool
+	Static       *StaticChallenge
+	Dynamic      *DynamicChallenge
+	Token        string
+}
+
+func (HoldEvent) Notification() string      { return "HOLD" }
+func (LogEvent) Notification() string       { return "LOG" }
+func (InfoEvent) Notification() string      { return "INFO" }
+func (FatalEvent) Notification() string     { return "FATAL" }
+func (NeedOkEvent) Notification() string    { return "NEED-OK" }
+func (NeedStrEvent) Notification() string   { return "NEED-STR" }
+func (RemoteEvent) Notification() string    { return "REMOTE" }
+func (ProxyEvent) Notification() string     { return "PROXY" }
+func (PkSignEvent) Notification() string    { return "PK_SIGN" }
+func (EchoEvent) Notification() string      { return "ECHO" }
+func (StateEvent) Notification() string     { return "STATE" }
+func (ByteCountEvent) Notification() string { return "BYTECOUNT" }
+func (PasswordEvent) Notification() string  { return "PASSWORD" }
+func (e UnknownEvent) Notification() string { return e.Kind }
+
+// ParseEvent parses a real-time notification line into a typed event.
+// Notifications that are well-formed but unknown become an UnknownEvent
+func ParseEvent(line string) (Event, error) {
+	if len(line) < 2 || line[0] != '>' {
+		return nil, fmt.Errorf("not a notification: %q", line)
+	}
+	colonIndex := strings.IndexRune(line, ':')
+	if colonIndex < 0 {
+		return nil, fmt.Errorf("malformed notification: %q", line)
+	}
+	kind, data := line[1:colonIndex], line[colonIndex+1:]
+
+	switch kind {
+	case "HOLD":
+		return HoldEvent{Message: data}, nil
+	case "INFO":
+		return InfoEvent{Message: data}, nil
+	case "FATAL":
+		return FatalEvent{Message: data}, nil
+	case "LOG":
+		fields := strings.SplitN(data, ",", 3)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("malformed log notification: %q", line)
+		}
+		return LogEvent{Time: parseTime(fields[0]), Flags: fields[1], Message: fields[2]}, nil
+	case "ECHO":
+		fields := strings.SplitN(data, ",", 2)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("malformed echo notification: %q", line)
+		}
+		return EchoEvent{Time: parseTime(fields[0]), Param: fields[1]}, nil
+	case "NEED-OK", "NEED-STR":
+		name, msg, err := parseNeed(data)
+		if err != nil {
+			return nil, err
+		}
+		if kind == "NEED-OK" {
+			return NeedOkEvent{Name: name, Message: msg}, nil
+		}
+		return NeedStrEvent{Name: name, Message: msg}, nil
+	case "REMOTE":
+		fields := strings.Split(data, ",")
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("malformed remote notification: %q", line)
+		}
+		port, err := strconv.ParseUint(fields[1], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid remote port: %q", fields[1])
+		}
+		return RemoteEvent{Host: fields[0], Port: uint(port), Proto: fields[2]}, nil
+	case "PROXY":
+		fields := strings.SplitN(data, ",", 3)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("malformed proxy notification: %q", line)
+		}
+		index, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy index: %q", fields[0])
+		}
+		return ProxyEvent{Index: index, Proto: fields[1], Host: fields[2]}, nil
+	case "PK_SIGN":
+		fields := strings.SplitN(data, ",", 2)
+		ev := PkSignEvent{Data: fields[0]}
+		if len(fields) == 2 {
+			ev.Algorithm = fields[1]
+		}
+		return ev, nil
+	case "STATE":
+		return parseState(data)
+	case "BYTECOUNT":
+		fields := strings.Split(data, ",")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("malformed bytecount notification: %q", line)
+		}
+		in, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		out, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return ByteCountEvent{In: in, Out: out}, nil
+	case "PASSWORD":
+		return parsePassword(data)
+	default:
+		return UnknownEvent{Kind: kind, Data: data}, nil
+	}
+}
+
+// openvpn sends unix timestamps in notifications
+func parseTime(s string) time.Time {
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+// Parses the quoted name of a password or a need-* request, returns the rest of the text
+func parseQuoted(data string) (string, string, error) {
+	start := strings.IndexRune(data, '\'')
+	if start < 0 {
+		return "", "", fmt.Errorf("no quoted name in %q", data)
+	}
+	end := strings.IndexRune(data[start+1:], '\'')
+	if end < 0 {
+		return "", "", fmt.Errorf("unterminated quoted name in %q", data)
+	}
+	end += start + 1
+	return data[start+1 : end], data[end+1:], nil
+}
+
+// Format: Need 'name' confirmation MSG:message
+func parseNeed(data string) (string, string, error) {
+	name, rest, err := parseQuoted(data)
+	if err != nil {
+		return "", "", err
+	}
+	msg := ""
+	if i := strings.Index(rest, "MSG:"); i >= 0 {
+		msg = rest[i+len("MSG:"):]
+	}
+	return name, msg, nil
+}
+
+// Format: time,state,description,local ip,remote ip,remote port,local addr,local port,local ipv6
+// Only the first two fields are guaranteed to exist
+func parseState(data string) (Event, error) {
+	fields := strings.Split(data, ",")
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("malformed state notification: %q", data)
+	}
+	// Missing fields are left empty
+	for len(fields) < 9 {
+		fields = append(fields, "")
+	}
+	return StateEvent{
+		Time:        parseTime(fields[0]),
+		Name:        fields[1],
+		Description: fields[2],
+		LocalIP:     fields[3],
+		RemoteIP:    fields[4],
+		RemotePort:  fields[5],
+		LocalAddr:   fields[6],
+		LocalPort:   fields[7],
+		LocalIPv6:   fields[8],
+	}, nil
+}
+
+func parsePassword(data string) (Event, error) {
+	const (
+		needPrefix   = "Need "
+		failedPrefix = "Verification Failed: "
+		tokenPrefix  = "Auth-Token:"
+	)
+	switch {
+	case strings.HasPrefix(data, tokenPrefix):
+		return PasswordEvent{Kind: PasswordAuthToken, Type: "Auth",
+			Token: data[len(tokenPrefix):]}, nil
+
+	case strings.HasPrefix(data, failedPrefix):
+		typ, rest, err := parseQuoted(data[len(failedPrefix):])
+		if err != nil {
+			return nil, err
+		}
+		ev := PasswordEvent{Kind: PasswordFailed, Type: typ}
+		// Dynamic challenges look like: ['CRV1:flags:state_id:base64_username:text']
+		if start := strings.Index(rest, "['CRV1:"); start >= 0 {
+			end := strings.LastIndex(rest, "']")
+			if end < start {
+				return nil, fmt.Errorf("malformed dynamic challenge: %q", rest)
+			}
+			dc, err := parseDynamicChallenge(rest[start+len("['CRV1:") : end])
+			if err != nil {
+				return nil, err
+			}
+			ev.Dynamic = dc
+		}
+		return ev, nil
+
+	case strings.HasPrefix(data, needPrefix):
+		typ, rest, err := parseQuoted(data[len(needPrefix):])
+		if err != nil {
+			return nil, err
+		}
+		rest = strings.TrimSpace(rest)
+		ev := PasswordEvent{Kind: PasswordNeed, Type: typ,
+			NeedUsername: strings.HasPrefix(rest, "username/password")}
+		// Static challenges look like: SC:echo_flag,text
+		if i := strings.Index(rest, "SC:"); i >= 0 {
+			sc := strings.SplitN(rest[i+len("SC:"):], ",", 2)
+			if len(sc) < 2 {
+				return nil, fmt.Errorf("malformed static challenge: %q", rest)
+			}
+			ev.Static = &StaticChallenge{Echo: sc[0] == "1", Text: sc[1]}
+		}
+		return ev, nil
+	}
+	return nil, fmt.Errorf("unknown password notification: %q", data)
+}
+
+// Format: flags:state_id:base64_username:text
+func parseDynamicChallenge(data string) (*DynamicChallenge, error) {
+	fields := strings.SplitN(data, ":", 4)
+	if len(fields) < 4 {
+		return nil, errors.New("dynamic challenge has too few fields")
+	}
+	username, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid username in dynamic challenge: %v", err)
+	}
+	return &DynamicChallenge{Flags: fields[0], StateID: fields[1],
+		Username: string(username), Text: fields[3]}, nil
+}
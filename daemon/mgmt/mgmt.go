@@ -0,0 +1,376 @@
+// Package mgmt is a client for the OpenVPN management interface.
+// It turns real-time notifications into typed events and matches every
+// command with its SUCCESS: or ERROR: reply
+package mgmt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrClosed is returned for commands that are sent after the connection is closed
+var ErrClosed = errors.New("management connection is closed")
+
+// ErrControlChars is returned for arguments that can't be sent, a line break would start another command
+var ErrControlChars = errors.New("management command arguments can't have control characters")
+
+// CommandError is an 'ERROR:' reply from openvpn
+type CommandError struct {
+	Command string
+	Message string
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("management command %q failed: %s", e.Command, e.Message)
+}
+
+type reply struct {
+	text string
+	err  error
+}
+
+type Client struct {
+	conn net.Conn
+	// Only one command can wait for a reply at a time
+	cmdMtx sync.Mutex
+	// The reader sends the replies of commands here
+	replies chan reply
+	events  chan Event
+	// Some commands are answered with a notification of this kind instead of SUCCESS:
+	replyKindMtx sync.Mutex
+	replyKind    string
+	// A command waits for a reply, others are dropped so the reader never blocks
+	waiting bool
+
+	// Events are queued here so the reader never blocks on a slow consumer
+	queueMtx  sync.Mutex
+	queueCond *sync.Cond
+	queue     []Event
+	closed    bool
+}
+
+// Dial connects to the management interface on a unix socket
+func Dial(path string) (*Client, error) {
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(c), nil
+}
+
+// NewClient starts reading from an existing management connection
+func NewClient(conn net.Conn) *Client {
+	c := &Client{
+		conn:    conn,
+		replies: make(chan reply, 1),
+		events:  make(chan Event),
+	}
+	c.queueCond = sync.NewCond(&c.queueMtx)
+	go c.read()
+	go c.dispatch()
+	return c
+}
+
+// Events returns the notifications sent by openvpn.
+// The channel is closed after the connection is closed
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// Close closes the connection to the management interface
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Command sends a single-line command and waits for its reply.
+// The text after 'SUCCESS:' is returned, an 'ERROR:' reply becomes a *CommandError
+func (c *Client) Command(cmd string) (string, error) {
+	return c.command(cmd, "")
+}
+
+// command sends a command, the reply is the text of a notification if replyKind isn't empty
+func (c *Client) command(cmd, replyKind string) (string, error) {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return "", errors.New("empty management command")
+	}
+	c.cmdMtx.Lock()
+	defer c.cmdMtx.Unlock()
+
+	c.expectReply(replyKind, true)
+	defer c.expectReply("", false)
+	if _, err := c.conn.Write([]byte(cmd + "\n")); err != nil {
+		return "", err
+	}
+	r, ok := <-c.replies
+	if !ok {
+		return "", ErrClosed
+	}
+	if r.err != nil {
+		return "", &CommandError{Command: fields[0], Message: r.err.Error()}
+	}
+	return r.text, nil
+}
+
+// quotedCommand sends a command with quoted arguments
+func (c *Client) quotedCommand(cmd string, args ...string) error {
+	for _, arg := range args {
+		quoted, err := Quote(arg)
+		if err != nil {
+			return err
+		}
+		cmd += " " + quoted
+	}
+	_, err := c.Command(cmd)
+	return err
+}
+
+// HoldRelease lets openvpn continue after --management-hold
+func (c *Client) HoldRelease() error {
+	_, err := c.Command("hold release")
+	return err
+}
+
+// State enables or disables real-time state notifications
+func (c *Client) State(on bool) error {
+	_, err := c.Command("state " + onOff(on))
+	return err
+}
+
+// Log enables or disables real-time log notifications
+func (c *Client) Log(on bool) error {
+	_, err := c.Command("log " + onOff(on))
+	return err
+}
+
+// ByteCount enables bytecount notifications every n seconds, zero disables them
+func (c *Client) ByteCount(n int) error {
+	_, err := c.Command(fmt.Sprintf("bytecount %d", n))
+	return err
+}
+
+// Username answers a username request of the given type
+func (c *Client) Username(typ, username string) error {
+	return c.quotedCommand("username", typ, username)
+}
+
+// Password answers a password request of the given type
+func (c *Client) Password(typ, password string) error {
+	return c.quotedCommand("password", typ, password)
+}
+
+// Signal sends a signal like SIGHUP, SIGTERM, SIGUSR1 or SIGUSR2 to openvpn
+func (c *Client) Signal(sig string) error {
+	_, err := c.Command("signal " + sig)
+	return err
+}
+
+// Remote answers a >REMOTE notification, the remote is skipped if accept is false
+func (c *Client) Remote(accept bool) error {
+	action := "ACCEPT"
+	if !accept {
+		action = "SKIP"
+	}
+	_, err := c.Command("remote " + action)
+	return err
+}
+
+// Proxy answers a >PROXY notification, typ is HTTP or SOCKS. An empty typ connects without a proxy
+func (c *Client) Proxy(typ, host string, port uint16) error {
+	if typ == "" {
+		_, err := c.Command("proxy NONE")
+		return err
+	}
+	quoted, err := Quote(host)
+	if err != nil {
+		return err
+	}
+	_, err = c.Command(fmt.Sprintf("proxy %s %s %d", typ, quoted, port))
+	return err
+}
+
+// PkSig answers a >PK_SIGN notification with a base64 signature
+func (c *Client) PkSig(signature string) error {
+	_, err := c.multiLine("pk-sig", signature)
+	return err
+}
+
+// multiLine sends a command whose base64 data follows in lines and ends with END
+func (c *Client) multiLine(cmd, data string) (string, error) {
+	var b strings.Builder
+	b.WriteString(cmd + "\n")
+	for len(data) > 64 {
+		b.WriteString(data[:64] + "\n")
+		data = data[64:]
+	}
+	if data != "" {
+		b.WriteString(data + "\n")
+	}
+	b.WriteString("END")
+	return c.Command(b.String())
+}
+
+// PKCS11ID is a certificate of a token, an entry of pkcs11-id-get
+type PKCS11ID struct {
+	Index int
+	// The serialized id that answers pkcs11-id-request
+	ID string
+	// The base64 DER certificate
+	Blob string
+}
+
+// PKCS11IDCount returns the number of certificates in the tokens of pkcs11-providers
+func (c *Client) PKCS11IDCount() (int, error) {
+	text, err := c.command("pkcs11-id-count", "PKCS11ID-COUNT")
+	if err != nil {
+		return 0, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(text))
+	if err != nil {
+		return 0, fmt.Errorf("invalid pkcs11 id count: %q", text)
+	}
+	return count, nil
+}
+
+// PKCS11IDGet returns a certificate by its index
+func (c *Client) PKCS11IDGet(index int) (PKCS11ID, error) {
+	text, err := c.command(fmt.Sprintf("pkcs11-id-get %d", index), "PKCS11ID-ENTRY")
+	if err != nil {
+		return PKCS11ID{}, err
+	}
+	return parsePKCS11ID(text)
+}
+
+// Format: '0', ID:'id', BLOB:'base64'
+func parsePKCS11ID(text string) (PKCS11ID, error) {
+	fields := strings.SplitN(text, ", ", 3)
+	if len(fields) != 3 || !strings.HasPrefix(fields[1], "ID:") || !strings.HasPrefix(fields[2], "BLOB:") {
+		return PKCS11ID{}, fmt.Errorf("malformed pkcs11 id entry: %q", text)
+	}
+	unquote := func(s string) string {
+		return strings.TrimSuffix(strings.TrimPrefix(s, "'"), "'")
+	}
+	index, err := strconv.Atoi(unquote(fields[0]))
+	if err != nil {
+		return PKCS11ID{}, fmt.Errorf("invalid pkcs11 id index: %q", fields[0])
+	}
+	return PKCS11ID{Index: index, ID: unquote(fields[1][len("ID:"):]),
+		Blob: unquote(fields[2][len("BLOB:"):])}, nil
+}
+
+// NeedStr answers a >NEED-STR notification
+func (c *Client) NeedStr(name, value string) error {
+	return c.quotedCommand("needstr "+name, value)
+}
+
+func (c *Client) expectReply(kind string, waiting bool) {
+	c.replyKindMtx.Lock()
+	defer c.replyKindMtx.Unlock()
+	c.replyKind = kind
+	c.waiting = waiting
+}
+
+// deliver passes a reply to the waiting command, replies that no command waits for are dropped
+func (c *Client) deliver(r reply) {
+	c.replyKindMtx.Lock()
+	defer c.replyKindMtx.Unlock()
+	if !c.waiting {
+		log.Printf("Management: dropped a reply without a command: %+v\n", r)
+		return
+	}
+	c.waiting = false
+	c.replyKind = ""
+	c.replies <- r
+}
+
+// takeReply returns the text of a notification that is the reply of the current command
+func (c *Client) takeReply(line string) (string, bool) {
+	c.replyKindMtx.Lock()
+	defer c.replyKindMtx.Unlock()
+	prefix := ">" + c.replyKind + ":"
+	if c.replyKind == "" || !strings.HasPrefix(line, prefix) {
+		return "", false
+	}
+	return line[len(prefix):], true
+}
+
+// Quote escapes and quotes a command argument.
+// openvpn can't unescape control characters, arguments with them return ErrControlChars
+func Quote(arg string) (string, error) {
+	for _, r := range arg {
+		if r < 0x20 || r == 0x7f {
+			return "", ErrControlChars
+		}
+	}
+	arg = strings.ReplaceAll(arg, "\\", "\\\\")
+	arg = strings.ReplaceAll(arg, "\"", "\\\"")
+	return "\"" + arg + "\"", nil
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+func (c *Client) read() {
+	defer func() {
+		close(c.replies)
+		c.queueMtx.Lock()
+		c.closed = true
+		c.queueCond.Signal()
+		c.queueMtx.Unlock()
+	}()
+
+	scanner := bufio.NewScanner(c.conn)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case strings.HasPrefix(line, ">"):
+			if text, ok := c.takeReply(line); ok {
+				c.deliver(reply{text: text})
+				continue
+			}
+			ev, err := ParseEvent(line)
+			if err != nil {
+				log.Printf("Management: %v\n", err)
+				continue
+			}
+			c.queueMtx.Lock()
+			c.queue = append(c.queue, ev)
+			c.queueCond.Signal()
+			c.queueMtx.Unlock()
+		case strings.HasPrefix(line, "SUCCESS:"):
+			c.deliver(reply{text: strings.TrimSpace(line[len("SUCCESS:"):])})
+		case strings.HasPrefix(line, "ERROR:"):
+			c.deliver(reply{err: errors.New(strings.TrimSpace(line[len("ERROR:"):]))})
+		}
+	}
+}
+
+// Passes the queued events to the events channel in order
+func (c *Client) dispatch() {
+	defer close(c.events)
+	for {
+		c.queueMtx.Lock()
+		for len(c.queue) == 0 && !c.closed {
+			c.queueCond.Wait()
+		}
+		if len(c.queue) == 0 {
+			c.queueMtx.Unlock()
+			return
+		}
+		ev := c.queue[0]
+		c.queue = c.queue[1:]
+		c.queueMtx.Unlock()
+
+		c.events <- ev
+	}
+}
@@ -0,0 +1,187 @@
+package mgmt
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseEvent(t *testing.T) {
+	tests := []struct {
+		line string
+		want Event
+	}{
+		{">HOLD:Waiting for hold release:0", HoldEvent{Message: "Waiting for hold release:0"}},
+		{">INFO:OpenVPN Management Interface Version 1", InfoEvent{Message: "OpenVPN Management Interface Version 1"}},
+		{">FATAL:Cannot open TUN/TAP dev", FatalEvent{Message: "Cannot open TUN/TAP dev"}},
+		{">LOG:1570000000,I,Initialization Sequence Completed",
+			LogEvent{Time: time.Unix(1570000000, 0), Flags: "I", Message: "Initialization Sequence Completed"}},
+		{">ECHO:1570000000,forget-passwords", EchoEvent{Time: time.Unix(1570000000, 0), Param: "forget-passwords"}},
+		{">NEED-OK:Need 'token-insertion-request' confirmation MSG:Please insert your token",
+			NeedOkEvent{Name: "token-insertion-request", Message: "Please insert your token"}},
+		{">NEED-STR:Need 'pkcs11-id-request' input MSG:Please specify PKCS#11 id to use",
+			NeedStrEvent{Name: "pkcs11-id-request", Message: "Please specify PKCS#11 id to use"}},
+		{">REMOTE:vpn.example.com,1194,udp", RemoteEvent{Host: "vpn.example.com", Port: 1194, Proto: "udp"}},
+		{">PROXY:1,TCP,vpn.example.com", ProxyEvent{Index: 1, Proto: "TCP", Host: "vpn.example.com"}},
+		{">PK_SIGN:ZGF0YQ==", PkSignEvent{Data: "ZGF0YQ=="}},
+		{">PK_SIGN:ZGF0YQ==,RSA_PKCS1_PADDING", PkSignEvent{Data: "ZGF0YQ==", Algorithm: "RSA_PKCS1_PADDING"}},
+		{">BYTECOUNT:1024,2048", ByteCountEvent{In: 1024, Out: 2048}},
+		{">STATE:1570000000,CONNECTED,SUCCESS,10.8.0.6,1.2.3.4,1194,,,fd00::1000",
+			StateEvent{Time: time.Unix(1570000000, 0), Name: "CONNECTED", Description: "SUCCESS",
+				LocalIP: "10.8.0.6", RemoteIP: "1.2.3.4", RemotePort: "1194", LocalIPv6: "fd00::1000"}},
+		{">STATE:1570000000,WAIT", StateEvent{Time: time.Unix(1570000000, 0), Name: "WAIT"}},
+		{">PASSWORD:Need 'Auth' username/password",
+			PasswordEvent{Kind: PasswordNeed, Type: "Auth", NeedUsername: true}},
+		{">PASSWORD:Need 'Private Key' password", PasswordEvent{Kind: PasswordNeed, Type: "Private Key"}},
+		{">PASSWORD:Need 'Auth' username/password SC:1,Please enter token PIN",
+			PasswordEvent{Kind: PasswordNeed, Type: "Auth", NeedUsername: true,
+				Static: &StaticChallenge{Echo: true, Text: "Please enter token PIN"}}},
+		{">PASSWORD:Verification Failed: 'Auth'", PasswordEvent{Kind: PasswordFailed, Type: "Auth"}},
+		{">PASSWORD:Verification Failed: 'Auth' ['CRV1:R,E:Om01u7Fh4LrGBS7uh0SWmzwabUiGiW6l:Y3Ix:Please enter token PIN']",
+			PasswordEvent{Kind: PasswordFailed, Type: "Auth", Dynamic: &DynamicChallenge{Flags: "R,E",
+				StateID: "Om01u7Fh4LrGBS7uh0SWmzwabUiGiW6l", Username: "cr1", Text: "Please enter token PIN"}}},
+		{">PASSWORD:Auth-Token:abcdef", PasswordEvent{Kind: PasswordAuthToken, Type: "Auth", Token: "abcdef"}},
+		{">CLIENT:CONNECT,0,1", UnknownEvent{Kind: "CLIENT", Data: "CONNECT,0,1"}},
+	}
+	for _, test := range tests {
+		got, err := ParseEvent(test.line)
+		if err != nil {
+			t.Errorf("ParseEvent(%q) failed: %v", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseEvent(%q) = %#v, want %#v", test.line, got, test.want)
+		}
+	}
+}
+
+func TestParseEventInvalid(t *testing.T) {
+	for _, line := range []string{"", ">", ">NOCOLON", "SUCCESS: ok", ">BYTECOUNT:12",
+		">PASSWORD:Something else", ">REMOTE:host,port,udp"} {
+		if ev, err := ParseEvent(line); err == nil {
+			t.Errorf("ParseEvent(%q) = %#v, expected an error", line, ev)
+		}
+	}
+}
+
+func TestCommandReplies(t *testing.T) {
+	server, conn := net.Pipe()
+	c := NewClient(conn)
+	defer c.Close()
+
+	pkSig := make(chan []string, 1)
+	go func() {
+		scanner := bufio.NewScanner(server)
+		var lines []string
+		for scanner.Scan() {
+			if lines != nil {
+				if scanner.Text() == "END" {
+					pkSig <- lines
+					lines = nil
+					_, _ = server.Write([]byte("SUCCESS: pk-sig command succeeded\n"))
+				} else {
+					lines = append(lines, scanner.Text())
+				}
+				continue
+			}
+			switch scanner.Text() {
+			case "pk-sig":
+				lines = []string{}
+			case "state on":
+				// Notifications may arrive before the reply
+				_, _ = server.Write([]byte(">HOLD:Waiting for hold release:0\nSUCCESS: real-time state notification set to ON\n"))
+			case "proxy HTTP \"proxy.example.com\" 3128":
+				_, _ = server.Write([]byte("SUCCESS: proxy command succeeded\n"))
+			case "pkcs11-id-count":
+				_, _ = server.Write([]byte(">PKCS11ID-COUNT:1\n"))
+			case "pkcs11-id-get 0":
+				_, _ = server.Write([]byte(">PKCS11ID-ENTRY:'0', ID:'Token/01', BLOB:'MIIB'\n"))
+			case "pkcs11-id-get 1":
+				_, _ = server.Write([]byte("ERROR: Cannot get certificate\n"))
+			case `password "Auth" "p\"w"`:
+				_, _ = server.Write([]byte("ERROR: password entry failed\n"))
+			}
+		}
+	}()
+
+	if err := c.State(true); err != nil {
+		t.Errorf("state on failed: %v", err)
+	}
+	ev := <-c.Events()
+	if _, ok := ev.(HoldEvent); !ok {
+		t.Errorf("expected a hold event, got %#v", ev)
+	}
+	err := c.Password("Auth", `p"w`)
+	if cmdErr, ok := err.(*CommandError); !ok || cmdErr.Message != "password entry failed" {
+		t.Errorf("expected a command error, got %v", err)
+	}
+
+	signature := strings.Repeat("A", 64) + "BBBB"
+	if err := c.PkSig(signature); err != nil {
+		t.Errorf("pk-sig failed: %v", err)
+	}
+	if lines := <-pkSig; len(lines) != 2 || lines[0]+lines[1] != signature {
+		t.Errorf("wrong pk-sig lines: %q", lines)
+	}
+
+	if err := c.Proxy("HTTP", "proxy.example.com", 3128); err != nil {
+		t.Errorf("proxy failed: %v", err)
+	}
+	if count, err := c.PKCS11IDCount(); err != nil || count != 1 {
+		t.Errorf("pkcs11-id-count = %d, %v", count, err)
+	}
+	entry, err := c.PKCS11IDGet(0)
+	if err != nil || entry != (PKCS11ID{Index: 0, ID: "Token/01", Blob: "MIIB"}) {
+		t.Errorf("pkcs11-id-get 0 = %+v, %v", entry, err)
+	}
+	if _, err := c.PKCS11IDGet(1); err == nil {
+		t.Errorf("pkcs11-id-get 1 should fail")
+	}
+
+	server.Close()
+	if _, ok := <-c.Events(); ok {
+		t.Errorf("events channel should be closed")
+	}
+	if _, err := c.Command("state off"); err == nil {
+		t.Errorf("command should fail on a closed connection")
+	}
+}
+
+func TestCommandChecks(t *testing.T) {
+	server, conn := net.Pipe()
+	c := NewClient(conn)
+	defer c.Close()
+
+	go func() {
+		// A reply that no command waits for must not block the reader
+		_, _ = server.Write([]byte("SUCCESS: unsolicited\nERROR: unsolicited\n>HOLD:Waiting for hold release:0\n"))
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+			if scanner.Text() == "hold release" {
+				_, _ = server.Write([]byte("SUCCESS: hold release succeeded\n"))
+			}
+		}
+	}()
+	if _, ok := (<-c.Events()).(HoldEvent); !ok {
+		t.Fatal("expected a hold event")
+	}
+	if text, err := c.Command("hold release"); err != nil || text != "hold release succeeded" {
+		t.Errorf("hold release = %q, %v", text, err)
+	}
+
+	if _, err := c.Command(" "); err == nil {
+		t.Error("an empty command was sent")
+	}
+	for _, arg := range []string{"pass\nsignal SIGTERM", "pass\r", "a\x00b"} {
+		if _, err := Quote(arg); err != ErrControlChars {
+			t.Errorf("Quote(%q) = %v", arg, err)
+		}
+		if err := c.Password("Auth", arg); err != ErrControlChars {
+			t.Errorf("Password(%q) = %v", arg, err)
+		}
+	}
+	server.Close()
+}
@@ -0,0 +1,152 @@
+package daemon
+
+import (
+	"errors"
+	"github.com/TheWeirdDev/Vodga/shared/consts"
+	"github.com/TheWeirdDev/Vodga/shared/messages"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// "ip netns exec" puts the files of this directory over the ones in /etc
+var netnsEtc = filepath.Join("/etc/netns", consts.Netns)
+
+// namespace keeps the tunnel out of the host's network.
+// openvpn doesn't configure the device, the daemon moves it into the namespace
+// and gives it the address, the default routes and the DNS servers there
+type namespace struct {
+	mtx     sync.Mutex
+	enabled bool
+}
+
+func (n *namespace) isEnabled() bool {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return n.enabled
+}
+
+// prepareNamespace creates an empty namespace for a profile in namespace mode
+func (d *Daemon) prepareNamespace(args map[string]string) error {
+	if args["namespace"] != "true" {
+		return nil
+	}
+	if args["split_mode"] != "" {
+		return errors.New("split tunneling doesn't work in namespace mode")
+	}
+	if args["dns_stub"] == "true" {
+		return errors.New("the DNS stub doesn't work in namespace mode")
+	}
+	// Left by a daemon that didn't exit cleanly
+	_ = ipCommand("netns", "delete", consts.Netns)
+	if err := ipCommand("netns", "add", consts.Netns); err != nil {
+		return err
+	}
+	if err := ipCommand("-n", consts.Netns, "link", "set", "lo", "up"); err != nil {
+		_ = ipCommand("netns", "delete", consts.Netns)
+		return err
+	}
+	d.netns.mtx.Lock()
+	d.netns.enabled = true
+	d.netns.mtx.Unlock()
+	log.Printf("Network namespace %s created\n", consts.Netns)
+	return nil
+}
+
+// namespaceArgs returns the openvpn options of namespace mode
+func (d *Daemon) namespaceArgs() []string {
+	if !d.netns.isEnabled() {
+		return nil
+	}
+	// The host keeps its addresses and routes
+	return []string{"--ifconfig-noexec", "--route-noexec"}
+}
+
+// applyNamespace moves the device of the tunnel into the namespace and configures it.
+// It's called before the state becomes Connected, so commands don't start without a route
+func (d *Daemon) applyNamespace() {
+	if !d.netns.isEnabled() {
+		return
+	}
+	d.dns.mtx.Lock()
+	dev, servers, domains := d.dns.dev, d.dns.servers(), d.dns.pushed.Domains
+	d.dns.mtx.Unlock()
+	localIP, localIPv6 := d.openvpn.addresses()
+	if dev == "" || localIP == "" && localIPv6 == "" {
+		log.Println("Namespace: the device or the address of the tunnel is unknown")
+		return
+	}
+
+	// With persist-tun the device is still in the namespace after a restart
+	if _, err := net.InterfaceByName(dev); err == nil {
+		if err := ipCommand("link", "set", dev, "netns", consts.Netns); err != nil {
+			d.namespaceError(err)
+			return
+		}
+	}
+	cmds := [][]string{{"link", "set", dev, "up"}}
+	if localIP != "" {
+		cmds = append(cmds, []string{"addr", "replace", localIP + "/32", "dev", dev},
+			[]string{"route", "replace", "default", "dev", dev})
+	}
+	if localIPv6 != "" {
+		cmds = append(cmds, []string{"addr", "replace", localIPv6 + "/128", "dev", dev},
+			[]string{"-6", "route", "replace", "default", "dev", dev})
+	}
+	for _, args := range cmds {
+		if err := ipCommand(append([]string{"-n", consts.Netns}, args...)...); err != nil {
+			d.namespaceError(err)
+			return
+		}
+	}
+
+	if err := writeNamespaceResolvConf(dev, servers, domains); err != nil {
+		d.namespaceError(err)
+		return
+	}
+	log.Printf("Namespace: %s is up in %s\n", dev, consts.Netns)
+}
+
+func (d *Daemon) namespaceError(err error) {
+	log.Printf("Namespace: %v\n", err)
+	d.broadcastMessage(messages.ErrorMsg("Can't configure the namespace: " + err.Error()))
+}
+
+// writeNamespaceResolvConf gives the commands in the namespace the servers of the tunnel,
+// the resolver of the host isn't reachable from there
+func writeNamespaceResolvConf(dev string, servers, domains []string) error {
+	if err := os.MkdirAll(netnsEtc, 0755); err != nil {
+		return err
+	}
+	var b strings.Builder
+	b.WriteString("# Generated by vodga for " + dev + "\n")
+	for _, server := range servers {
+		b.WriteString("nameserver " + server + "\n")
+	}
+	if len(domains) > 0 {
+		b.WriteString("search " + strings.Join(domains, " ") + "\n")
+	}
+	return ioutil.WriteFile(filepath.Join(netnsEtc, "resolv.conf"), []byte(b.String()), 0644)
+}
+
+// stopNamespace deletes the namespace, commands that still run in it lose their network
+func (d *Daemon) stopNamespace() {
+	d.netns.mtx.Lock()
+	enabled := d.netns.enabled
+	d.netns.enabled = false
+	d.netns.mtx.Unlock()
+	if !enabled {
+		return
+	}
+	if err := ipCommand("netns", "delete", consts.Netns); err != nil {
+		log.Printf("Namespace: %v\n", err)
+	}
+	if err := os.RemoveAll(netnsEtc); err != nil {
+		log.Printf("Namespace: %v\n", err)
+	}
+	log.Printf("Network namespace %s deleted\n", consts.Netns)
+}
@@ -0,0 +1,126 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	routesPath = "/proc/net/route"
+	// How often the routing table is checked for network changes
+	networkPollInterval = 3 * time.Second
+)
+
+// route is the default route of a physical interface
+type route struct {
+	iface string
+	// Empty for point-to-point links
+	gateway string
+}
+
+func (r route) String() string {
+	if r.gateway == "" {
+		return r.iface
+	}
+	return r.iface + " via " + r.gateway
+}
+
+// defaultRoute returns the interface and the gateway of the default IPv4 route.
+// Routes of tun and tap devices are ignored, so openvpn's own routes don't count
+// as a network change
+func defaultRoute(r io.Reader) (route, error) {
+	scanner := bufio.NewScanner(r)
+	// Skip the header
+	scanner.Scan()
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		if strings.HasPrefix(fields[0], "tun") || strings.HasPrefix(fields[0], "tap") {
+			continue
+		}
+		// The gateway is in host byte order
+		gw, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil {
+			continue
+		}
+		rt := route{iface: fields[0]}
+		if gw != 0 {
+			ip := make(net.IP, 4)
+			binary.LittleEndian.PutUint32(ip, uint32(gw))
+			rt.gateway = ip.String()
+		}
+		return rt, nil
+	}
+	return route{}, scanner.Err()
+}
+
+func readDefaultRoute() (route, error) {
+	file, err := os.Open(routesPath)
+	if err != nil {
+		return route{}, err
+	}
+	defer file.Close()
+	return defaultRoute(file)
+}
+
+// watchNetwork brings the tunnel back when the default route changes,
+// e.g. after switching from ethernet to wifi or resuming from suspend
+func (d *Daemon) watchNetwork() {
+	last, err := readDefaultRoute()
+	if err != nil {
+		log.Printf("Can't watch for network changes: %v\n", err)
+		return
+	}
+	tick := time.NewTicker(networkPollInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-d.quit:
+			return
+		case <-tick.C:
+		}
+		rt, err := readDefaultRoute()
+		if err != nil || rt == last {
+			continue
+		}
+		log.Printf("Default route changed from %q to %q\n", last, rt)
+		last = rt
+		if rt.iface == "" {
+			// Nothing to reconnect to until the network is back
+			continue
+		}
+		d.networkChanged()
+	}
+}
+
+func (d *Daemon) networkChanged() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	switch d.openvpn.getState() {
+	case Connecting, Authenticating, Connected:
+		// openvpn restarts the connection without exiting
+		if m := d.openvpn.mgmt; m != nil {
+			go func() {
+				if err := m.Signal("SIGUSR1"); err != nil {
+					d.mgmtError(err)
+				}
+			}()
+		}
+	case Reconnecting:
+		if d.openvpn.isRunning() {
+			return
+		}
+		// Don't wait for the backoff delay, the network is back
+		d.wakeReconnect()
+	}
+}
@@ -0,0 +1,27 @@
+package daemon
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDefaultRoute(t *testing.T) {
+	table := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+tun0	00000000	0100080A	0003	0	0	0	00000080	0	0	0
+wlan0	0001A8C0	00000000	0001	0	0	600	00FFFFFF	0	0	0
+tun0	00000000	00000000	0001	0	0	0	00000000	0	0	0
+wlan0	00000000	0101A8C0	0003	0	0	600	00000000	0	0	0
+`
+	rt, err := defaultRoute(strings.NewReader(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt != (route{iface: "wlan0", gateway: "192.168.1.1"}) {
+		t.Errorf("wrong default route: %q", rt)
+	}
+
+	rt, err = defaultRoute(strings.NewReader(strings.SplitN(table, "\n", 3)[0] + "\n"))
+	if err != nil || rt != (route{}) {
+		t.Errorf("expected no default route, got %q, %v", rt, err)
+	}
+}
@@ -1,18 +1,76 @@
 package daemon
 
 import (
+	"github.com/TheWeirdDev/Vodga/daemon/mgmt"
 	"github.com/TheWeirdDev/Vodga/shared/auth"
+	"github.com/TheWeirdDev/Vodga/shared/messages"
+	"github.com/TheWeirdDev/Vodga/shared/profiles"
+	"github.com/TheWeirdDev/Vodga/shared/reconnect"
 	"os"
 	"os/exec"
+	"sync"
+	"time"
 )
 
+// Management is the part of the openvpn management interface that the daemon uses
+type Management interface {
+	Events() <-chan mgmt.Event
+	Command(cmd string) (string, error)
+	HoldRelease() error
+	State(on bool) error
+	ByteCount(n int) error
+	Username(typ, username string) error
+	Password(typ, password string) error
+	Signal(sig string) error
+	Remote(accept bool) error
+	PkSig(signature string) error
+	PKCS11IDCount() (int, error)
+	PKCS11IDGet(index int) (mgmt.PKCS11ID, error)
+	NeedStr(name, value string) error
+	Proxy(typ, host string, port uint16) error
+	Close() error
+}
+
+// dialMgmt connects to the management socket of openvpn
+var dialMgmt = func(path string) (Management, error) {
+	return mgmt.Dial(path)
+}
 
 type Openvpn struct {
 	config    string
+	// The config that openvpn is started with, after the script policy is applied
+	launchConfig string
+	trusted      bool
+	// launchConfig is a private copy that is removed after openvpn exits
+	launchCopy bool
+	// openvpn asks the client for the signatures of the private key
+	externalKey bool
+	// The certificate of the profile in a PKCS#11 token
+	pkcs11ID string
+	// The proxy that openvpn reaches the server through, nil connects directly
+	upstream *profiles.UpstreamProxy
+	// The proxy is in the launch config, because SOCKS credentials can't be given with 'proxy'
+	upstreamInConfig bool
 	creds     auth.Credentials
 	process   *exec.Cmd
-	connected bool
-	state     string
+	mgmt      Management
+	state     State
+	stateMtx  sync.Mutex
+	// When the state became Connected
+	connectedSince time.Time
+	// The addresses of the last openvpn state that had them
+	localIP    string
+	localIPv6  string
+	// The ifconfig-ipv6 of the server, older versions of openvpn don't report it in the state
+	pushedIPv6 string
+	remoteIP   string
+	remotePort string
+	// The reconnect policy of the profile and the state of reconnecting
+	policy   reconnect.Policy
+	attempt  int
+	failover failover
+	// Wakes up a scheduled reconnect before its time
+	wake     chan struct{}
 	bytesIn   uint64
 	bytesOut  uint64
 	totalIn   uint64
@@ -29,3 +87,104 @@ func (o *Openvpn) closeConnection() error {
 func (o *Openvpn) isRunning() bool {
 	return o.process != nil
 }
+
+func (o *Openvpn) getState() State {
+	o.stateMtx.Lock()
+	defer o.stateMtx.Unlock()
+	return o.state
+}
+
+// setState moves to another state and returns the previous one.
+// Transitions that are not in the transitions table are rejected
+func (o *Openvpn) setState(to State) (State, error) {
+	o.stateMtx.Lock()
+	defer o.stateMtx.Unlock()
+	from := o.state
+	if !from.canBecome(to) {
+		return from, &StateError{From: from, To: to}
+	}
+	o.state = to
+	if to == Connected {
+		o.connectedSince = time.Now()
+	} else if !to.isActive() {
+		o.connectedSince = time.Time{}
+	}
+	return from, nil
+}
+
+func (o *Openvpn) setAddresses(ev mgmt.StateEvent) {
+	o.stateMtx.Lock()
+	defer o.stateMtx.Unlock()
+	if ev.LocalIP != "" || ev.RemoteIP != "" {
+		o.localIP = ev.LocalIP
+		o.localIPv6 = ev.LocalIPv6
+		o.remoteIP = ev.RemoteIP
+		o.remotePort = ev.RemotePort
+	}
+}
+
+func (o *Openvpn) setPushedIPv6(addr string) {
+	o.stateMtx.Lock()
+	defer o.stateMtx.Unlock()
+	o.pushedIPv6 = addr
+}
+
+// tunnelIPv6 returns the IPv6 address of the tunnel, the caller holds stateMtx
+func (o *Openvpn) tunnelIPv6() string {
+	if o.localIPv6 != "" {
+		return o.localIPv6
+	}
+	return o.pushedIPv6
+}
+
+// addresses returns the addresses of the tunnel
+func (o *Openvpn) addresses() (string, string) {
+	o.stateMtx.Lock()
+	defer o.stateMtx.Unlock()
+	return o.localIP, o.tunnelIPv6()
+}
+
+func (o *Openvpn) clearAddresses() {
+	o.stateMtx.Lock()
+	defer o.stateMtx.Unlock()
+	o.localIP = ""
+	o.localIPv6 = ""
+	o.pushedIPv6 = ""
+	o.remoteIP = ""
+	o.remotePort = ""
+}
+
+// status returns a snapshot of the connection for the clients
+func (o *Openvpn) status() messages.Status {
+	o.stateMtx.Lock()
+	defer o.stateMtx.Unlock()
+	return messages.Status{
+		State:          o.state.String(),
+		Profile:        o.config,
+		ConnectedSince: o.connectedSince,
+		LocalIP:        o.localIP,
+		LocalIPv6:      o.tunnelIPv6(),
+		RemoteIP:       o.remoteIP,
+		RemotePort:     o.remotePort,
+		Bytecount: messages.Bytecount{In: o.bytesIn, Out: o.bytesOut,
+			TotalIn: o.totalIn, TotalOut: o.totalOut},
+	}
+}
+
+// addByteCount adds a BYTECOUNT of the openvpn process to the totals of the connection.
+// The counters start again with every process and after restarts of openvpn itself
+func (o *Openvpn) addByteCount(in, out uint64) {
+	if in < o.bytesIn || out < o.bytesOut {
+		o.newSession()
+	}
+	o.totalIn += in - o.bytesIn
+	o.totalOut += out - o.bytesOut
+	o.bytesIn = in
+	o.bytesOut = out
+}
+
+// newSession zeroes the counters of the openvpn process, the totals stay until the connection ends
+func (o *Openvpn) newSession() {
+	o.bytesIn = 0
+	o.bytesOut = 0
+}
@@ -0,0 +1,219 @@
+package daemon
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/TheWeirdDev/Vodga/daemon/mgmt"
+	"github.com/TheWeirdDev/Vodga/shared/auth"
+	"github.com/TheWeirdDev/Vodga/shared/consts"
+	"github.com/TheWeirdDev/Vodga/shared/messages"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+var (
+	errNoPasswordClient = errors.New("the client that started the connection is gone")
+	errPasswordCanceled = errors.New("the request was canceled")
+)
+
+// passwordState routes the password requests of openvpn to the client that sent CONNECT,
+// like the signatures of an external key. Only that client can answer them,
+// the others only see the state changes
+type passwordState struct {
+	mtx    sync.Mutex
+	client net.Conn
+	// The response of the client is sent here, it's closed when the request is canceled
+	response chan *messages.Message
+	// The command of the response, like PASSWORD_RESPONSE
+	expect string
+	// The challenge of the last authentication failure, it's answered with the next credentials
+	dynamic *mgmt.DynamicChallenge
+}
+
+// passwordKind converts the name of a password in openvpn into its kind in PASSWORD_REQUEST
+func passwordKind(typ string) string {
+	switch typ {
+	case "Auth":
+		return consts.PasswordAuth
+	case "Private Key":
+		return consts.PasswordPrivateKey
+	case "HTTP Proxy":
+		return consts.PasswordHTTPProxy
+	case "SOCKS Proxy":
+		return consts.PasswordSOCKSProxy
+	}
+	// The PINs of PKCS#11 tokens are named after the label of the token
+	if strings.HasSuffix(typ, " token") {
+		return consts.PasswordToken
+	}
+	return consts.PasswordOther
+}
+
+// scrv1 is the password of a static challenge, openvpn sends it to the server as it is
+func scrv1(password, response string) string {
+	return "SCRV1:" + base64.StdEncoding.EncodeToString([]byte(password)) + ":" +
+		base64.StdEncoding.EncodeToString([]byte(response))
+}
+
+// crv1 is the password that answers a dynamic challenge
+func crv1(dc *mgmt.DynamicChallenge, response string) string {
+	return "CRV1::" + dc.StateID + "::" + response
+}
+
+// setPasswordClient remembers the client of a new connection
+func (d *Daemon) setPasswordClient(c net.Conn) {
+	d.passwords.mtx.Lock()
+	defer d.passwords.mtx.Unlock()
+	d.passwords.client = c
+}
+
+// askClient sends a request to the client, the response with the expected command comes from
+// the returned channel. The channel is closed without a response if the request is canceled
+func (d *Daemon) askClient(req *messages.Message, expect string) (<-chan *messages.Message, error) {
+	d.passwords.mtx.Lock()
+	defer d.passwords.mtx.Unlock()
+	if d.passwords.client == nil {
+		return nil, errNoPasswordClient
+	}
+	if err := messages.WriteMessage(req, d.passwords.client); err != nil {
+		return nil, err
+	}
+	d.closePending()
+	d.passwords.response = make(chan *messages.Message, 1)
+	d.passwords.expect = expect
+	return d.passwords.response, nil
+}
+
+// answerClient passes a response of the client to the request that waits for it
+func (d *Daemon) answerClient(msg *messages.Message, c net.Conn) {
+	d.passwords.mtx.Lock()
+	defer d.passwords.mtx.Unlock()
+	if d.passwords.response == nil || d.passwords.expect != msg.Command {
+		d.reply(msg, messages.ErrorMsg("No request is waiting for "+msg.Command), c)
+		return
+	}
+	if c != d.passwords.client {
+		d.reply(msg, messages.DeniedMsg(msg.Command,
+			"only the client that started the connection can answer"), c)
+		return
+	}
+	d.passwords.response <- msg
+	d.passwords.response = nil
+	d.replyOK(msg, c)
+}
+
+// setDynamicChallenge keeps the challenge of a failure until openvpn asks for the credentials again
+func (d *Daemon) setDynamicChallenge(dc *mgmt.DynamicChallenge) {
+	d.passwords.mtx.Lock()
+	defer d.passwords.mtx.Unlock()
+	d.passwords.dynamic = dc
+}
+
+func (d *Daemon) takeDynamicChallenge() *mgmt.DynamicChallenge {
+	d.passwords.mtx.Lock()
+	defer d.passwords.mtx.Unlock()
+	dc := d.passwords.dynamic
+	d.passwords.dynamic = nil
+	return dc
+}
+
+// cancelPasswords stops waiting for a response when the connection ends
+func (d *Daemon) cancelPasswords() {
+	d.passwords.mtx.Lock()
+	defer d.passwords.mtx.Unlock()
+	d.closePending()
+	d.passwords.client = nil
+	d.passwords.dynamic = nil
+}
+
+// cancelRequests stops waiting for the responses to an openvpn process that exited.
+// The client stays, it answers the requests of the next process when openvpn reconnects
+func (d *Daemon) cancelRequests() {
+	d.passwords.mtx.Lock()
+	defer d.passwords.mtx.Unlock()
+	d.closePending()
+	d.passwords.dynamic = nil
+}
+
+// closePending cancels the request that waits for the client and tells if there was one
+func (d *Daemon) closePending() bool {
+	if d.passwords.response == nil {
+		return false
+	}
+	close(d.passwords.response)
+	d.passwords.response = nil
+	return true
+}
+
+// dropPasswordClient forgets a client that disconnected.
+// If it had to answer a request, nobody else can and the connection fails
+func (d *Daemon) dropPasswordClient(c net.Conn) {
+	d.passwords.mtx.Lock()
+	if c != d.passwords.client {
+		d.passwords.mtx.Unlock()
+		return
+	}
+	d.passwords.client = nil
+	pending := d.closePending()
+	d.passwords.mtx.Unlock()
+	if pending {
+		d.passwordFailed(errNoPasswordClient)
+	}
+}
+
+func (d *Daemon) passwordFailed(err error) {
+	log.Printf("Can't answer the request of openvpn: %v\n", err)
+	d.broadcastMessage(messages.ErrorMsg("Can't answer the request of openvpn: " + err.Error()))
+	d.setState(Failed, "the request of openvpn wasn't answered", "")
+	_ = d.openvpn.closeConnection()
+}
+
+// credentials returns the username and password that answer a password request.
+// The credentials of CONNECT answer the Auth requests, the ones of the upstream proxy and the
+// obfs4 transport answer their requests, the client is asked for everything else and the
+// responses of the challenges. It blocks until the response comes,
+// errPasswordCanceled means the connection ended meanwhile
+func (d *Daemon) credentials(ev mgmt.PasswordEvent) (string, string, error) {
+	creds := d.openvpn.creds
+	req := messages.PasswordRequest{Kind: passwordKind(ev.Type), Type: ev.Type, NeedUsername: ev.NeedUsername}
+	var dc *mgmt.DynamicChallenge
+	if req.Kind == consts.PasswordAuth {
+		dc = d.takeDynamicChallenge()
+	}
+	switch {
+	case dc != nil:
+		req = messages.PasswordRequest{Kind: consts.PasswordChallenge, Type: ev.Type, Text: dc.Text,
+			Echo: dc.Echo(), Dynamic: true}
+	case ev.Static != nil:
+		req = messages.PasswordRequest{Kind: consts.PasswordChallenge, Type: ev.Type, Text: ev.Static.Text,
+			Echo: ev.Static.Echo}
+	case req.Kind == consts.PasswordAuth && creds.Auth == auth.USER_PASS:
+		return creds.Username, creds.Password, nil
+	}
+	if username, password, ok := d.upstreamCredentials(ev.Type); ok {
+		return username, password, nil
+	}
+	if username, password, ok := d.transportCredentials(ev.Type); ok {
+		return username, password, nil
+	}
+
+	responses, err := d.askClient(messages.PasswordRequestMsg(req), consts.MsgPasswordResponse)
+	if err != nil {
+		return "", "", err
+	}
+	log.Printf("Waiting for the client to answer the %s request of %q\n", req.Kind, ev.Type)
+	resp, ok := <-responses
+	if !ok {
+		return "", "", errPasswordCanceled
+	}
+	switch {
+	case dc != nil:
+		// The username of the challenge is the one the server accepted
+		return dc.Username, crv1(dc, resp.Args["password"]), nil
+	case ev.Static != nil:
+		return creds.Username, scrv1(creds.Password, resp.Args["password"]), nil
+	}
+	return resp.Args["username"], resp.Args["password"], nil
+}
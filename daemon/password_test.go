@@ -0,0 +1,193 @@
+package daemon
+
+import (
+	"bufio"
+	"github.com/TheWeirdDev/Vodga/daemon/mgmt"
+	"github.com/TheWeirdDev/Vodga/shared/auth"
+	"github.com/TheWeirdDev/Vodga/shared/consts"
+	"github.com/TheWeirdDev/Vodga/shared/messages"
+	"testing"
+	"time"
+)
+
+type credentialsResult struct {
+	username, password string
+	err                error
+}
+
+// askCredentials answers a password request in the background and returns the request that the client got
+func askCredentials(t *testing.T, d *Daemon, ev mgmt.PasswordEvent,
+	client *bufio.Scanner) (messages.PasswordRequest, <-chan credentialsResult) {
+	done := make(chan credentialsResult, 1)
+	go func() {
+		username, password, err := d.credentials(ev)
+		done <- credentialsResult{username, password, err}
+	}()
+	if !client.Scan() {
+		t.Fatalf("no request: %v", client.Err())
+	}
+	msg, err := messages.UnmarshalMsg(client.Text())
+	if err != nil || msg.Command != consts.MsgPasswordRequest {
+		t.Fatalf("wrong message %q, %v", client.Text(), err)
+	}
+	return messages.ParsePasswordRequest(msg), done
+}
+
+func testPasswordDaemon(t *testing.T) (*Daemon, *bufio.Scanner, func()) {
+	client, server := unixPair(t)
+	d := &Daemon{}
+	d.openvpn.creds = auth.Credentials{Auth: auth.USER_PASS, Username: "user", Password: "pass"}
+	d.setPasswordClient(server)
+	return d, bufio.NewScanner(client), func() {
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestStaticChallenge(t *testing.T) {
+	d, scanner, done := testPasswordDaemon(t)
+	defer done()
+	server := d.passwords.client
+
+	req, result := askCredentials(t, d, mgmt.PasswordEvent{Kind: mgmt.PasswordNeed, Type: "Auth",
+		NeedUsername: true, Static: &mgmt.StaticChallenge{Echo: true, Text: "Enter PIN"}}, scanner)
+	if req != (messages.PasswordRequest{Kind: consts.PasswordChallenge, Type: "Auth", Text: "Enter PIN",
+		Echo: true}) {
+		t.Errorf("wrong request: %+v", req)
+	}
+
+	// Only the client of the connection can answer
+	other, _ := unixPair(t)
+	defer other.Close()
+	d.answerClient(messages.PasswordResponseMsg("", "000000"), other)
+	answer := messages.PasswordResponseMsg("", "123456")
+	answer.ID = "1"
+	d.answerClient(answer, server)
+	if !scanner.Scan() {
+		t.Fatal(scanner.Err())
+	}
+	if reply, err := messages.UnmarshalMsg(scanner.Text()); err != nil || reply.Command != consts.MsgOK ||
+		reply.ID != "1" {
+		t.Fatalf("wrong reply %q", scanner.Text())
+	}
+	r := <-result
+	if r.err != nil || r.username != "user" || r.password != "SCRV1:cGFzcw==:MTIzNDU2" {
+		t.Errorf("got %+v", r)
+	}
+}
+
+func TestDynamicChallenge(t *testing.T) {
+	d, scanner, done := testPasswordDaemon(t)
+	defer done()
+	dc := &mgmt.DynamicChallenge{Flags: "R", StateID: "Om01u7Fh", Username: "cr", Text: "Enter PIN"}
+	ev := mgmt.PasswordEvent{Kind: mgmt.PasswordNeed, Type: "Auth", NeedUsername: true}
+
+	d.setDynamicChallenge(dc)
+	req, result := askCredentials(t, d, ev, scanner)
+	if req != (messages.PasswordRequest{Kind: consts.PasswordChallenge, Type: "Auth", Text: "Enter PIN",
+		Dynamic: true}) {
+		t.Errorf("wrong request: %+v", req)
+	}
+	d.answerClient(messages.PasswordResponseMsg("", "123456"), d.passwords.client)
+	if r := <-result; r.err != nil || r.username != "cr" || r.password != "CRV1::Om01u7Fh::123456" {
+		t.Errorf("got %+v", r)
+	}
+
+	// The connection ends while waiting
+	d.setDynamicChallenge(dc)
+	_, result = askCredentials(t, d, ev, scanner)
+	d.cancelPasswords()
+	if r := <-result; r.err != errPasswordCanceled {
+		t.Errorf("got %+v", r)
+	}
+}
+
+func TestPasswordRequests(t *testing.T) {
+	d, scanner, done := testPasswordDaemon(t)
+	defer done()
+
+	// The credentials of CONNECT answer without asking
+	username, password, err := d.credentials(mgmt.PasswordEvent{Kind: mgmt.PasswordNeed, Type: "Auth",
+		NeedUsername: true})
+	if err != nil || username != "user" || password != "pass" {
+		t.Errorf("got %q %q %v", username, password, err)
+	}
+
+	for _, tt := range []struct {
+		ev   mgmt.PasswordEvent
+		want messages.PasswordRequest
+	}{
+		{mgmt.PasswordEvent{Kind: mgmt.PasswordNeed, Type: "Private Key"},
+			messages.PasswordRequest{Kind: consts.PasswordPrivateKey, Type: "Private Key"}},
+		{mgmt.PasswordEvent{Kind: mgmt.PasswordNeed, Type: "HTTP Proxy", NeedUsername: true},
+			messages.PasswordRequest{Kind: consts.PasswordHTTPProxy, Type: "HTTP Proxy", NeedUsername: true}},
+		{mgmt.PasswordEvent{Kind: mgmt.PasswordNeed, Type: "PIV_II token"},
+			messages.PasswordRequest{Kind: consts.PasswordToken, Type: "PIV_II token"}},
+	} {
+		req, result := askCredentials(t, d, tt.ev, scanner)
+		if req != tt.want {
+			t.Errorf("got %+v, want %+v", req, tt.want)
+		}
+		d.answerClient(messages.PasswordResponseMsg("proxy-user", "secret"), d.passwords.client)
+		if r := <-result; r.err != nil || r.username != "proxy-user" || r.password != "secret" {
+			t.Errorf("got %+v", r)
+		}
+	}
+}
+
+// recordingMgmt records the answers that are sent to openvpn
+type recordingMgmt struct {
+	Management
+	calls chan string
+}
+
+func (m *recordingMgmt) Password(typ, password string) error {
+	m.calls <- "password " + password
+	return nil
+}
+
+func (m *recordingMgmt) PkSig(signature string) error {
+	m.calls <- "pk-sig " + signature
+	return nil
+}
+
+func TestPasswordAfterExit(t *testing.T) {
+	d, scanner, done := testPasswordDaemon(t)
+	defer done()
+	m := &recordingMgmt{calls: make(chan string, 1)}
+	ev := mgmt.PasswordEvent{Kind: mgmt.PasswordNeed, Type: "Private Key"}
+
+	// openvpn exits while the client answers, the answer goes to the connection that asked
+	d.openvpn.mgmt = m
+	d.processMgmtEvent(ev)
+	if !scanner.Scan() {
+		t.Fatal(scanner.Err())
+	}
+	d.openvpn.mgmt = nil
+	d.answerClient(messages.PasswordResponseMsg("", "secret"), d.passwords.client)
+	if call := <-m.calls; call != "password secret" {
+		t.Errorf("got %q", call)
+	}
+
+	// The request of an exited process is canceled
+	d.openvpn.mgmt = m
+	d.processMgmtEvent(ev)
+	if !scanner.Scan() {
+		t.Fatal(scanner.Err())
+	}
+	d.openvpn.mgmt = nil
+	d.cancelRequests()
+	if d.passwords.client == nil {
+		t.Error("the client was dropped")
+	}
+	d.answerClient(messages.PasswordResponseMsg("", "secret"), d.passwords.client)
+	scanner.Scan()
+	if reply, _ := messages.UnmarshalMsg(scanner.Text()); reply == nil || reply.Command != consts.MsgError {
+		t.Errorf("the canceled request was answered: %q", scanner.Text())
+	}
+	select {
+	case call := <-m.calls:
+		t.Errorf("openvpn got %q", call)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
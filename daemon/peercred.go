@@ -0,0 +1,125 @@
+package daemon
+
+import (
+	"errors"
+	"github.com/TheWeirdDev/Vodga/shared/consts"
+	"log"
+	"net"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Permission is what a connected client is allowed to do
+type Permission int
+
+const (
+	// PermRead allows querying the daemon
+	PermRead Permission = iota
+	// PermControl allows changing the connection and stopping the daemon
+	PermControl
+)
+
+func (p Permission) String() string {
+	switch p {
+	case PermRead:
+		return "read"
+	case PermControl:
+		return "control"
+	default:
+		return "unknown"
+	}
+}
+
+// Commands that read-only clients may send, everything else needs PermControl
+var readOnlyCommands = map[string]bool{
+	consts.MsgHello:        true,
+	consts.MsgGetBytecount: true,
+	consts.MsgGetLogs:      true,
+	consts.MsgGetStatus:    true,
+	consts.MsgSubscribe:    true,
+}
+
+// peer is the process on the other side of a client connection
+type peer struct {
+	uid  uint32
+	gid  uint32
+	pid  int32
+	perm Permission
+}
+
+// getPeer reads SO_PEERCRED of a unix socket connection and decides its permission
+func getPeer(c net.Conn) (*peer, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("not a unix socket connection")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+
+	p := &peer{uid: cred.Uid, gid: cred.Gid, pid: cred.Pid}
+	p.perm = permissionFor(p)
+	return p, nil
+}
+
+// The lookups of the control group and of the groups of a user, tests replace them
+var (
+	lookupGroup  = user.LookupGroup
+	lookupGroups = func(uid uint32) ([]string, error) {
+		usr, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+		if err != nil {
+			return nil, err
+		}
+		return usr.GroupIds()
+	}
+)
+
+// Root and members of the control group can control the daemon, others can only read
+func permissionFor(p *peer) Permission {
+	if p.uid == 0 {
+		return PermControl
+	}
+	grp, err := lookupGroup(consts.ControlGroup)
+	if err != nil {
+		return PermRead
+	}
+	if grp.Gid == strconv.FormatUint(uint64(p.gid), 10) {
+		return PermControl
+	}
+	gids, err := lookupGroups(p.uid)
+	if err != nil {
+		log.Printf("Can't get the groups of uid %d: %v\n", p.uid, err)
+		return PermRead
+	}
+	for _, gid := range gids {
+		if gid == grp.Gid {
+			return PermControl
+		}
+	}
+	return PermRead
+}
+
+// authorize checks if the peer may send the command and logs the decision
+func (p *peer) authorize(cmd string) bool {
+	allowed := p.perm == PermControl || readOnlyCommands[cmd]
+	decision := "denied"
+	if allowed {
+		decision = "allowed"
+	}
+	log.Printf("Command %s from uid=%d pid=%d (%v): %s\n", cmd, p.uid, p.pid, p.perm, decision)
+	return allowed
+}
@@ -0,0 +1,64 @@
+package daemon
+
+import (
+	"errors"
+	"github.com/TheWeirdDev/Vodga/shared/consts"
+	"os/user"
+	"testing"
+)
+
+func TestPermissions(t *testing.T) {
+	oldGroup, oldGroups := lookupGroup, lookupGroups
+	defer func() {
+		lookupGroup, lookupGroups = oldGroup, oldGroups
+	}()
+	groupExists := true
+	lookupGroup = func(name string) (*user.Group, error) {
+		if name != consts.ControlGroup || !groupExists {
+			return nil, user.UnknownGroupError(name)
+		}
+		return &user.Group{Gid: "1500", Name: name}, nil
+	}
+	lookupGroups = func(uid uint32) ([]string, error) {
+		switch uid {
+		case 1001:
+			return []string{"1001", "1500"}, nil
+		case 1002:
+			return []string{"1002", "27"}, nil
+		}
+		return nil, errors.New("unknown user")
+	}
+
+	tests := []struct {
+		name    string
+		peer    peer
+		noGroup bool
+		want    Permission
+	}{
+		{"root", peer{uid: 0, gid: 0}, false, PermControl},
+		{"root without the group", peer{uid: 0, gid: 0}, true, PermControl},
+		{"primary group", peer{uid: 1000, gid: 1500}, false, PermControl},
+		{"supplementary group", peer{uid: 1001, gid: 1001}, false, PermControl},
+		{"other user", peer{uid: 1002, gid: 1002}, false, PermRead},
+		{"unknown user", peer{uid: 4242, gid: 4242}, false, PermRead},
+		{"member without the group", peer{uid: 1001, gid: 1001}, true, PermRead},
+	}
+	for _, test := range tests {
+		groupExists = !test.noGroup
+		p := test.peer
+		p.perm = permissionFor(&p)
+		if p.perm != test.want {
+			t.Errorf("%s: permission %v, want %v", test.name, p.perm, test.want)
+		}
+		for _, cmd := range []string{consts.MsgHello, consts.MsgGetStatus, consts.MsgGetLogs, consts.MsgSubscribe} {
+			if !p.authorize(cmd) {
+				t.Errorf("%s: read-only command %s was denied", test.name, cmd)
+			}
+		}
+		for _, cmd := range []string{consts.MsgConnect, consts.MsgDisconnect, consts.MsgStop, consts.MsgExec} {
+			if got := p.authorize(cmd); got != (test.want == PermControl) {
+				t.Errorf("%s: authorize(%s) = %v", test.name, cmd, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package daemon
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"github.com/TheWeirdDev/Vodga/shared/consts"
+	"github.com/TheWeirdDev/Vodga/shared/messages"
+	"log"
+)
+
+// pkcs11Certs lists the certificates of the tokens of pkcs11-providers
+func pkcs11Certs(m Management) ([]messages.PKCS11Cert, error) {
+	count, err := m.PKCS11IDCount()
+	if err != nil {
+		return nil, err
+	}
+	var certs []messages.PKCS11Cert
+	for i := 0; i < count; i++ {
+		entry, err := m.PKCS11IDGet(i)
+		if err != nil {
+			return nil, err
+		}
+		cert := messages.PKCS11Cert{ID: entry.ID}
+		// The id is enough to answer, the rest helps the user to choose
+		if der, err := base64.StdEncoding.DecodeString(entry.Blob); err == nil {
+			if c, err := x509.ParseCertificate(der); err == nil {
+				cert.Subject = c.Subject.String()
+				cert.Issuer = c.Issuer.String()
+				cert.NotAfter = c.NotAfter
+			}
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// pkcs11ID answers a pkcs11-id-request. The certificate of the profile is used if a token has it,
+// otherwise the client chooses one. It blocks until the client answers
+func (d *Daemon) pkcs11ID(m Management) (string, error) {
+	certs, err := pkcs11Certs(m)
+	if err != nil {
+		return "", err
+	}
+	if len(certs) == 0 {
+		return "", errors.New("no certificates were found in the tokens")
+	}
+	for _, cert := range certs {
+		if cert.ID == d.openvpn.pkcs11ID {
+			return cert.ID, nil
+		}
+	}
+
+	req, err := messages.PKCS11IDRequestMsg(certs)
+	if err != nil {
+		return "", err
+	}
+	responses, err := d.askClient(req, consts.MsgPKCS11IDResponse)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Waiting for the client to choose one of %d certificates\n", len(certs))
+	resp, ok := <-responses
+	if !ok {
+		return "", errPasswordCanceled
+	}
+	for _, cert := range certs {
+		if cert.ID == resp.Args["id"] {
+			return cert.ID, nil
+		}
+	}
+	return "", errors.New("the client chose a certificate that is not in the tokens")
+}
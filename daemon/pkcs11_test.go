@@ -0,0 +1,95 @@
+package daemon
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"github.com/TheWeirdDev/Vodga/daemon/mgmt"
+	"github.com/TheWeirdDev/Vodga/shared/consts"
+	"github.com/TheWeirdDev/Vodga/shared/messages"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeToken answers the pkcs11 commands of the management interface with two certificates
+func fakeToken(t *testing.T) *mgmt.Client {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "alice"},
+		NotAfter: time.Unix(2000000000, 0)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := base64.StdEncoding.EncodeToString(der)
+
+	server, conn := net.Pipe()
+	go func() {
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+			var reply string
+			switch scanner.Text() {
+			case "pkcs11-id-count":
+				reply = ">PKCS11ID-COUNT:2\n"
+			case "pkcs11-id-get 0":
+				reply = fmt.Sprintf(">PKCS11ID-ENTRY:'0', ID:'Token/01', BLOB:'%s'\n", blob)
+			case "pkcs11-id-get 1":
+				reply = ">PKCS11ID-ENTRY:'1', ID:'Token/02', BLOB:''\n"
+			}
+			_, _ = server.Write([]byte(reply))
+		}
+	}()
+	return mgmt.NewClient(conn)
+}
+
+func TestPKCS11ID(t *testing.T) {
+	d, scanner, done := testPasswordDaemon(t)
+	defer done()
+	server := d.passwords.client
+	m := fakeToken(t)
+	defer m.Close()
+
+	// The stored certificate is used without asking
+	d.openvpn.pkcs11ID = "Token/02"
+	if id, err := d.pkcs11ID(m); err != nil || id != "Token/02" {
+		t.Errorf("pkcs11ID() = %q, %v", id, err)
+	}
+
+	d.openvpn.pkcs11ID = "Token/03"
+	type result struct {
+		id  string
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		id, err := d.pkcs11ID(m)
+		results <- result{id, err}
+	}()
+	if !scanner.Scan() {
+		t.Fatal(scanner.Err())
+	}
+	msg, err := messages.UnmarshalMsg(scanner.Text())
+	if err != nil || msg.Command != consts.MsgPKCS11IDRequest {
+		t.Fatalf("wrong message %q, %v", scanner.Text(), err)
+	}
+	certs, err := messages.ParsePKCS11IDRequest(msg)
+	if err != nil || len(certs) != 2 {
+		t.Fatalf("wrong certificates %+v, %v", certs, err)
+	}
+	if certs[0].ID != "Token/01" || certs[0].Subject != "CN=alice" || certs[0].NotAfter.Unix() != 2000000000 {
+		t.Errorf("wrong certificate %+v", certs[0])
+	}
+	d.answerClient(messages.PKCS11IDResponseMsg("Token/01"), server)
+	if r := <-results; r.err != nil || r.id != "Token/01" {
+		t.Errorf("got %+v", r)
+	}
+}
@@ -0,0 +1,427 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/TheWeirdDev/Vodga/shared/consts"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	proxyDialTimeout = 10 * time.Second
+	// Sockets bound to the tunnel device find their routes in this table
+	proxyRouteTable   = "5645"
+	proxyRulePriority = "5645"
+)
+
+// SOCKS5 reply codes
+const (
+	socksSucceeded       = 0x00
+	socksNotAllowed      = 0x02
+	socksHostUnreachable = 0x04
+	socksCmdUnsupported  = 0x07
+	socksAddrUnsupported = 0x08
+)
+
+var errTunnelDown = errors.New("the tunnel is not connected")
+
+// deviceDialer returns a dialer whose sockets only use a device
+func deviceDialer(dev string, timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout: timeout,
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, dev)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+}
+
+// tunnelDial connects to an address through the tunnel, names are resolved by the DNS servers of the tunnel
+func tunnelDial(dev string, servers []string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	dialer := deviceDialer(dev, proxyDialTimeout)
+	if net.ParseIP(host) != nil {
+		return dialer.Dial("tcp", addr)
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("the tunnel has no DNS servers to resolve " + host)
+	}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return deviceDialer(dev, dnsTimeout).DialContext(ctx, network, net.JoinHostPort(servers[0], "53"))
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), proxyDialTimeout)
+	defer cancel()
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = dialer.Dial("tcp", net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// localProxy is a SOCKS5 and HTTP CONNECT proxy on localhost.
+// Every connection leaves through the tunnel device, they are refused while the tunnel is down
+type localProxy struct {
+	socks    net.Listener
+	http     net.Listener
+	upstream dnsUpstream
+	dial     func(dev string, servers []string, addr string) (net.Conn, error)
+	wg       sync.WaitGroup
+}
+
+// startProxy listens on the ports of localhost that are not zero
+func startProxy(socksPort, httpPort int, upstream dnsUpstream) (*localProxy, error) {
+	p := &localProxy{upstream: upstream, dial: tunnelDial}
+	var err error
+	if socksPort != 0 {
+		if p.socks, err = net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(socksPort))); err != nil {
+			return nil, err
+		}
+		p.wg.Add(1)
+		go p.serve(p.socks, p.serveSOCKS)
+	}
+	if httpPort != 0 {
+		if p.http, err = net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(httpPort))); err != nil {
+			p.close()
+			return nil, err
+		}
+		p.wg.Add(1)
+		go p.serve(p.http, p.serveHTTP)
+	}
+	return p, nil
+}
+
+// ports returns the ports that the proxy listens on, zero for the disabled ones
+func (p *localProxy) ports() (socks, http int) {
+	if p.socks != nil {
+		socks = p.socks.Addr().(*net.TCPAddr).Port
+	}
+	if p.http != nil {
+		http = p.http.Addr().(*net.TCPAddr).Port
+	}
+	return socks, http
+}
+
+func (p *localProxy) close() {
+	if p.socks != nil {
+		p.socks.Close()
+	}
+	if p.http != nil {
+		p.http.Close()
+	}
+	p.wg.Wait()
+}
+
+func (p *localProxy) serve(ln net.Listener, handle func(net.Conn)) {
+	defer p.wg.Done()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go handle(c)
+	}
+}
+
+// connect opens the connection of a client through the tunnel
+func (p *localProxy) connect(addr string) (net.Conn, error) {
+	dev, servers, ok := p.upstream()
+	if !ok {
+		return nil, errTunnelDown
+	}
+	return p.dial(dev, servers, addr)
+}
+
+// serveSOCKS handles a SOCKS5 client, only CONNECT without authentication is supported
+func (p *localProxy) serveSOCKS(c net.Conn) {
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(proxyDialTimeout))
+	r := bufio.NewReader(c)
+
+	// Greeting: version, number of methods, methods
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil || header[0] != 5 {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return
+	}
+	noAuth := false
+	for _, m := range methods {
+		noAuth = noAuth || m == 0
+	}
+	if !noAuth {
+		_, _ = c.Write([]byte{5, 0xff})
+		return
+	}
+	if _, err := c.Write([]byte{5, 0}); err != nil {
+		return
+	}
+
+	// Request: version, command, reserved, address type
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil || req[0] != 5 {
+		return
+	}
+	if req[1] != 1 {
+		socksReply(c, socksCmdUnsupported, nil)
+		return
+	}
+	var host string
+	switch req[3] {
+	case 1, 4:
+		ip := make(net.IP, 4)
+		if req[3] == 4 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return
+		}
+		host = ip.String()
+	case 3:
+		size, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		name := make([]byte, size)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		socksReply(c, socksAddrUnsupported, nil)
+		return
+	}
+	var port uint16
+	if err := binary.Read(r, binary.BigEndian, &port); err != nil {
+		return
+	}
+
+	upstream, err := p.connect(net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err == errTunnelDown {
+		socksReply(c, socksNotAllowed, nil)
+		return
+	} else if err != nil {
+		log.Printf("Proxy: %v\n", err)
+		socksReply(c, socksHostUnreachable, nil)
+		return
+	}
+	defer upstream.Close()
+	if !socksReply(c, socksSucceeded, upstream.LocalAddr()) {
+		return
+	}
+	_ = c.SetDeadline(time.Time{})
+	relay(c, r, upstream)
+}
+
+// socksReply sends the reply to a request, with the bound address if there's one
+func socksReply(c net.Conn, code byte, bound net.Addr) bool {
+	reply := []byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0}
+	if addr, ok := bound.(*net.TCPAddr); ok {
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			copy(reply[4:8], ip4)
+		} else {
+			reply = append([]byte{5, code, 0, 4}, addr.IP.To16()...)
+			reply = append(reply, 0, 0)
+		}
+		binary.BigEndian.PutUint16(reply[len(reply)-2:], uint16(addr.Port))
+	}
+	_, err := c.Write(reply)
+	return err == nil
+}
+
+// serveHTTP handles an HTTP CONNECT request
+func (p *localProxy) serveHTTP(c net.Conn) {
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(proxyDialTimeout))
+	r := bufio.NewReader(c)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return
+	}
+	if req.Method != http.MethodConnect {
+		httpReply(c, http.StatusMethodNotAllowed)
+		return
+	}
+	upstream, err := p.connect(req.Host)
+	if err == errTunnelDown {
+		httpReply(c, http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		log.Printf("Proxy: %v\n", err)
+		httpReply(c, http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	if _, err := fmt.Fprint(c, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	_ = c.SetDeadline(time.Time{})
+	relay(c, r, upstream)
+}
+
+func httpReply(c net.Conn, status int) {
+	fmt.Fprintf(c, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+		status, http.StatusText(status))
+}
+
+// relay copies in both directions until both sides are done.
+// r is the reader of the client, it may have buffered data
+func relay(client net.Conn, r io.Reader, upstream net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(upstream, r)
+		if tcp, ok := upstream.(*net.TCPConn); ok {
+			_ = tcp.CloseWrite()
+		}
+		close(done)
+	}()
+	_, _ = io.Copy(client, upstream)
+	if tcp, ok := client.(*net.TCPConn); ok {
+		_ = tcp.CloseWrite()
+	}
+	<-done
+}
+
+// proxyState is the proxy of the profile and the routes of its sockets
+type proxyState struct {
+	mtx   sync.Mutex
+	proxy *localProxy
+	only  bool
+	// The device that the routing rule is for
+	dev string
+}
+
+// prepareProxy starts the proxy if the profile enables it
+func (d *Daemon) prepareProxy(args map[string]string) error {
+	if args["proxy_socks"] == "" && args["proxy_http"] == "" {
+		return nil
+	}
+	if args["namespace"] == "true" {
+		return errors.New("the proxy doesn't work in namespace mode")
+	}
+	var ports [2]int
+	for i, name := range []string{"proxy_socks", "proxy_http"} {
+		port, err := strconv.ParseUint(args[name], 10, 16)
+		if args[name] != "" && err != nil {
+			return fmt.Errorf("invalid proxy port %q", args[name])
+		}
+		ports[i] = int(port)
+	}
+	if ports[0] == 0 && ports[1] == 0 {
+		ports[0] = consts.ProxySOCKSPort
+	}
+	proxy, err := startProxy(ports[0], ports[1], d.dnsUpstream)
+	if err != nil {
+		return fmt.Errorf("can't start the proxy: %v", err)
+	}
+	socks, http := proxy.ports()
+	log.Printf("Proxy: SOCKS5 port %d, HTTP port %d\n", socks, http)
+	d.proxy.mtx.Lock()
+	d.proxy.proxy = proxy
+	d.proxy.only = args["proxy_only"] == "true"
+	d.proxy.mtx.Unlock()
+	return nil
+}
+
+// proxyArgs returns the openvpn options of the proxy
+func (d *Daemon) proxyArgs() []string {
+	d.proxy.mtx.Lock()
+	defer d.proxy.mtx.Unlock()
+	if d.proxy.proxy != nil && d.proxy.only {
+		return []string{"--route-nopull"}
+	}
+	return nil
+}
+
+// proxyPorts returns the ports of the proxy for the status
+func (d *Daemon) proxyPorts() (int, int) {
+	d.proxy.mtx.Lock()
+	defer d.proxy.mtx.Unlock()
+	if d.proxy.proxy == nil {
+		return 0, 0
+	}
+	return d.proxy.proxy.ports()
+}
+
+// applyProxy routes the sockets of the proxy when the tunnel is up.
+// They are bound to the device, without the pushed routes the main table has no route for them
+func (d *Daemon) applyProxy() {
+	d.proxy.mtx.Lock()
+	defer d.proxy.mtx.Unlock()
+	if d.proxy.proxy == nil {
+		return
+	}
+	d.dns.mtx.Lock()
+	dev := d.dns.dev
+	d.dns.mtx.Unlock()
+	if dev == "" || dev == d.proxy.dev {
+		return
+	}
+	removeProxyRoutes(d.proxy.dev)
+	d.proxy.dev = dev
+	for _, family := range []string{"-4", "-6"} {
+		for _, args := range [][]string{
+			{family, "route", "replace", "default", "dev", dev, "table", proxyRouteTable},
+			{family, "rule", "add", "oif", dev, "table", proxyRouteTable, "priority", proxyRulePriority},
+		} {
+			if err := ipCommand(args...); err != nil {
+				// The tunnel may not have IPv6
+				log.Printf("Proxy: %v\n", err)
+			}
+		}
+	}
+}
+
+func removeProxyRoutes(dev string) {
+	if dev == "" {
+		return
+	}
+	for _, family := range []string{"-4", "-6"} {
+		_ = ipCommand(family, "rule", "del", "oif", dev, "table", proxyRouteTable)
+		_ = ipCommand(family, "route", "flush", "table", proxyRouteTable)
+	}
+}
+
+// stopProxy closes the proxy of the profile
+func (d *Daemon) stopProxy() {
+	d.proxy.mtx.Lock()
+	proxy := d.proxy.proxy
+	removeProxyRoutes(d.proxy.dev)
+	d.proxy.proxy = nil
+	d.proxy.only = false
+	d.proxy.dev = ""
+	d.proxy.mtx.Unlock()
+	// The proxy calls dnsUpstream until it's closed
+	if proxy != nil {
+		proxy.close()
+	}
+}
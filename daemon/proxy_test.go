@@ -0,0 +1,144 @@
+package daemon
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// testProxy serves SOCKS5 and HTTP on random ports and dials without the tunnel
+func testProxy(t *testing.T, up bool) *localProxy {
+	p := &localProxy{
+		upstream: func() (string, []string, bool) { return "tun0", nil, up },
+		dial: func(_ string, _ []string, addr string) (net.Conn, error) {
+			return net.Dial("tcp", addr)
+		},
+	}
+	var err error
+	if p.socks, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if p.http, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	p.wg.Add(2)
+	go p.serve(p.socks, p.serveSOCKS)
+	go p.serve(p.http, p.serveHTTP)
+	return p
+}
+
+func echoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln
+}
+
+// socksConnect sends a CONNECT for 127.0.0.1:port and returns the reply code
+func socksConnect(t *testing.T, p *localProxy, port int) (net.Conn, byte) {
+	c, err := net.Dial("tcp", p.socks.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := []byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, byte(port >> 8), byte(port)}
+	if _, err := c.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, 12)
+	if _, err := io.ReadFull(c, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp[0] != 5 || resp[1] != 0 {
+		t.Fatalf("wrong method selection: %v", resp[:2])
+	}
+	return c, resp[3]
+}
+
+func TestProxyRefusesWhileDown(t *testing.T) {
+	p := testProxy(t, false)
+	defer p.close()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	c, code := socksConnect(t, p, echo.Addr().(*net.TCPAddr).Port)
+	c.Close()
+	if code != socksNotAllowed {
+		t.Errorf("SOCKS reply is %d, want %d", code, socksNotAllowed)
+	}
+
+	c, err := net.Dial("tcp", p.http.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := io.WriteString(c, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\nHost: "+
+		echo.Addr().String()+"\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("HTTP status is %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+func TestProxyRelays(t *testing.T) {
+	p := testProxy(t, true)
+	defer p.close()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	c, code := socksConnect(t, p, echo.Addr().(*net.TCPAddr).Port)
+	defer c.Close()
+	if code != socksSucceeded {
+		t.Fatalf("SOCKS reply is %d", code)
+	}
+	if _, err := io.WriteString(c, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("got %q, %v through SOCKS", buf, err)
+	}
+
+	h, err := net.Dial("tcp", p.http.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if _, err := io.WriteString(h, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(h)
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.Contains(line, " 200 ") {
+		t.Fatalf("wrong reply %q, %v", line, err)
+	}
+	if _, err := r.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(h, "pong"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "pong" {
+		t.Errorf("got %q, %v through HTTP", buf, err)
+	}
+}
@@ -0,0 +1,115 @@
+package daemon
+
+import (
+	"github.com/TheWeirdDev/Vodga/shared/consts"
+	"github.com/TheWeirdDev/Vodga/shared/messages"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+// failover decides which remotes of a config openvpn may use
+// by answering its >REMOTE notifications (--management-query-remote)
+type failover struct {
+	// Failures of a remote before it's skipped, zero never skips
+	after    int
+	failures int
+	// The remote that was accepted last
+	current string
+	skipped map[string]bool
+	// The skipped remotes that were offered since the last accepted one
+	offered map[string]bool
+}
+
+func newFailover(after int) failover {
+	return failover{after: after, skipped: map[string]bool{}, offered: map[string]bool{}}
+}
+
+func remoteKey(host string, port uint, proto string) string {
+	return net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10)) + "/" + proto
+}
+
+// offer reports whether a remote should be accepted
+func (f *failover) offer(remote string) bool {
+	if f.skipped[remote] && !f.offered[remote] {
+		f.offered[remote] = true
+		return false
+	}
+	if f.offered[remote] {
+		// Every remote was skipped, start over
+		log.Println("All remotes failed, trying them again")
+		f.skipped = map[string]bool{}
+	}
+	f.offered = map[string]bool{}
+	f.current = remote
+	return true
+}
+
+// failed records a failure of the current remote.
+// true is returned if the next remote will be used
+func (f *failover) failed() bool {
+	f.failures++
+	if f.after == 0 || f.failures < f.after || f.current == "" {
+		return false
+	}
+	f.skipped[f.current] = true
+	f.failures = 0
+	return true
+}
+
+func (f *failover) connected() {
+	f.failures = 0
+}
+
+// scheduleReconnect restarts openvpn after the delay of the reconnect policy.
+// false is returned if there are no attempts left
+func (d *Daemon) scheduleReconnect(reason string) bool {
+	o := &d.openvpn
+	if o.attempt >= o.policy.MaxAttempts {
+		return false
+	}
+	o.attempt++
+	if o.failover.failed() {
+		log.Printf("Moving on from %s after %d failures\n", o.failover.current, o.policy.FailoverAfter)
+	}
+	delay := o.policy.Delay(o.attempt, rand.Float64())
+
+	// openvpn may die again while reconnecting
+	if o.getState() != Reconnecting && !d.setState(Reconnecting, reason, "") {
+		return false
+	}
+	d.broadcastMessage(messages.ReconnectMsg(o.attempt, o.policy.MaxAttempts, delay, reason))
+	log.Printf("Reconnecting in %v (attempt %d/%d)\n", delay, o.attempt, o.policy.MaxAttempts)
+
+	wake := o.wake
+	go func() {
+		select {
+		case <-time.After(delay):
+		case <-wake:
+		}
+		d.mtx.Lock()
+		defer d.mtx.Unlock()
+		switch d.openvpn.getState() {
+		case Reconnecting:
+			// The new process counts from zero
+			d.openvpn.newSession()
+			go d.startOpenVPN()
+		case Disconnecting:
+			// DISCONNECT while waiting
+			d.resetOpenvpn()
+			d.setState(Idle, "reconnecting canceled", "")
+			d.broadcastMessage(messages.SimpleMsg(consts.MsgDisconnected))
+		}
+	}()
+	return true
+}
+
+// wakeReconnect skips the delay of a scheduled reconnect
+func (d *Daemon) wakeReconnect() {
+	select {
+	case d.openvpn.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,59 @@
+package daemon
+
+import (
+	"testing"
+)
+
+func TestFailover(t *testing.T) {
+	f := newFailover(2)
+	a, b := remoteKey("a.example.com", 1194, "udp"), remoteKey("b.example.com", 443, "tcp-client")
+
+	if !f.offer(a) {
+		t.Fatal("the first remote should be accepted")
+	}
+	if f.failed() {
+		t.Error("the remote was skipped after one failure")
+	}
+	if !f.failed() {
+		t.Error("the remote should be skipped after two failures")
+	}
+	if f.offer(a) || !f.offer(b) {
+		t.Error("the failed remote should be skipped for the next one")
+	}
+
+	// b fails too, both are tried again
+	f.failed()
+	f.failed()
+	if f.offer(a) || f.offer(b) {
+		t.Error("both remotes should be skipped once")
+	}
+	if !f.offer(a) {
+		t.Error("after every remote is skipped they should be tried again")
+	}
+
+	f = newFailover(0)
+	f.offer(a)
+	for i := 0; i < 10; i++ {
+		if f.failed() {
+			t.Fatal("remotes are never skipped without a failover setting")
+		}
+	}
+}
+
+func TestByteCountAfterReconnect(t *testing.T) {
+	o := &Openvpn{}
+	o.addByteCount(100, 50)
+	o.addByteCount(150, 70)
+	// The new process counts from zero
+	o.newSession()
+	o.addByteCount(10, 5)
+	if o.totalIn != 160 || o.totalOut != 75 || o.bytesIn != 10 || o.bytesOut != 5 {
+		t.Errorf("got %d/%d of %d/%d, want 10/5 of 160/75", o.bytesIn, o.bytesOut, o.totalIn, o.totalOut)
+	}
+
+	// openvpn restarted itself, the counters went back without a new process
+	o.addByteCount(4, 2)
+	if o.totalIn != 164 || o.totalOut != 77 {
+		t.Errorf("got totals %d/%d, want 164/77", o.totalIn, o.totalOut)
+	}
+}
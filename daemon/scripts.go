@@ -0,0 +1,368 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/TheWeirdDev/Vodga/shared/ovpn"
+	"github.com/TheWeirdDev/Vodga/shared/utils"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ScriptPolicy decides what happens to configs that can run code as root
+type ScriptPolicy int
+
+const (
+	// PolicyReject refuses to start configs with privileged directives
+	PolicyReject ScriptPolicy = iota
+	// PolicyStrip removes privileged directives before starting openvpn
+	PolicyStrip
+)
+
+// ParseScriptPolicy converts a command line value into a policy
+func ParseScriptPolicy(s string) (ScriptPolicy, error) {
+	switch s {
+	case "reject":
+		return PolicyReject, nil
+	case "strip":
+		return PolicyStrip, nil
+	default:
+		return PolicyReject, fmt.Errorf("unknown script policy \"%s\"", s)
+	}
+}
+
+// Directives that make openvpn run programs, load code or write files as root.
+// They are only allowed in configs that are installed by root
+var privilegedDirectives = map[string]string{
+	"up":                    "runs a script",
+	"down":                  "runs a script",
+	"route-up":              "runs a script",
+	"route-pre-down":        "runs a script",
+	"ipchange":              "runs a script",
+	"learn-address":         "runs a script",
+	"tls-verify":            "runs a script",
+	"client-connect":        "runs a script",
+	"client-disconnect":     "runs a script",
+	"auth-user-pass-verify": "runs a script",
+	"iproute":               "runs a program",
+	"script-security":       "allows running scripts",
+	"plugin":                "loads a plugin",
+	"config":                "includes another config",
+	"cd":                    "changes the working directory",
+	"chroot":                "changes the root directory",
+	"log":                   "writes files",
+	"log-append":            "writes files",
+	"status":                "writes files",
+	"writepid":              "writes files",
+	"replay-persist":        "writes files",
+	"tmp-dir":               "writes files",
+	"tls-export-cert":       "writes files",
+	"ifconfig-pool-persist": "writes files",
+	"capath":                "reads files",
+	"client-config-dir":     "reads files",
+	"tls-crypt-v2-verify":   "runs a script",
+	"providers":             "loads a library",
+	"engine":                "loads a library",
+	"management":            "conflicts with the daemon",
+	"daemon":                "conflicts with the daemon",
+}
+
+// readsFile returns why a directive reads a file that the config can't have inline.
+// The files of inline blocks like ca are inlined by inlineFiles before the config is checked
+func readsFile(d ovpn.Directive) (string, bool) {
+	switch {
+	case ovpn.InlineTags[d.Name] && !d.Inline && len(d.Args) > 0 && !(d.Name == "dh" && d.Args[0] == "none"):
+		return "reads a file", true
+	case d.Name == "askpass" && len(d.Args) > 0:
+		return "reads a file", true
+	case (d.Name == "http-proxy" || d.Name == "socks-proxy") && len(d.Args) > 2 &&
+		d.Args[2] != "stdin" && d.Args[2] != "auto" && d.Args[2] != "auto-nct":
+		return "reads a file", true
+	}
+	return "", false
+}
+
+// ConfigError points to the line of a config that violates the policy
+type ConfigError struct {
+	Line   int
+	Text   string
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("line %d: '%s' %s as root, which is not allowed in user-supplied configs",
+		e.Line, e.Text, e.Reason)
+}
+
+// sanitizeConfig checks every directive of a config against the policy.
+// With PolicyReject the first privileged directive is returned as a *ConfigError,
+// with PolicyStrip the config is returned without them.
+// The config is read like openvpn reads it, so quoting a directive doesn't hide it
+func sanitizeConfig(r io.Reader, policy ScriptPolicy) ([]byte, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	file, err := ovpn.Parse(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		return nil, err
+	}
+
+	// The lines of the stripped directives
+	stripped := map[int]bool{}
+	var check func(directives []ovpn.Directive) error
+	check = func(directives []ovpn.Directive) error {
+		for _, d := range directives {
+			reason, ok := privilegedDirectives[d.Name]
+			if !ok && d.Name == "pkcs11-providers" && !providersInstalledByRoot(d.Args) {
+				reason, ok = "loads a library that isn't installed by root", true
+			}
+			if !ok {
+				reason, ok = readsFile(d)
+			}
+			if !ok {
+				if err := check(d.Children); err != nil {
+					return err
+				}
+				continue
+			}
+			if policy == PolicyReject {
+				return &ConfigError{Line: d.Line, Text: strings.TrimSpace(lines[d.Line-1]), Reason: reason}
+			}
+			for line := d.Line; line <= d.EndLine; line++ {
+				stripped[line] = true
+			}
+		}
+		return nil
+	}
+	if err := check(file.Directives); err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	for i, line := range lines {
+		if !stripped[i+1] {
+			out.WriteString(line + "\n")
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// appendDirectives adds directives that the daemon made from the arguments of a client to a launch config.
+// They are checked again, the config may be trusted and started without --script-security 1
+func appendDirectives(data []byte, directives ...ovpn.Directive) ([]byte, error) {
+	var extra strings.Builder
+	for _, d := range directives {
+		extra.WriteString(d.String() + "\n")
+	}
+	if _, err := sanitizeConfig(strings.NewReader(extra.String()), PolicyReject); err != nil {
+		return nil, err
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+	data = append(data, extra.String()...)
+	// A directive can't end up in an inline block or change the others
+	file, err := ovpn.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if !sameDirectives(file.Directives, directives) {
+		return nil, errors.New("the added options are not read as they were written")
+	}
+	return data, nil
+}
+
+// sameDirectives tells if a config ends with the directives
+func sameDirectives(config, want []ovpn.Directive) bool {
+	if len(config) < len(want) {
+		return false
+	}
+	got := config[len(config)-len(want):]
+	for i := range want {
+		if got[i].Name != want[i].Name || strings.Join(got[i].Args, "\x00") != strings.Join(want[i].Args, "\x00") {
+			return false
+		}
+	}
+	return true
+}
+
+// isInstalledByRoot checks if only root could have written the file, or replaced it or one of its directories
+func isInstalledByRoot(path string) bool {
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	for p := path; ; p = filepath.Dir(p) {
+		stat, err := os.Stat(p)
+		if err != nil {
+			return false
+		}
+		sys, ok := stat.Sys().(*syscall.Stat_t)
+		if !ok || sys.Uid != 0 || stat.Mode().Perm()&0022 != 0 {
+			return false
+		}
+		if p == filepath.Dir(p) {
+			return true
+		}
+	}
+}
+
+// providersInstalledByRoot checks the libraries of a pkcs11-providers option, openvpn loads them as root.
+// Names without a path are found in the library directories of the system
+func providersInstalledByRoot(providers []string) bool {
+	for _, provider := range providers {
+		if strings.ContainsRune(provider, filepath.Separator) &&
+			(!filepath.IsAbs(provider) || !isInstalledByRoot(provider)) {
+			return false
+		}
+	}
+	return true
+}
+
+// inlineFiles replaces the files of options like ca with inline blocks, read is called with their absolute paths.
+// Relative paths are in dir, openvpn runs in the directory of the config.
+// origin has the line of the config that every line of the result comes from
+func inlineFiles(data []byte, dir string, read func(path string) ([]byte, error)) (inlined []byte, origin []int,
+	err error) {
+	file, err := ovpn.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	lines := strings.Split(string(data), "\n")
+	for _, d := range file.Directives {
+		if !ovpn.InlineTags[d.Name] || d.Inline || len(d.Args) == 0 || d.Name == "connection" ||
+			(d.Name == "dh" && d.Args[0] == "none") || (d.Name == "crl-verify" && len(d.Args) > 1) {
+			continue
+		}
+		path := d.Args[0]
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		content, err := read(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", d.Line, err)
+		}
+		if d.Name == "pkcs12" {
+			// Inline PKCS#12 files are base64 encoded
+			content = []byte(base64.StdEncoding.EncodeToString(content) + "\n")
+		}
+		block := ovpn.Directive{Name: d.Name, Inline: true, Content: string(content)}
+		// A file can't close the block and add options after it
+		for _, line := range strings.Split(block.Content, "\n") {
+			if strings.HasPrefix(strings.TrimLeft(line, " \t"), "</"+d.Name+">") {
+				return nil, nil, fmt.Errorf("line %d: %s closes the <%s> block", d.Line, path, d.Name)
+			}
+		}
+		lines[d.Line-1] = block.String()
+		// The key direction is lost when the key is inlined, keep it as an option
+		if (d.Name == "tls-auth" || d.Name == "secret") && len(d.Args) >= 2 {
+			lines[d.Line-1] += "\nkey-direction " + utils.OpenvpnEscape(d.Args[1])
+		}
+	}
+	for i, line := range lines {
+		for range strings.Split(line, "\n") {
+			origin = append(origin, i+1)
+		}
+	}
+	return []byte(strings.Join(lines, "\n")), origin, nil
+}
+
+// readAsUser reads a file with the permissions of a user, so configs can't make root read the files of others
+func readAsUser(path string, uid, gid uint32) ([]byte, error) {
+	usr, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return nil, err
+	}
+	ids, err := usr.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	groups := []uint32{}
+	for _, id := range ids {
+		if n, err := strconv.ParseUint(id, 10, 32); err == nil {
+			groups = append(groups, uint32(n))
+		}
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("cat", "--", path)
+	cmd.Stderr = &stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uid, Gid: gid, Groups: groups}}
+	data, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s: %s", path, strings.TrimSpace(stderr.String()))
+	}
+	return data, nil
+}
+
+// prepareConfig applies the script policy to a config and returns the path that openvpn should use.
+// Configs that aren't installed by root are read as the user of the client with the files they name,
+// and copied to a private file after they are checked, so they can't be changed before openvpn starts.
+// trusted is true if the config is used as it is
+func prepareConfig(path string, policy ScriptPolicy, p *peer) (launchPath string, trusted bool, err error) {
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return "", false, err
+	}
+	if isInstalledByRoot(path) {
+		return path, true, nil
+	}
+
+	read := func(path string) ([]byte, error) {
+		return readAsUser(path, p.uid, p.gid)
+	}
+	data, err := read(path)
+	if err != nil {
+		return "", false, err
+	}
+	if data, err = sanitizeUserConfig(data, filepath.Dir(path), read, policy); err != nil {
+		return "", false, err
+	}
+	launchPath, err = writeLaunchCopy(data)
+	return launchPath, false, err
+}
+
+// sanitizeUserConfig inlines the files of a config and checks it against the policy.
+// Errors point to the lines of the config as the user wrote it
+func sanitizeUserConfig(data []byte, dir string, read func(path string) ([]byte, error),
+	policy ScriptPolicy) ([]byte, error) {
+	inlined, origin, err := inlineFiles(data, dir, read)
+	if err != nil {
+		return nil, err
+	}
+	out, err := sanitizeConfig(bytes.NewReader(inlined), policy)
+	if cfgErr, ok := err.(*ConfigError); ok {
+		lines := strings.Split(string(data), "\n")
+		cfgErr.Line = origin[cfgErr.Line-1]
+		cfgErr.Text = strings.TrimSpace(lines[cfgErr.Line-1])
+	}
+	return out, err
+}
+
+// writeLaunchCopy writes a config to a private file that only root can change
+func writeLaunchCopy(data []byte) (string, error) {
+	tmp, err := ioutil.TempFile("", "vodgad-*.ovpn")
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+	if _, err := tmp.Write(data); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
@@ -0,0 +1,201 @@
+package daemon
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const scriptConfig = `client
+remote vpn.example.com 1194 udp
+<ca>
+up this is not a directive
+</ca>
+# up /tmp/commented.sh
+  --up /tmp/evil.sh
+dev tun
+`
+
+func TestSanitizeConfigReject(t *testing.T) {
+	_, err := sanitizeConfig(strings.NewReader(scriptConfig), PolicyReject)
+	cfgErr, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("expected a config error, got %v", err)
+	}
+	if cfgErr.Line != 7 || cfgErr.Text != "--up /tmp/evil.sh" {
+		t.Errorf("wrong offending line: %d '%s'", cfgErr.Line, cfgErr.Text)
+	}
+	if !strings.HasPrefix(cfgErr.Error(), "line 7: '--up /tmp/evil.sh'") {
+		t.Errorf("error doesn't name the line: %v", cfgErr)
+	}
+}
+
+func TestSanitizeConfigStrip(t *testing.T) {
+	data, err := sanitizeConfig(strings.NewReader(scriptConfig), PolicyStrip)
+	if err != nil {
+		t.Fatalf("strip failed: %v", err)
+	}
+	out := string(data)
+	if strings.Contains(out, "evil.sh") {
+		t.Errorf("script directive was not stripped")
+	}
+	if !strings.Contains(out, "up this is not a directive") || !strings.Contains(out, "dev tun") {
+		t.Errorf("stripped too much:\n%s", out)
+	}
+}
+
+func TestSanitizeConfigConnectionBlock(t *testing.T) {
+	cfg := "client\n<connection>\nremote 1.2.3.4\nplugin /tmp/evil.so\n</connection>\n"
+	_, err := sanitizeConfig(strings.NewReader(cfg), PolicyReject)
+	if cfgErr, ok := err.(*ConfigError); !ok || cfgErr.Line != 4 {
+		t.Errorf("directives in <connection> blocks should be checked, got %v", err)
+	}
+}
+
+func TestSanitizeConfigProviders(t *testing.T) {
+	cfg := "client\npkcs11-providers opensc-pkcs11.so /bin/sh\npkcs11-providers /tmp/evil.so\n"
+	_, err := sanitizeConfig(strings.NewReader(cfg), PolicyReject)
+	if cfgErr, ok := err.(*ConfigError); !ok || cfgErr.Line != 3 {
+		t.Errorf("providers that root didn't install should be rejected, got %v", err)
+	}
+}
+
+func TestSanitizeConfigQuoted(t *testing.T) {
+	// openvpn ends the block at "</ca> x" and reads the quoted "up" as a directive
+	cfg := "client\n<ca>\nCA\n</ca> x\n\"up\" /tmp/evil.sh\n"
+	_, err := sanitizeConfig(strings.NewReader(cfg), PolicyReject)
+	if cfgErr, ok := err.(*ConfigError); !ok || cfgErr.Line != 5 {
+		t.Errorf("quoted directives should be checked, got %v", err)
+	}
+}
+
+func TestSanitizeConfigFiles(t *testing.T) {
+	for _, cfg := range []string{
+		"client\nca /etc/shadow\n",
+		"client\naskpass /root/pass.txt\n",
+		"client\nhttp-proxy proxy.example.com 3128 /root/creds.txt\n",
+		"client\ncrl-verify /root/crls dir\n",
+		"client\nproviders /tmp/evil\n",
+		"client\nengine dynamic\n",
+	} {
+		if _, err := sanitizeConfig(strings.NewReader(cfg), PolicyReject); err == nil {
+			t.Errorf("%q was accepted", cfg)
+		}
+	}
+	for _, cfg := range []string{
+		"client\naskpass\nauth-user-pass\ndh none\n",
+		"client\nhttp-proxy proxy.example.com 3128 auto\nsocks-proxy 10.0.0.1 1080 stdin\n",
+	} {
+		if _, err := sanitizeConfig(strings.NewReader(cfg), PolicyReject); err != nil {
+			t.Errorf("%q was rejected: %v", cfg, err)
+		}
+	}
+}
+
+func TestInlineFiles(t *testing.T) {
+	files := map[string]string{
+		"/etc/vpn/ca.crt":  "CA\n",
+		"/etc/vpn/ta.key":  "TA\n",
+		"/home/alice/p12":  "\x00\x01",
+		"/etc/vpn/up.pass": "user\npass\n",
+		"/etc/vpn/bad.crt": "CA\n</ca>\nup /tmp/evil.sh\n",
+	}
+	read := func(path string) ([]byte, error) {
+		if data, ok := files[path]; ok {
+			return []byte(data), nil
+		}
+		return nil, errors.New("can't read " + path)
+	}
+	cfg := "client\nca ca.crt\ntls-auth /etc/vpn/ta.key 1\npkcs12 /home/alice/p12\nauth-user-pass up.pass\n" +
+		"dh none\n<cert>\nCERT\n</cert>\n"
+	got, origin, err := inlineFiles([]byte(cfg), "/etc/vpn", read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "client\n<ca>\nCA\n</ca>\n<tls-auth>\nTA\n</tls-auth>\nkey-direction 1\n<pkcs12>\n" +
+		base64.StdEncoding.EncodeToString([]byte("\x00\x01")) + "\n</pkcs12>\n" +
+		"<auth-user-pass>\nuser\npass\n</auth-user-pass>\ndh none\n<cert>\nCERT\n</cert>\n"
+	if string(got) != want {
+		t.Errorf("inlineFiles() = %q, want %q", got, want)
+	}
+	wantOrigin := []int{1, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 5, 5, 5, 5, 6, 7, 8, 9, 10}
+	if fmt.Sprint(origin) != fmt.Sprint(wantOrigin) {
+		t.Errorf("origin = %v, want %v", origin, wantOrigin)
+	}
+
+	for _, cfg := range []string{"client\nca /etc/shadow\n", "client\nca bad.crt\n"} {
+		if _, _, err := inlineFiles([]byte(cfg), "/etc/vpn", read); err == nil {
+			t.Errorf("%q was inlined", cfg)
+		}
+	}
+}
+
+func TestSanitizeUserConfig(t *testing.T) {
+	read := func(path string) ([]byte, error) {
+		return []byte("CA\nCA\n"), nil
+	}
+	cfg := "client\nca ca.crt\n  up  /tmp/evil.sh\n"
+	_, err := sanitizeUserConfig([]byte(cfg), "/etc/vpn", read, PolicyReject)
+	if cfgErr, ok := err.(*ConfigError); !ok || cfgErr.Line != 3 || cfgErr.Text != "up  /tmp/evil.sh" {
+		t.Errorf("got %v, want the error of line 3", err)
+	}
+}
+
+func TestIsInstalledByRoot(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("the files must be owned by root")
+	}
+	dir, err := ioutil.TempDir("", "vodga-scripts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The temporary directory is in /tmp, everyone can replace what's in it
+	nested := filepath.Join(dir, "a", "b")
+	if err := os.MkdirAll(nested, 0755); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(nested, "vpn.ovpn")
+	if err := ioutil.WriteFile(config, []byte("client\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := os.Stat(os.TempDir()); err == nil && stat.Mode().Perm()&0022 != 0 && isInstalledByRoot(config) {
+		t.Error("a config under a writable directory is trusted")
+	}
+	if err := os.Chown(filepath.Join(dir, "a"), 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+	if isInstalledByRoot(config) {
+		t.Error("a config in a directory of another user is trusted")
+	}
+	if !isInstalledByRoot("/") {
+		t.Error("/ isn't trusted")
+	}
+}
+
+func TestReadAsUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("only root can read files as another user")
+	}
+	f, err := ioutil.TempFile("", "vodga-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("secret\n")
+	f.Close()
+	if err := os.Chmod(f.Name(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readAsUser(f.Name(), 0, 0); err != nil || string(data) != "secret\n" {
+		t.Errorf("readAsUser() = %q, %v", data, err)
+	}
+	if _, err := readAsUser(f.Name(), 65534, 65534); err == nil {
+		t.Error("nobody read a file of root")
+	}
+}
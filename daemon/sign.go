@@ -0,0 +1,73 @@
+package daemon
+
+import (
+	"errors"
+	"github.com/TheWeirdDev/Vodga/daemon/mgmt"
+	"github.com/TheWeirdDev/Vodga/shared/consts"
+	"github.com/TheWeirdDev/Vodga/shared/messages"
+	"github.com/TheWeirdDev/Vodga/shared/ovpn"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// stripKey removes the private key of a config, openvpn doesn't accept it with --management-external-key
+func stripKey(data []byte) ([]byte, error) {
+	return ovpn.Rewrite(data, func(d ovpn.Directive) ([]string, bool) {
+		return nil, d.Name != "key"
+	})
+}
+
+// prepareExternalKey makes openvpn ask the client for the signatures when the profile has an external key
+func (d *Daemon) prepareExternalKey(args map[string]string) error {
+	if args["external_key"] != "true" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(d.openvpn.launchConfig)
+	if err != nil {
+		return err
+	}
+	data, err = stripKey(data)
+	if err != nil {
+		return err
+	}
+	launchConfig, err := writeLaunchCopy(data)
+	if err != nil {
+		return err
+	}
+	if d.openvpn.launchCopy {
+		os.Remove(d.openvpn.launchConfig)
+	}
+	d.openvpn.launchConfig = launchConfig
+	d.openvpn.launchCopy = true
+	d.openvpn.externalKey = true
+	return nil
+}
+
+// externalKeyArgs returns the options of openvpn for an external key, PSS is needed by TLS 1.3
+func (d *Daemon) externalKeyArgs() []string {
+	if !d.openvpn.externalKey {
+		return nil
+	}
+	return []string{"--management-external-key", "pkcs1", "pss"}
+}
+
+// signature returns the base64 signature of a PK_SIGN request, it blocks until the client answers
+func (d *Daemon) signature(ev mgmt.PkSignEvent) (string, error) {
+	responses, err := d.askClient(messages.SignRequestMsg(ev.Data, ev.Algorithm), consts.MsgSignResponse)
+	if err != nil {
+		return "", err
+	}
+	log.Println("Waiting for the client to sign the data of openvpn")
+	resp, ok := <-responses
+	if !ok {
+		return "", errPasswordCanceled
+	}
+	if errText := resp.Args["error"]; errText != "" {
+		return "", errors.New("the client can't sign: " + errText)
+	}
+	if resp.Args["signature"] == "" {
+		return "", errors.New("the client sent an empty signature")
+	}
+	return resp.Args["signature"], nil
+}
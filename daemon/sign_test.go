@@ -0,0 +1,102 @@
+package daemon
+
+import (
+	"github.com/TheWeirdDev/Vodga/daemon/mgmt"
+	"github.com/TheWeirdDev/Vodga/shared/consts"
+	"github.com/TheWeirdDev/Vodga/shared/messages"
+	"testing"
+	"time"
+)
+
+func TestStripKey(t *testing.T) {
+	config := "client\nkey client.key\n<ca>\nCA\n</ca>\n<key>\nKEY\n</key>\ncert client.crt\n"
+	want := "client\n<ca>\nCA\n</ca>\ncert client.crt\n"
+	if got, err := stripKey([]byte(config)); err != nil || string(got) != want {
+		t.Errorf("stripKey() = %q, %v, want %q", got, err, want)
+	}
+}
+
+func TestSignature(t *testing.T) {
+	d, scanner, done := testPasswordDaemon(t)
+	defer done()
+	server := d.passwords.client
+
+	type result struct {
+		signature string
+		err       error
+	}
+	results := make(chan result, 2)
+	sign := func() {
+		signature, err := d.signature(mgmt.PkSignEvent{Data: "ZGF0YQ==", Algorithm: "RSA_PKCS1_PADDING"})
+		results <- result{signature, err}
+	}
+	request := func() *messages.Message {
+		if !scanner.Scan() {
+			t.Fatalf("no request: %v", scanner.Err())
+		}
+		msg, err := messages.UnmarshalMsg(scanner.Text())
+		if err != nil || msg.Command != consts.MsgSignRequest {
+			t.Fatalf("wrong message %q, %v", scanner.Text(), err)
+		}
+		return msg
+	}
+
+	go sign()
+	if req := request(); req.Args["data"] != "ZGF0YQ==" || req.Args["algorithm"] != "RSA_PKCS1_PADDING" {
+		t.Errorf("wrong request: %+v", req.Args)
+	}
+	d.answerClient(messages.SignResponseMsg("c2ln", ""), server)
+	if r := <-results; r.err != nil || r.signature != "c2ln" {
+		t.Errorf("got %+v", r)
+	}
+
+	// The error of the client fails the request
+	go sign()
+	request()
+	d.answerClient(messages.SignResponseMsg("", "the token is missing"), server)
+	if r := <-results; r.err == nil {
+		t.Error("the error of the client was ignored")
+	}
+
+	// Disconnecting cancels the request
+	go sign()
+	request()
+	d.cancelPasswords()
+	if r := <-results; r.err != errPasswordCanceled {
+		t.Errorf("got %+v, want errPasswordCanceled", r)
+	}
+}
+
+func TestPkSigAfterExit(t *testing.T) {
+	d, scanner, done := testPasswordDaemon(t)
+	defer done()
+	m := &recordingMgmt{calls: make(chan string, 1)}
+	ev := mgmt.PkSignEvent{Data: "ZGF0YQ==", Algorithm: "RSA_PKCS1_PADDING"}
+
+	// The signature goes to the connection that asked for it
+	d.openvpn.mgmt = m
+	d.processMgmtEvent(ev)
+	if !scanner.Scan() {
+		t.Fatal(scanner.Err())
+	}
+	d.openvpn.mgmt = nil
+	d.answerClient(messages.SignResponseMsg("c2ln", ""), d.passwords.client)
+	if call := <-m.calls; call != "pk-sig c2ln" {
+		t.Errorf("got %q", call)
+	}
+
+	// The signature of an exited process is dropped
+	d.openvpn.mgmt = m
+	d.processMgmtEvent(ev)
+	if !scanner.Scan() {
+		t.Fatal(scanner.Err())
+	}
+	d.openvpn.mgmt = nil
+	d.cancelRequests()
+	d.answerClient(messages.SignResponseMsg("c2ln", ""), d.passwords.client)
+	select {
+	case call := <-m.calls:
+		t.Errorf("openvpn got %q", call)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,230 @@
+package daemon
+
+import (
+	"fmt"
+	"github.com/TheWeirdDev/Vodga/shared/profiles"
+	"log"
+	"net"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the domains of the rules are resolved again
+const splitResolveInterval = 5 * time.Minute
+
+// splitState routes the destinations of the split tunneling rules of a profile.
+// With SplitOnly openvpn ignores the pushed routes and the daemon routes the
+// destinations through the tunnel. With SplitExcept the pushed routes are used and
+// the destinations are routed through the default gateway of the physical network
+type splitState struct {
+	mtx     sync.Mutex
+	mode    profiles.SplitMode
+	cidrs   []*net.IPNet
+	domains []string
+	// The destinations that the daemon routed
+	routes []string
+	stop   chan struct{}
+}
+
+// enabled reports whether the profile has split tunneling rules
+func (s *splitState) enabled() bool {
+	return s.mode != ""
+}
+
+// splitDestinations returns the destinations that need a route, sorted and without duplicates.
+// The DNS servers go through the tunnel in SplitOnly mode, otherwise queries would leak
+func splitDestinations(mode profiles.SplitMode, cidrs []*net.IPNet, resolved []net.IP,
+	dnsServers []string) []string {
+	seen := make(map[string]bool)
+	add := func(cidr *net.IPNet) {
+		// IPv6 can't go through the IPv4 gateway
+		if mode == profiles.SplitExcept && cidr.IP.To4() == nil {
+			return
+		}
+		seen[cidr.String()] = true
+	}
+	for _, cidr := range cidrs {
+		add(cidr)
+	}
+	for _, ip := range resolved {
+		if cidr, ok := profiles.SplitRuleCIDR(ip.String()); ok {
+			add(cidr)
+		}
+	}
+	if mode == profiles.SplitOnly {
+		for _, server := range dnsServers {
+			if cidr, ok := profiles.SplitRuleCIDR(server); ok {
+				add(cidr)
+			}
+		}
+	}
+	dests := make([]string, 0, len(seen))
+	for dest := range seen {
+		dests = append(dests, dest)
+	}
+	sort.Strings(dests)
+	return dests
+}
+
+// routeArgs returns the arguments of "ip route replace" for a destination
+func routeArgs(mode profiles.SplitMode, dest, dev string, gw route) []string {
+	args := []string{"route", "replace", dest}
+	if mode == profiles.SplitOnly {
+		return append(args, "dev", dev)
+	}
+	if gw.gateway != "" {
+		args = append(args, "via", gw.gateway)
+	}
+	return append(args, "dev", gw.iface)
+}
+
+func ipCommand(args ...string) error {
+	if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("ip %s failed: %v: %s", strings.Join(args, " "), err,
+			strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// prepareSplit reads the split tunneling rules of a profile
+func (d *Daemon) prepareSplit(args map[string]string) error {
+	d.split.mtx.Lock()
+	defer d.split.mtx.Unlock()
+	if args["split_mode"] == "" {
+		return nil
+	}
+	split := profiles.SplitTunnel{Mode: profiles.SplitMode(args["split_mode"])}
+	if args["split_rules"] != "" {
+		split.Rules = strings.Split(args["split_rules"], ",")
+	}
+	if err := split.Check(); err != nil {
+		return err
+	}
+	for _, rule := range split.Rules {
+		if cidr, ok := profiles.SplitRuleCIDR(rule); ok {
+			d.split.cidrs = append(d.split.cidrs, cidr)
+		} else {
+			d.split.domains = append(d.split.domains, rule)
+		}
+	}
+	d.split.mode = split.Mode
+	d.split.stop = make(chan struct{})
+	if len(d.split.domains) > 0 {
+		go d.refreshSplit(d.split.stop)
+	}
+	return nil
+}
+
+// splitArgs returns the openvpn options that split tunneling needs
+func (d *Daemon) splitArgs() []string {
+	d.split.mtx.Lock()
+	defer d.split.mtx.Unlock()
+	if d.split.mode == profiles.SplitOnly {
+		// The daemon adds the routes, the pushed ones would send everything through the tunnel
+		return []string{"--route-nopull"}
+	}
+	return nil
+}
+
+// applySplit routes the destinations of the rules, it's called when the tunnel is up
+// and when the domains are resolved again
+func (d *Daemon) applySplit() {
+	d.split.mtx.Lock()
+	defer d.split.mtx.Unlock()
+	if !d.split.enabled() || d.openvpn.getState() != Connected {
+		return
+	}
+	d.dns.mtx.Lock()
+	dev, servers := d.dns.dev, d.dns.servers()
+	d.dns.mtx.Unlock()
+	if dev == "" {
+		log.Println("Split tunneling: the device of the tunnel is unknown")
+		return
+	}
+	var gw route
+	if d.split.mode == profiles.SplitExcept {
+		var err error
+		if gw, err = readDefaultRoute(); err != nil || gw.iface == "" {
+			log.Printf("Split tunneling: no default route to exclude the destinations: %v\n", err)
+			return
+		}
+	}
+
+	var resolved []net.IP
+	for _, domain := range d.split.domains {
+		ips, err := net.LookupIP(domain)
+		if err != nil {
+			log.Printf("Split tunneling: can't resolve %s: %v\n", domain, err)
+			continue
+		}
+		resolved = append(resolved, ips...)
+	}
+	dests := splitDestinations(d.split.mode, d.split.cidrs, resolved, servers)
+
+	wanted := make(map[string]bool)
+	var routes []string
+	for _, dest := range dests {
+		wanted[dest] = true
+		if err := ipCommand(routeArgs(d.split.mode, dest, dev, gw)...); err != nil {
+			log.Printf("Split tunneling: %v\n", err)
+			continue
+		}
+		routes = append(routes, dest)
+	}
+	// Addresses that the domains don't resolve to anymore
+	for _, dest := range d.split.routes {
+		if !wanted[dest] {
+			_ = ipCommand("route", "del", dest)
+		}
+	}
+	d.split.routes = routes
+	log.Printf("Split tunneling (%s): %d routes\n", d.split.mode, len(routes))
+}
+
+// refreshSplit resolves the domains of the rules again until stop is closed
+func (d *Daemon) refreshSplit(stop chan struct{}) {
+	tick := time.NewTicker(splitResolveInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-d.quit:
+			return
+		case <-tick.C:
+			d.applySplit()
+		}
+	}
+}
+
+// removeSplitRoutes deletes the routes of the daemon.
+// Routes through the tunnel are gone with the device, but the routes of SplitExcept stay
+func (d *Daemon) removeSplitRoutes() {
+	d.split.mtx.Lock()
+	defer d.split.mtx.Unlock()
+	for _, dest := range d.split.routes {
+		if d.split.mode == profiles.SplitExcept {
+			if err := ipCommand("route", "del", dest); err != nil {
+				log.Printf("Split tunneling: %v\n", err)
+			}
+		}
+	}
+	d.split.routes = nil
+}
+
+// stopSplit forgets the rules of the profile
+func (d *Daemon) stopSplit() {
+	d.removeSplitRoutes()
+	d.split.mtx.Lock()
+	defer d.split.mtx.Unlock()
+	if d.split.stop != nil {
+		close(d.split.stop)
+		d.split.stop = nil
+	}
+	d.split.mode = ""
+	d.split.cidrs = nil
+	d.split.domains = nil
+}
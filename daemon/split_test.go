@@ -0,0 +1,51 @@
+package daemon
+
+import (
+	"github.com/TheWeirdDev/Vodga/shared/profiles"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestSplitDestinations(t *testing.T) {
+	var cidrs []*net.IPNet
+	for _, rule := range []string{"10.1.0.0/16", "2001:db8::/32", "10.1.0.0/16"} {
+		cidr, ok := profiles.SplitRuleCIDR(rule)
+		if !ok {
+			t.Fatalf("%s is not a range", rule)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	resolved := []net.IP{net.ParseIP("93.184.216.34"), net.ParseIP("2606:2800:220:1::")}
+	dns := []string{"1.1.1.1"}
+
+	only := splitDestinations(profiles.SplitOnly, cidrs, resolved, dns)
+	want := []string{"1.1.1.1/32", "10.1.0.0/16", "2001:db8::/32", "2606:2800:220:1::/128", "93.184.216.34/32"}
+	if !reflect.DeepEqual(only, want) {
+		t.Errorf("only: got %v, want %v", only, want)
+	}
+
+	except := splitDestinations(profiles.SplitExcept, cidrs, resolved, dns)
+	want = []string{"10.1.0.0/16", "93.184.216.34/32"}
+	if !reflect.DeepEqual(except, want) {
+		t.Errorf("except: got %v, want %v", except, want)
+	}
+}
+
+func TestRouteArgs(t *testing.T) {
+	gw := route{iface: "wlan0", gateway: "192.168.1.1"}
+	tests := []struct {
+		mode profiles.SplitMode
+		gw   route
+		want []string
+	}{
+		{profiles.SplitOnly, gw, []string{"route", "replace", "10.1.0.0/16", "dev", "tun0"}},
+		{profiles.SplitExcept, gw, []string{"route", "replace", "10.1.0.0/16", "via", "192.168.1.1", "dev", "wlan0"}},
+		{profiles.SplitExcept, route{iface: "ppp0"}, []string{"route", "replace", "10.1.0.0/16", "dev", "ppp0"}},
+	}
+	for _, tt := range tests {
+		if got := routeArgs(tt.mode, "10.1.0.0/16", "tun0", tt.gw); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s via %v: got %v, want %v", tt.mode, tt.gw, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package daemon
+
+import (
+	"fmt"
+	"github.com/TheWeirdDev/Vodga/shared/consts"
+)
+
+// State is the lifecycle of the openvpn connection
+type State int
+
+const (
+	Idle State = iota
+	Starting
+	Connecting
+	Authenticating
+	Connected
+	Reconnecting
+	Disconnecting
+	Failed
+)
+
+var stateNames = map[State]string{
+	Idle:           consts.StateIdle,
+	Starting:       consts.StateStarting,
+	Connecting:     consts.StateCONNECTING,
+	Authenticating: consts.StateAuthenticating,
+	Connected:      consts.StateCONNECTED,
+	Reconnecting:   consts.StateRECONNECTING,
+	Disconnecting:  consts.StateDisconnecting,
+	Failed:         consts.StateFailed,
+}
+
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// The states that can follow each state
+var transitions = map[State][]State{
+	Idle:           {Starting},
+	Starting:       {Connecting, Authenticating, Reconnecting, Disconnecting, Failed},
+	Connecting:     {Authenticating, Connected, Reconnecting, Disconnecting, Failed},
+	Authenticating: {Connecting, Connected, Reconnecting, Disconnecting, Failed},
+	Connected:      {Reconnecting, Disconnecting, Failed},
+	Reconnecting:   {Connecting, Authenticating, Connected, Disconnecting, Failed},
+	Disconnecting:  {Idle, Failed},
+	Failed:         {Starting, Idle},
+}
+
+func (s State) canBecome(to State) bool {
+	for _, next := range transitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// isActive reports whether openvpn is (or is about to be) running
+func (s State) isActive() bool {
+	return s != Idle && s != Failed
+}
+
+// stateFromOpenvpn maps the states of the management interface to ours.
+// false is returned for states that don't change anything.
+// EXITING is one of them, the daemon knows whether it asked openvpn to exit
+// and the reconnect policy decides what happens when it didn't
+func stateFromOpenvpn(name string) (State, bool) {
+	switch name {
+	case consts.StateCONNECTING, consts.StateWAIT, "RESOLVE", "TCP_CONNECT":
+		return Connecting, true
+	case consts.StateAUTH, consts.StateGET_CONFIG, "AUTH_PENDING":
+		return Authenticating, true
+	case consts.StateCONNECTED:
+		return Connected, true
+	case consts.StateRECONNECTING:
+		return Reconnecting, true
+	default:
+		return Idle, false
+	}
+}
+
+// StateError is returned for transitions that are not allowed
+type StateError struct {
+	From State
+	To   State
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("invalid state transition from %v to %v", e.From, e.To)
+}
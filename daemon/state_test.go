@@ -0,0 +1,57 @@
+package daemon
+
+import (
+	"testing"
+)
+
+func TestStateTransitions(t *testing.T) {
+	o := Openvpn{state: Idle}
+	steps := []State{Starting, Connecting, Authenticating, Connected, Reconnecting,
+		Connected, Disconnecting, Idle}
+	for _, to := range steps {
+		if _, err := o.setState(to); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	invalid := []struct {
+		from State
+		to   State
+	}{
+		{Idle, Connected},
+		{Connecting, Starting},
+		{Connected, Idle},
+		{Disconnecting, Connected},
+		{Failed, Connecting},
+	}
+	for _, tt := range invalid {
+		o := Openvpn{state: tt.from}
+		if _, err := o.setState(tt.to); err == nil {
+			t.Errorf("%v -> %v should be rejected", tt.from, tt.to)
+		}
+		if o.getState() != tt.from {
+			t.Errorf("a rejected transition changed the state to %v", o.getState())
+		}
+	}
+}
+
+func TestStateFromOpenvpn(t *testing.T) {
+	tests := []struct {
+		name  string
+		state State
+		ok    bool
+	}{
+		{"WAIT", Connecting, true},
+		{"GET_CONFIG", Authenticating, true},
+		{"CONNECTED", Connected, true},
+		{"RECONNECTING", Reconnecting, true},
+		{"EXITING", Idle, false},
+		{"ADD_ROUTES", Idle, false},
+	}
+	for _, tt := range tests {
+		state, ok := stateFromOpenvpn(tt.name)
+		if state != tt.state || ok != tt.ok {
+			t.Errorf("%s: got %v %v, want %v %v", tt.name, state, ok, tt.state, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,468 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/TheWeirdDev/Vodga/shared/messages"
+	"github.com/TheWeirdDev/Vodga/shared/ovpn"
+	"github.com/TheWeirdDev/Vodga/shared/profiles"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How long a transport may take to accept connections
+const transportTimeout = 20 * time.Second
+
+// transportState is the sidecar that carries the connection of openvpn.
+// It's started before openvpn, stays up while openvpn reconnects and is stopped with the tunnel
+type transportState struct {
+	mtx       sync.Mutex
+	transport *profiles.Transport
+	// The addresses of the server, the sidecar connects to them
+	// so it works while the kill switch blocks DNS
+	ips  []string
+	port string
+	// The remote of the config that SSH -L forwards to
+	target string
+	// The sidecar runs as the user that connected, with its ssh config and keys
+	uid  uint32
+	gid  uint32
+	home string
+	// The state of obfs4proxy, it belongs to the user
+	dir string
+	// The endpoint that openvpn connects to, obfs4proxy chooses its own port every time
+	local string
+	cmd   *exec.Cmd
+	// Closed when the sidecar exits
+	done chan struct{}
+}
+
+// prepareTransport points the launch config at the local endpoint of the transport of the profile.
+// The sidecar is started by startOpenVPN
+func (d *Daemon) prepareTransport(args map[string]string, p *peer) error {
+	transport, err := profiles.TransportFromArgs(args)
+	if err != nil || transport == nil {
+		return err
+	}
+	if d.openvpn.upstream != nil {
+		return errors.New("a transport can't be used with an upstream proxy")
+	}
+	u, err := user.LookupId(strconv.FormatUint(uint64(p.uid), 10))
+	if err != nil {
+		return err
+	}
+	host, port, _ := net.SplitHostPort(transport.Server)
+	ips := []string{host}
+	if net.ParseIP(host) == nil {
+		if ips = resolveRemote(host, d.killSwitch); len(ips) == 0 {
+			return fmt.Errorf("can't resolve %s", host)
+		}
+	}
+
+	remotes, _, err := readRemotes(d.openvpn.launchConfig)
+	if err != nil {
+		return err
+	}
+	if len(remotes) == 0 {
+		return errors.New("config has no remotes")
+	}
+	data, err := ioutil.ReadFile(d.openvpn.launchConfig)
+	if err != nil {
+		return err
+	}
+	local, endpoint := "", ""
+	switch {
+	case transport.Type == profiles.TransportObfs4:
+		// The bridge forwards to the openvpn server
+		endpoint = net.JoinHostPort(ips[0], port)
+	case transport.Type == profiles.TransportStunnel || !transport.Dynamic:
+		if local, err = freeLocalPort(); err != nil {
+			return err
+		}
+		endpoint = local
+	}
+	data, err = transportConfig(data, endpoint, ips)
+	if err != nil {
+		return err
+	}
+	launchConfig, err := writeLaunchCopy(data)
+	if err != nil {
+		return err
+	}
+	if d.openvpn.launchCopy {
+		os.Remove(d.openvpn.launchConfig)
+	}
+	d.openvpn.launchConfig = launchConfig
+	d.openvpn.launchCopy = true
+
+	t := &d.transport
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.transport = transport
+	t.local = local
+	t.ips = ips
+	t.port = port
+	t.target = net.JoinHostPort(remoteHost(remotes[0]), strconv.FormatUint(uint64(remotes[0].Port), 10))
+	t.uid, t.gid, t.home = p.uid, p.gid, u.HomeDir
+	return nil
+}
+
+func remoteHost(rmt profiles.Remote) string {
+	if rmt.Hostname != "" {
+		return rmt.Hostname
+	}
+	return rmt.IPs[0]
+}
+
+// freeLocalPort returns a loopback address that nothing listens on
+func freeLocalPort() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	return ln.Addr().String(), nil
+}
+
+// transportConfig makes openvpn connect over TCP to the endpoint of a transport, an empty endpoint
+// keeps the remotes for SOCKS transports. The server of the transport is routed outside of the tunnel
+func transportConfig(data []byte, endpoint string, serverIPs []string) ([]byte, error) {
+	hasConnection := false
+	data, err := ovpn.Rewrite(data, func(d ovpn.Directive) ([]string, bool) {
+		switch d.Name {
+		case "connection":
+			hasConnection = true
+		case "proto", "remote-random":
+			return nil, false
+		case "remote":
+			if endpoint != "" {
+				return nil, false
+			}
+			// The protocol of the remote would override tcp-client
+			if len(d.Args) > 2 {
+				d.Args = d.Args[:2]
+			}
+			return []string{d.String()}, false
+		}
+		return nil, true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if hasConnection {
+		return nil, errors.New("transports can't be used with <connection> blocks")
+	}
+	out := bytes.NewBuffer(data)
+	if endpoint != "" {
+		host, port, _ := net.SplitHostPort(endpoint)
+		fmt.Fprintf(out, "remote %s %s\n", host, port)
+	}
+	out.WriteString("proto tcp-client\n")
+	for _, ip := range serverIPs {
+		if addr := net.ParseIP(ip); addr != nil && addr.To4() != nil {
+			fmt.Fprintf(out, "route %s 255.255.255.255 net_gateway\n", ip)
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// transportArgs makes openvpn use the SOCKS proxy of obfs4proxy and SSH -D
+func (d *Daemon) transportArgs() []string {
+	t := &d.transport
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.transport == nil || t.transport.Type == profiles.TransportStunnel {
+		return nil
+	}
+	if t.transport.Type == profiles.TransportSSH && !t.transport.Dynamic {
+		return nil
+	}
+	host, port, _ := net.SplitHostPort(t.local)
+	args := []string{"--socks-proxy", host, port}
+	if t.transport.Type == profiles.TransportObfs4 {
+		// The arguments of the bridge are given as the credentials of the proxy
+		args = append(args, "stdin")
+	}
+	return args
+}
+
+// obfs4Credentials splits the arguments of an obfs4 bridge into the SOCKS username and password,
+// obfs4proxy joins them again
+func obfs4Credentials(t *profiles.Transport) (string, string) {
+	args := fmt.Sprintf("cert=%s;iat-mode=%d", t.Cert, t.IATMode)
+	return args[:len(args)-1], args[len(args)-1:]
+}
+
+// transportCredentials answers the SOCKS Proxy request of openvpn for obfs4
+func (d *Daemon) transportCredentials(typ string) (string, string, bool) {
+	t := &d.transport
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.transport == nil || t.transport.Type != profiles.TransportObfs4 || typ != "SOCKS Proxy" {
+		return "", "", false
+	}
+	username, password := obfs4Credentials(t.transport)
+	return username, password, true
+}
+
+// transportRemotes returns the addresses of the server, the kill switch and the IPv6 block allow them
+func (d *Daemon) transportRemotes() []killSwitchRemote {
+	t := &d.transport
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.transport == nil {
+		return nil
+	}
+	host, _, _ := net.SplitHostPort(t.transport.Server)
+	if net.ParseIP(host) != nil {
+		host = ""
+	}
+	port, _ := strconv.ParseUint(t.port, 10, 16)
+	var remotes []killSwitchRemote
+	for _, ip := range t.ips {
+		remotes = append(remotes, killSwitchRemote{Host: host, IP: ip, Port: uint(port), Proto: "tcp"})
+	}
+	return remotes
+}
+
+// stunnelConfig runs stunnel in the foreground as a client of the server
+func stunnelConfig(local, server, sni string) string {
+	var b strings.Builder
+	b.WriteString("foreground = yes\n")
+	b.WriteString("pid =\n")
+	b.WriteString("[openvpn]\n")
+	b.WriteString("client = yes\n")
+	fmt.Fprintf(&b, "accept = %s\n", local)
+	fmt.Fprintf(&b, "connect = %s\n", server)
+	if sni != "" {
+		fmt.Fprintf(&b, "sni = %s\n", sni)
+	}
+	return b.String()
+}
+
+// sshArgs forwards the endpoint of openvpn through the SSH server, the host key is checked
+// against the known hosts of the user with the name of the server
+func sshArgs(t *profiles.Transport, ip, local, target string) []string {
+	host, port, _ := net.SplitHostPort(t.Server)
+	args := []string{"-N", "-o", "BatchMode=yes", "-o", "ExitOnForwardFailure=yes",
+		"-o", "ServerAliveInterval=15", "-o", "HostKeyAlias=" + host, "-p", port}
+	if t.Identity != "" {
+		args = append(args, "-i", t.Identity)
+	}
+	if t.User != "" {
+		args = append(args, "-l", t.User)
+	}
+	if t.Dynamic {
+		args = append(args, "-D", local)
+	} else {
+		args = append(args, "-L", local+":"+target)
+	}
+	return append(args, ip)
+}
+
+// parseCMethod reads the SOCKS endpoint that obfs4proxy reports with the pluggable transport protocol
+func parseCMethod(line string) (string, bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 || fields[0] != "CMETHOD" || fields[1] != "obfs4" || fields[2] != "socks5" {
+		return "", false
+	}
+	return fields[3], true
+}
+
+// command returns the command of the sidecar, the caller holds the lock
+func (t *transportState) command() (*exec.Cmd, error) {
+	if t.dir == "" {
+		dir, err := ioutil.TempDir("", "vodgad-transport-")
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chown(dir, int(t.uid), int(t.gid)); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		t.dir = dir
+	}
+	server := net.JoinHostPort(t.ips[0], t.port)
+	host, _, _ := net.SplitHostPort(t.transport.Server)
+	var cmd *exec.Cmd
+	switch t.transport.Type {
+	case profiles.TransportStunnel:
+		sni := host
+		if net.ParseIP(host) != nil {
+			sni = ""
+		}
+		// The config is read from stdin, the directory belongs to the user and root doesn't write into it
+		cmd = exec.Command("stunnel", "-fd", "0")
+		cmd.Stdin = strings.NewReader(stunnelConfig(t.local, server, sni))
+	case profiles.TransportObfs4:
+		cmd = exec.Command("obfs4proxy")
+		cmd.Env = []string{"TOR_PT_MANAGED_TRANSPORT_VER=1", "TOR_PT_CLIENT_TRANSPORTS=obfs4",
+			"TOR_PT_STATE_LOCATION=" + t.dir}
+	case profiles.TransportSSH:
+		cmd = exec.Command("ssh", sshArgs(t.transport, t.ips[0], t.local, t.target)...)
+	}
+	cmd.Env = append(cmd.Env, "HOME="+t.home, "PATH="+os.Getenv("PATH"))
+	cmd.Dir = t.home
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true,
+		Credential: &syscall.Credential{Uid: t.uid, Gid: t.gid}}
+	return cmd, nil
+}
+
+// startTransport starts the sidecar if it's not running and waits until it accepts connections
+func (d *Daemon) startTransport() error {
+	t := &d.transport
+	t.mtx.Lock()
+	if t.transport == nil || t.running() {
+		t.mtx.Unlock()
+		return nil
+	}
+	if t.transport.Type == profiles.TransportObfs4 {
+		t.local = ""
+	}
+	cmd, err := t.command()
+	if err != nil {
+		t.mtx.Unlock()
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.mtx.Unlock()
+		return err
+	}
+	cmd.Stdout = w
+	cmd.Stderr = w
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		r.Close()
+		t.mtx.Unlock()
+		return err
+	}
+	done := make(chan struct{})
+	t.cmd, t.done = cmd, done
+	local := t.local
+	name := string(t.transport.Type)
+	t.mtx.Unlock()
+	log.Printf("Started %s, pid %d\n", name, cmd.Process.Pid)
+
+	endpoints := make(chan string, 1)
+	go func() {
+		defer r.Close()
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			if endpoint, ok := parseCMethod(scanner.Text()); ok {
+				select {
+				case endpoints <- endpoint:
+				default:
+				}
+			}
+			line := "[" + name + "] " + scanner.Text()
+			d.addLog(line)
+			d.broadcastMessage(messages.LogMsg(line))
+		}
+	}()
+	go func() {
+		err := cmd.Wait()
+		log.Printf("%s exited: %v\n", name, err)
+		close(done)
+		d.transportExited(done)
+	}()
+
+	timeout := time.After(transportTimeout)
+	if local == "" {
+		select {
+		case local = <-endpoints:
+		case <-done:
+			return errors.New(name + " exited before it was ready")
+		case <-timeout:
+			d.killTransport(done)
+			return errors.New(name + " didn't report its endpoint")
+		}
+		t.mtx.Lock()
+		t.local = local
+		t.mtx.Unlock()
+	}
+	for {
+		if conn, err := net.DialTimeout("tcp", local, time.Second); err == nil {
+			conn.Close()
+			return nil
+		}
+		select {
+		case <-done:
+			return errors.New(name + " exited before it was ready")
+		case <-timeout:
+			d.killTransport(done)
+			return errors.New(name + " doesn't accept connections")
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+// running tells if the sidecar is alive, the caller holds the lock
+func (t *transportState) running() bool {
+	if t.done == nil {
+		return false
+	}
+	select {
+	case <-t.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// killTransport kills a sidecar and the processes it started
+func (d *Daemon) killTransport(done chan struct{}) {
+	t := &d.transport
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.done == done && t.running() {
+		_ = syscall.Kill(-t.cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// transportExited makes openvpn exit if the sidecar died under it,
+// starting openvpn again starts a new sidecar
+func (d *Daemon) transportExited(done chan struct{}) {
+	t := &d.transport
+	t.mtx.Lock()
+	current := t.transport != nil && t.done == done
+	t.mtx.Unlock()
+	if !current || !d.openvpn.isRunning() {
+		return
+	}
+	d.broadcastMessage(messages.ErrorMsg("The transport exited, restarting openvpn"))
+	_ = d.openvpn.closeConnection()
+}
+
+// stopTransport kills the sidecar and removes its files
+func (d *Daemon) stopTransport() {
+	t := &d.transport
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.running() {
+		_ = syscall.Kill(-t.cmd.Process.Pid, syscall.SIGKILL)
+	}
+	if t.dir != "" {
+		if err := os.RemoveAll(t.dir); err != nil {
+			log.Printf("Can't remove %s: %v\n", t.dir, err)
+		}
+	}
+	t.transport = nil
+	t.ips = nil
+	t.dir = ""
+	t.local = ""
+	t.cmd = nil
+	t.done = nil
+}
@@ -0,0 +1,130 @@
+package daemon
+
+import (
+	"github.com/TheWeirdDev/Vodga/daemon/mgmt"
+	"github.com/TheWeirdDev/Vodga/shared/profiles"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTransportConfig(t *testing.T) {
+	config := "client\nproto udp\nremote vpn.example.com 1194 udp\nremote-random\n<ca>\nremote inline\n</ca>\n"
+	got, err := transportConfig([]byte(config), "127.0.0.1:4000", []string{"10.0.0.1", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "client\n<ca>\nremote inline\n</ca>\nremote 127.0.0.1 4000\nproto tcp-client\n" +
+		"route 10.0.0.1 255.255.255.255 net_gateway\n"
+	if string(got) != want {
+		t.Errorf("transportConfig() = %q, want %q", got, want)
+	}
+
+	// SOCKS transports keep the remotes
+	got, err = transportConfig([]byte(config), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "client\nremote vpn.example.com 1194\n<ca>\nremote inline\n</ca>\nproto tcp-client\n"
+	if string(got) != want {
+		t.Errorf("transportConfig() = %q, want %q", got, want)
+	}
+
+	if _, err := transportConfig([]byte("<connection>\nremote a\n</connection>\n"), "", nil); err == nil {
+		t.Error("a <connection> block was accepted")
+	}
+}
+
+func TestTransportFromArgs(t *testing.T) {
+	transport := profiles.Transport{Type: profiles.TransportSSH, Server: "ssh.example.com:22", User: "alice",
+		Identity: "/home/alice/.ssh/id_ed25519", Dynamic: true}
+	args := map[string]string{}
+	transport.AddArgs(args)
+	got, err := profiles.TransportFromArgs(args)
+	if err != nil || got == nil || *got != transport {
+		t.Errorf("TransportFromArgs() = %+v, %v", got, err)
+	}
+
+	for _, bad := range []profiles.Transport{
+		{Type: "tor", Server: "example.com:443"},
+		{Type: profiles.TransportStunnel, Server: "example.com"},
+		{Type: profiles.TransportStunnel, Server: "example.com\nconnect = evil:443"},
+		{Type: profiles.TransportObfs4, Server: "192.0.2.1:443"},
+		{Type: profiles.TransportObfs4, Server: "192.0.2.1:443", Cert: "abc", IATMode: 3},
+	} {
+		args := map[string]string{}
+		bad.AddArgs(args)
+		if _, err := profiles.TransportFromArgs(args); err == nil {
+			t.Errorf("%+v was accepted", bad)
+		}
+	}
+}
+
+func TestSSHArgs(t *testing.T) {
+	transport := &profiles.Transport{Type: profiles.TransportSSH, Server: "ssh.example.com:2222", User: "alice"}
+	got := strings.Join(sshArgs(transport, "192.0.2.1", "127.0.0.1:4000", "vpn.example.com:1194"), " ")
+	want := "-N -o BatchMode=yes -o ExitOnForwardFailure=yes -o ServerAliveInterval=15 " +
+		"-o HostKeyAlias=ssh.example.com -p 2222 -l alice -L 127.0.0.1:4000:vpn.example.com:1194 192.0.2.1"
+	if got != want {
+		t.Errorf("sshArgs() = %q, want %q", got, want)
+	}
+	transport.Dynamic = true
+	if got := sshArgs(transport, "192.0.2.1", "127.0.0.1:4000", ""); got[len(got)-3] != "-D" {
+		t.Errorf("sshArgs() = %q", got)
+	}
+}
+
+func TestParseCMethod(t *testing.T) {
+	if endpoint, ok := parseCMethod("CMETHOD obfs4 socks5 127.0.0.1:38561"); !ok || endpoint != "127.0.0.1:38561" {
+		t.Errorf("parseCMethod() = %q, %v", endpoint, ok)
+	}
+	for _, line := range []string{"CMETHODS DONE", "CMETHOD-ERROR obfs4 failed", "VERSION 1"} {
+		if _, ok := parseCMethod(line); ok {
+			t.Errorf("%q was parsed", line)
+		}
+	}
+}
+
+func TestObfs4Credentials(t *testing.T) {
+	d := &Daemon{}
+	d.transport.transport = &profiles.Transport{Type: profiles.TransportObfs4, Server: "192.0.2.1:443",
+		Cert: "c2VydA", IATMode: 1}
+	d.transport.local = "127.0.0.1:38561"
+	if got := d.transportArgs(); !reflect.DeepEqual(got, []string{"--socks-proxy", "127.0.0.1", "38561", "stdin"}) {
+		t.Errorf("transportArgs() = %q", got)
+	}
+	username, password, err := d.credentials(mgmt.PasswordEvent{Kind: mgmt.PasswordNeed, Type: "SOCKS Proxy",
+		NeedUsername: true})
+	if err != nil || username+password != "cert=c2VydA;iat-mode=1" || password == "" {
+		t.Errorf("got %q %q %v", username, password, err)
+	}
+}
+
+func TestStunnelCommand(t *testing.T) {
+	home, err := ioutil.TempDir("", "vodga-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	ts := &transportState{transport: &profiles.Transport{Type: profiles.TransportStunnel, Server: "vpn.example.com:443"},
+		ips: []string{"192.0.2.1"}, port: "443", uid: uint32(os.Getuid()), gid: uint32(os.Getgid()),
+		home: home, local: "127.0.0.1:4000"}
+	cmd, err := ts.command()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(ts.dir)
+	if !reflect.DeepEqual(cmd.Args, []string{"stunnel", "-fd", "0"}) {
+		t.Errorf("stunnel runs with %q", cmd.Args)
+	}
+	// Root doesn't write into the directory of the user
+	if files, err := ioutil.ReadDir(ts.dir); err != nil || len(files) != 0 {
+		t.Errorf("the directory has %v, %v", files, err)
+	}
+	config, err := ioutil.ReadAll(cmd.Stdin)
+	if err != nil || !strings.Contains(string(config), "connect = 192.0.2.1:443\nsni = vpn.example.com\n") {
+		t.Errorf("stunnel reads %q, %v", config, err)
+	}
+}
@@ -0,0 +1,94 @@
+package daemon
+
+import (
+	"github.com/TheWeirdDev/Vodga/shared/ovpn"
+	"github.com/TheWeirdDev/Vodga/shared/profiles"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// prepareUpstream remembers the proxy of the profile, openvpn asks for it with >PROXY.
+// SOCKS proxies with credentials are written into the launch config instead,
+// openvpn only asks for their password when the authfile of socks-proxy is stdin
+func (d *Daemon) prepareUpstream(args map[string]string) error {
+	proxy, err := profiles.UpstreamFromArgs(args)
+	if err != nil || proxy == nil {
+		return err
+	}
+	d.openvpn.upstream = proxy
+	if proxy.Type != profiles.ProxySOCKS || !proxy.Auth {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(d.openvpn.launchConfig)
+	if err != nil {
+		return err
+	}
+	socks := ovpn.Directive{Name: "socks-proxy", Args: []string{proxy.Host, strconv.Itoa(int(proxy.Port)), "stdin"}}
+	data, err = appendDirectives(data, socks)
+	if err != nil {
+		return err
+	}
+	launchConfig, err := writeLaunchCopy(data)
+	if err != nil {
+		return err
+	}
+	if d.openvpn.launchCopy {
+		os.Remove(d.openvpn.launchConfig)
+	}
+	d.openvpn.launchConfig = launchConfig
+	d.openvpn.launchCopy = true
+	d.openvpn.upstreamInConfig = true
+	return nil
+}
+
+// upstreamArgs makes openvpn ask for the proxy of every connection entry
+func (d *Daemon) upstreamArgs() []string {
+	if d.openvpn.upstream == nil || d.openvpn.upstreamInConfig {
+		return nil
+	}
+	return []string{"--management-query-proxy"}
+}
+
+// upstreamType is the name of the proxy type in the 'proxy' command
+func upstreamType(proxy *profiles.UpstreamProxy) string {
+	if proxy == nil {
+		return ""
+	}
+	return strings.ToUpper(string(proxy.Type))
+}
+
+// upstreamCredentials returns the stored credentials of the proxy for a password request of openvpn
+func (d *Daemon) upstreamCredentials(typ string) (string, string, bool) {
+	proxy := d.openvpn.upstream
+	if proxy == nil || proxy.Username == "" || proxy.Password == "" || typ != upstreamType(proxy)+" Proxy" {
+		return "", "", false
+	}
+	return proxy.Username, proxy.Password, true
+}
+
+// upstreamRemotes returns the addresses of the proxy, the kill switch and the IPv6 block allow them
+func (d *Daemon) upstreamRemotes(previous *killSwitch) []killSwitchRemote {
+	proxy := d.openvpn.upstream
+	if proxy == nil {
+		return nil
+	}
+	host, ips := proxy.Host, []string{proxy.Host}
+	if net.ParseIP(proxy.Host) != nil {
+		host = ""
+	} else {
+		ips = resolveRemote(proxy.Host, previous)
+		if len(ips) == 0 {
+			log.Printf("Can't resolve the proxy %s\n", proxy.Host)
+		}
+	}
+	var remotes []killSwitchRemote
+	for _, ip := range ips {
+		remotes = append(remotes, killSwitchRemote{Host: host, IP: ip, Port: uint(proxy.Port), Proto: "tcp"})
+	}
+	return remotes
+}
@@ -0,0 +1,95 @@
+package daemon
+
+import (
+	"github.com/TheWeirdDev/Vodga/daemon/mgmt"
+	"github.com/TheWeirdDev/Vodga/shared/ovpn"
+	"github.com/TheWeirdDev/Vodga/shared/profiles"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPrepareUpstream(t *testing.T) {
+	config, err := writeLaunchCopy([]byte("client\nremote vpn.example.com 443 tcp\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(config)
+
+	d := &Daemon{}
+	d.openvpn.launchConfig = config
+	args := map[string]string{}
+	profiles.UpstreamProxy{Type: profiles.ProxyHTTP, Host: "proxy.example.com", Port: 3128}.AddArgs(args)
+	if err := d.prepareUpstream(args); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.upstreamArgs(); len(got) != 1 || got[0] != "--management-query-proxy" {
+		t.Errorf("upstreamArgs() = %q", got)
+	}
+	if d.openvpn.launchConfig != config {
+		t.Error("HTTP proxies don't need a copy of the config")
+	}
+
+	// openvpn can only ask for the password of SOCKS proxies that are in the config
+	d = &Daemon{}
+	d.openvpn.launchConfig = config
+	args = map[string]string{}
+	profiles.UpstreamProxy{Type: profiles.ProxySOCKS, Host: "10.0.0.1", Port: 1080, Auth: true,
+		Username: "user", Password: "pass"}.AddArgs(args)
+	if err := d.prepareUpstream(args); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(d.openvpn.launchConfig)
+	data, err := ioutil.ReadFile(d.openvpn.launchConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(data), "\nsocks-proxy 10.0.0.1 1080 stdin\n") {
+		t.Errorf("wrong launch config:\n%s", data)
+	}
+	if got := d.upstreamArgs(); len(got) != 0 {
+		t.Errorf("upstreamArgs() = %q", got)
+	}
+	if rmts := d.upstreamRemotes(nil); len(rmts) != 1 ||
+		rmts[0] != (killSwitchRemote{IP: "10.0.0.1", Port: 1080, Proto: "tcp"}) {
+		t.Errorf("upstreamRemotes() = %+v", rmts)
+	}
+
+	username, password, err := d.credentials(mgmt.PasswordEvent{Kind: mgmt.PasswordNeed, Type: "SOCKS Proxy",
+		NeedUsername: true})
+	if err != nil || username != "user" || password != "pass" {
+		t.Errorf("got %q %q %v", username, password, err)
+	}
+	if _, _, ok := d.upstreamCredentials("HTTP Proxy"); ok {
+		t.Error("the credentials of a SOCKS proxy answered an HTTP proxy")
+	}
+}
+
+func TestPrepareUpstreamInjection(t *testing.T) {
+	config, err := writeLaunchCopy([]byte("client\nremote vpn.example.com 443 tcp\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(config)
+
+	d := &Daemon{}
+	d.openvpn.launchConfig = config
+	args := map[string]string{}
+	profiles.UpstreamProxy{Type: profiles.ProxySOCKS, Host: "h 1080 stdin\nplugin /tmp/x.so\n#", Port: 1080,
+		Auth: true, Username: "user", Password: "pass"}.AddArgs(args)
+	if err := d.prepareUpstream(args); err == nil {
+		t.Fatal("a host with a newline was accepted")
+	}
+	if d.openvpn.launchConfig != config {
+		t.Error("the launch config was changed")
+	}
+
+	// Options that are made from the arguments of a client are checked again
+	if _, err := appendDirectives([]byte("client\n"), ovpn.Directive{Name: "plugin", Args: []string{"/tmp/x.so"}}); err == nil {
+		t.Error("a plugin was added to the config")
+	}
+	if _, err := appendDirectives([]byte("client\n<ca>\n"), ovpn.Directive{Name: "socks-proxy", Args: []string{"h"}}); err == nil {
+		t.Error("an option was added into an inline block")
+	}
+}
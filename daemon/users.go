@@ -0,0 +1,198 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"github.com/TheWeirdDev/Vodga/shared/messages"
+	"github.com/TheWeirdDev/Vodga/shared/profiles"
+	"io/ioutil"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	userRoutingTable = "vodga_users"
+	// The mark of the packets of the users, and the routing table and rule priority for it
+	userMark         = "0x5644"
+	userRouteTable   = "5644"
+	userRulePriority = 5644
+)
+
+// userRouting sends the traffic of some users through the tunnel, everyone else keeps the default route.
+// nftables marks the packets of their sockets, the mark selects a routing table that only has the tunnel.
+// The table keeps an unreachable route while the tunnel is down, so the traffic doesn't leak
+type userRouting struct {
+	mtx     sync.Mutex
+	uids    []uint32
+	gids    []uint32
+	enabled bool
+	// The rules and routes are installed
+	applied bool
+}
+
+// rules returns the nftables script that marks the packets and hides the
+// addresses of the physical network behind the tunnel's
+func (u *userRouting) rules(dev string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n", userRoutingTable, userRoutingTable)
+	fmt.Fprintf(&b, "table inet %s {\n", userRoutingTable)
+
+	// Route chains route the packets again when the mark changes
+	b.WriteString("\tchain output {\n")
+	b.WriteString("\t\ttype route hook output priority mangle; policy accept;\n")
+	if len(u.uids) > 0 {
+		fmt.Fprintf(&b, "\t\tmeta skuid { %s } meta mark set %s\n", joinIDs(u.uids), userMark)
+	}
+	if len(u.gids) > 0 {
+		fmt.Fprintf(&b, "\t\tmeta skgid { %s } meta mark set %s\n", joinIDs(u.gids), userMark)
+	}
+	b.WriteString("\t}\n")
+
+	// The source address was picked for the default route
+	b.WriteString("\tchain postrouting {\n")
+	b.WriteString("\t\ttype nat hook postrouting priority srcnat; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tmeta mark %s oifname %s masquerade\n", userMark, strconv.Quote(dev))
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func joinIDs(ids []uint32) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	return strings.Join(s, ", ")
+}
+
+// prepareUsers reads the users of a profile
+func (d *Daemon) prepareUsers(args map[string]string) error {
+	if args["users"] == "" {
+		return nil
+	}
+	if args["namespace"] == "true" || args["split_mode"] != "" {
+		return errors.New("routing by user doesn't work with namespace mode or split tunneling")
+	}
+	uids, gids, err := profiles.ResolveUsers(strings.Split(args["users"], ","))
+	if err != nil {
+		return err
+	}
+	// Left by a daemon that didn't exit cleanly
+	removeUserRouting()
+	d.users.mtx.Lock()
+	defer d.users.mtx.Unlock()
+	d.users.uids, d.users.gids = uids, gids
+	d.users.enabled = true
+	return nil
+}
+
+// usersArgs returns the openvpn options of routing by user
+func (d *Daemon) usersArgs() []string {
+	d.users.mtx.Lock()
+	defer d.users.mtx.Unlock()
+	if !d.users.enabled {
+		return nil
+	}
+	// The default route stays for the other users
+	return []string{"--route-nopull"}
+}
+
+// applyUsers installs the rules when the tunnel is up, the device may change after a restart
+func (d *Daemon) applyUsers() {
+	d.users.mtx.Lock()
+	defer d.users.mtx.Unlock()
+	if !d.users.enabled {
+		return
+	}
+	d.dns.mtx.Lock()
+	dev := d.dns.dev
+	d.dns.mtx.Unlock()
+	_, localIPv6 := d.openvpn.addresses()
+	if dev == "" {
+		log.Println("Routing by user: the device of the tunnel is unknown")
+		return
+	}
+
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(d.users.rules(dev))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		d.usersError(fmt.Errorf("nft failed: %v: %s", err, strings.TrimSpace(string(out))))
+		return
+	}
+	// The rules are added once, stopUsers removes whatever got installed
+	addRules := !d.users.applied
+	d.users.applied = true
+	priority := strconv.Itoa(userRulePriority)
+	cmds := [][]string{
+		{"route", "replace", "default", "dev", dev, "table", userRouteTable},
+		{"route", "replace", "unreachable", "default", "metric", "4096", "table", userRouteTable},
+		{"-6", "route", "replace", "unreachable", "default", "metric", "4096", "table", userRouteTable},
+	}
+	if localIPv6 != "" {
+		cmds = append(cmds, []string{"-6", "route", "replace", "default", "dev", dev, "table", userRouteTable})
+	}
+	if addRules {
+		for _, family := range []string{"-4", "-6"} {
+			cmds = append(cmds,
+				// The LAN and other networks of the main table stay reachable
+				[]string{family, "rule", "add", "fwmark", userMark, "table", "main", "suppress_prefixlength", "0",
+					"priority", strconv.Itoa(userRulePriority - 1)},
+				[]string{family, "rule", "add", "fwmark", userMark, "table", userRouteTable, "priority", priority})
+		}
+	}
+	for _, args := range cmds {
+		if err := ipCommand(args...); err != nil {
+			d.usersError(err)
+			return
+		}
+	}
+
+	// The replies come from the tunnel, but the addresses of the tunnel are not routed through it
+	// in the main table, strict reverse path filtering would drop them
+	rpFilter := "/proc/sys/net/ipv4/conf/" + dev + "/rp_filter"
+	if err := ioutil.WriteFile(rpFilter, []byte("2"), 0644); err != nil {
+		log.Printf("Routing by user: %v\n", err)
+	}
+	log.Printf("Routing by user: uids %v and gids %v go through %s\n", d.users.uids, d.users.gids, dev)
+}
+
+func (d *Daemon) usersError(err error) {
+	log.Printf("Routing by user: %v\n", err)
+	d.broadcastMessage(messages.ErrorMsg("Can't route the users through the tunnel: " + err.Error()))
+}
+
+// removeUserRouting deletes the rules and the routes, including the ones of a daemon that crashed
+func removeUserRouting() {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("table inet %s\ndelete table inet %s\n",
+		userRoutingTable, userRoutingTable))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("Routing by user: nft failed: %v: %s\n", err, strings.TrimSpace(string(out)))
+	}
+	for _, family := range []string{"-4", "-6"} {
+		// ip rule del removes one rule at a time
+		for {
+			if err := ipCommand(family, "rule", "del", "fwmark", userMark); err != nil {
+				break
+			}
+		}
+		_ = ipCommand(family, "route", "flush", "table", userRouteTable)
+	}
+}
+
+// stopUsers removes the rules on disconnect and forgets the users of the profile
+func (d *Daemon) stopUsers() {
+	d.users.mtx.Lock()
+	defer d.users.mtx.Unlock()
+	if d.users.applied {
+		removeUserRouting()
+		log.Println("Routing by user removed")
+	}
+	d.users.uids = nil
+	d.users.gids = nil
+	d.users.enabled = false
+	d.users.applied = false
+}
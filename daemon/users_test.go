@@ -0,0 +1,39 @@
+package daemon
+
+import (
+	"github.com/TheWeirdDev/Vodga/shared/profiles"
+	"strings"
+	"testing"
+)
+
+func TestUserRoutingRules(t *testing.T) {
+	u := &userRouting{uids: []uint32{1000, 1001}, gids: []uint32{27}}
+	rules := u.rules("tun0")
+	for _, want := range []string{
+		"type route hook output priority mangle; policy accept;",
+		"meta skuid { 1000, 1001 } meta mark set " + userMark,
+		"meta skgid { 27 } meta mark set " + userMark,
+		"meta mark " + userMark + " oifname \"tun0\" masquerade",
+	} {
+		if !strings.Contains(rules, want) {
+			t.Errorf("rules don't contain %q:\n%s", want, rules)
+		}
+	}
+
+	u = &userRouting{uids: []uint32{1000}}
+	if strings.Contains(u.rules("tun0"), "skgid") {
+		t.Error("rules match groups without any gids")
+	}
+}
+
+func TestResolveUsersRoot(t *testing.T) {
+	for _, rules := range [][]string{{"root"}, {"0"}, {"1000", "@root"}, {"@0"}} {
+		if _, _, err := profiles.ResolveUsers(rules); err == nil {
+			t.Errorf("%q was accepted", rules)
+		}
+	}
+	uids, gids, err := profiles.ResolveUsers([]string{"1000", "@27"})
+	if err != nil || len(uids) != 1 || uids[0] != 1000 || len(gids) != 1 || gids[0] != 27 {
+		t.Errorf("ResolveUsers() = %v, %v, %v", uids, gids, err)
+	}
+}
@@ -1,5 +1,17 @@
 package main
 
+import (
+	"fmt"
+	"github.com/TheWeirdDev/Vodga/cli"
+	"os"
+)
+
 func main() {
-	// Currently Empty, I need the daemon first
+	if err := cli.Run(os.Args[1:]); err != nil {
+		if exitErr, ok := err.(*cli.ExitError); ok {
+			os.Exit(exitErr.Code)
+		}
+		fmt.Fprintf(os.Stderr, "vodga: %v\n", err)
+		os.Exit(1)
+	}
 }
@@ -1,16 +1,13 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/TheWeirdDev/Vodga/daemon"
+	"github.com/TheWeirdDev/Vodga/shared/client"
 	"github.com/TheWeirdDev/Vodga/shared/consts"
-	"github.com/TheWeirdDev/Vodga/shared/messages"
 	"log"
-	"net"
 	"os"
 	"os/user"
 )
@@ -27,20 +24,25 @@ func main() {
 	// Only one instance may run at the same time
 	err := checkExistingInstance()
 	// Check all the command line arguments to decide what to do next
-	if err := checkArgs(err); err != nil {
+	opts, err := checkArgs(err)
+	if err != nil {
 		log.Fatalf("Error: %v", err)
 	}
 
 	log.Println("Vodga daemon is running")
 
-	server := daemon.NewDaemon()
+	server := daemon.NewDaemon(opts)
 	// Starts and waits for server to stop
 	server.StartServer()
 }
 
-func checkArgs(err error) error {
+func checkArgs(err error) (daemon.Options, error) {
 
 	command := flag.String("command", "start", "start or stop the daemon")
+	scripts := flag.String("scripts", "reject",
+		"what to do with script directives in configs that are not installed by root: reject or strip")
+	dns := flag.String("dns", "auto",
+		"how to apply the pushed DNS servers: auto, resolved, resolvconf or off")
 	//numbPtr := flag.Int("numb", 42, "an int")
 	//boolPtr := flag.Bool("fork", false, "a bool")
 
@@ -49,6 +51,15 @@ func checkArgs(err error) error {
 
 	flag.Parse()
 
+	opts := daemon.Options{}
+	var optErr error
+	if opts.ScriptPolicy, optErr = daemon.ParseScriptPolicy(*scripts); optErr != nil {
+		return opts, optErr
+	}
+	if opts.DNS, optErr = daemon.ParseDNSMode(*dns); optErr != nil {
+		return opts, optErr
+	}
+
 	shouldExit := true
 	switch *command {
 
@@ -61,10 +72,10 @@ func checkArgs(err error) error {
 		{
 			if err == InstanceExists {
 				if err := stopExistingServer(); err != nil {
-					return err
+					return opts, err
 				}
 			} else if err != nil {
-				return err
+				return opts, err
 			} else {
 				log.Println("No existing instance found")
 			}
@@ -76,48 +87,28 @@ func checkArgs(err error) error {
 
 	case "start":
 		if err != nil {
-			return err
+			return opts, err
 		}
 
 	default:
-		return fmt.Errorf("unknown command \"%s\"", *command)
+		return opts, fmt.Errorf("unknown command \"%s\"", *command)
 	}
-	return nil
+	return opts, nil
 	//fmt.Println("tail:", flag.Args())
 }
 
 func stopExistingServer() error {
-	c, err := net.Dial("unix", consts.UnixSocket)
+	c, err := client.Dial(consts.UnixSocket)
 	if err != nil {
 		return err
 	}
 	defer c.Close()
 
-	data, err := json.Marshal(messages.SimpleMsg(consts.MsgStop))
-	if err != nil {
-		return err
+	if err := c.StopServer(); err != nil {
+		return fmt.Errorf("can't stop the server: %v", err)
 	}
-	data = append(data, '\n')
-	_, err = c.Write(data)
-	if err != nil {
-		return err
-	}
-
-	scanner := bufio.NewScanner(c)
-	if scanner.Scan() {
-		msg, err := messages.UnmarshalMsg(scanner.Text())
-		if err != nil {
-			return err
-		}
-		if msg.Command == "" {
-			return errors.New("returned command is a empty")
-		}
-		if msg.Command == consts.MsgKilled {
-			log.Println("Server restarted")
-			return nil
-		}
-	}
-	return errors.New("can't stop the server")
+	log.Println("Server stopped")
+	return nil
 }
 
 func checkUser() error {
@@ -0,0 +1,476 @@
+// Package client talks to the Vodga daemon over its unix socket.
+// It's shared by the GUI, the CLI and any other tool that controls the daemon
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/TheWeirdDev/Vodga/shared/auth"
+	"github.com/TheWeirdDev/Vodga/shared/consts"
+	"github.com/TheWeirdDev/Vodga/shared/messages"
+	"github.com/TheWeirdDev/Vodga/shared/profiles"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Events that are generated by the client itself, not the daemon
+const (
+	// EventDisconnected is sent when the connection to the daemon is lost
+	EventDisconnected = "DAEMON_DISCONNECTED"
+	// EventReconnected is sent when the client is connected to the daemon again
+	EventReconnected = "DAEMON_RECONNECTED"
+)
+
+var (
+	ErrClosed       = errors.New("client is closed")
+	ErrDisconnected = errors.New("not connected to the daemon")
+	ErrTimeout      = errors.New("the daemon didn't reply in time")
+)
+
+const (
+	// How long to wait between reconnection attempts
+	reconnectDelay = 500 * time.Millisecond
+	// Daemons older than the protocol version 2 never reply with an id
+	requestTimeout = 5 * time.Second
+	// The longest message of the daemon, the replies of GET_LOGS have every log line
+	maxMessageSize = 16 * 1024 * 1024
+)
+
+// Events that wait for the application, it has to answer them or the connection hangs
+var requestEvents = map[string]bool{
+	consts.MsgPasswordRequest: true,
+	consts.MsgSignRequest:     true,
+	consts.MsgPKCS11IDRequest: true,
+}
+
+// DaemonError is an ERROR reply of the daemon
+type DaemonError struct {
+	Code    string
+	Message string
+}
+
+func (e *DaemonError) Error() string {
+	return e.Message
+}
+
+type (
+	Bytecount = messages.Bytecount
+	Status    = messages.Status
+)
+
+type Client struct {
+	path string
+
+	mtx     sync.Mutex
+	conn    net.Conn
+	nextID  uint64
+	pending map[string]chan *messages.Message
+
+	writeMtx sync.Mutex
+	// Held while sending events, the channel is closed with the write lock
+	eventsMtx sync.RWMutex
+	events    chan *messages.Message
+	closed    chan struct{}
+}
+
+// Dial connects to the daemon and checks the protocol version.
+// After the first connection, the client reconnects on its own when the daemon restarts
+func Dial(path string) (*Client, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		path:    path,
+		conn:    conn,
+		pending: make(map[string]chan *messages.Message),
+		events:  make(chan *messages.Message, 64),
+		closed:  make(chan struct{}),
+	}
+	go c.run(conn)
+
+	if err := c.hello(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if err := c.subscribe(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Events returns the broadcasts of the daemon and the client's own events.
+// Events are dropped if the channel is full, except the requests and the status after subscribing
+func (c *Client) Events() <-chan *messages.Message {
+	return c.events
+}
+
+// Close disconnects from the daemon and stops reconnecting
+func (c *Client) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	select {
+	case <-c.closed:
+		return ErrClosed
+	default:
+	}
+	close(c.closed)
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
+}
+
+// Request sends a message to the daemon and waits for its reply.
+// ERROR replies are returned as a *DaemonError
+func (c *Client) Request(msg *messages.Message) (*messages.Message, error) {
+	return c.request(msg, nil)
+}
+
+// request sends the descriptors of files along with the message
+func (c *Client) request(msg *messages.Message, files []*os.File) (*messages.Message, error) {
+	c.mtx.Lock()
+	conn := c.conn
+	if conn == nil {
+		c.mtx.Unlock()
+		return nil, ErrDisconnected
+	}
+	c.nextID++
+	msg.ID = strconv.FormatUint(c.nextID, 10)
+	ch := make(chan *messages.Message, 1)
+	c.pending[msg.ID] = ch
+	c.mtx.Unlock()
+
+	c.writeMtx.Lock()
+	var err error
+	if len(files) > 0 {
+		err = writeWithFiles(msg, conn, files)
+	} else {
+		err = messages.WriteMessage(msg, conn)
+	}
+	c.writeMtx.Unlock()
+	if err != nil {
+		c.mtx.Lock()
+		delete(c.pending, msg.ID)
+		c.mtx.Unlock()
+		return nil, err
+	}
+
+	var resp *messages.Message
+	select {
+	case r, ok := <-ch:
+		if !ok {
+			return nil, ErrDisconnected
+		}
+		resp = r
+	case <-time.After(requestTimeout):
+		c.mtx.Lock()
+		delete(c.pending, msg.ID)
+		c.mtx.Unlock()
+		return nil, ErrTimeout
+	}
+	switch resp.Command {
+	case consts.MsgError:
+		return nil, &DaemonError{Code: resp.Args["code"], Message: resp.Args["error"]}
+	case consts.MsgDenied:
+		return nil, &DaemonError{Code: consts.MsgDenied, Message: resp.Args["reason"]}
+	}
+	return resp, nil
+}
+
+// writeWithFiles sends the descriptors with the first byte of the message
+func writeWithFiles(msg *messages.Message, conn net.Conn, files []*os.File) error {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return errors.New("descriptors can only be sent over a unix socket")
+	}
+	var buf bytes.Buffer
+	if err := messages.WriteMessage(msg, &buf); err != nil {
+		return err
+	}
+	fds := make([]int, len(files))
+	for i, f := range files {
+		fds[i] = int(f.Fd())
+	}
+	data := buf.Bytes()
+	n, _, err := uc.WriteMsgUnix(data, syscall.UnixRights(fds...), nil)
+	if err != nil {
+		return err
+	}
+	_, err = uc.Write(data[n:])
+	return err
+}
+
+// Connect starts openvpn with an imported config and its settings
+func (c *Client) Connect(single profiles.SingleCfg, creds auth.Credentials) error {
+	msg := messages.ConnectMsg(single.Path(), creds)
+	single.AddConnectArgs(msg.Args)
+	_, err := c.Request(msg)
+	return err
+}
+
+// AnswerPassword answers a PASSWORD_REQUEST event, the username is ignored if it wasn't requested.
+// Only the client that sent CONNECT gets the requests of that connection
+func (c *Client) AnswerPassword(username, password string) error {
+	_, err := c.Request(messages.PasswordResponseMsg(username, password))
+	return err
+}
+
+// AnswerSignature answers a SIGN_REQUEST event with a base64 signature.
+// If the key can't sign, the error is sent instead and the connection fails
+func (c *Client) AnswerSignature(signature string, signErr error) error {
+	errText := ""
+	if signErr != nil {
+		errText = signErr.Error()
+	}
+	_, err := c.Request(messages.SignResponseMsg(signature, errText))
+	return err
+}
+
+// AnswerPKCS11ID answers a PKCS11_ID_REQUEST event with the id of a certificate of the list
+func (c *Client) AnswerPKCS11ID(id string) error {
+	_, err := c.Request(messages.PKCS11IDResponseMsg(id))
+	return err
+}
+
+// Exec runs a command in the namespace of a config that is connected in namespace mode.
+// The command gets the files as its stdin, stdout and stderr and runs as the user of the client.
+// The pid of the command is returned, an EXEC_EXITED event comes when it exits
+func (c *Client) Exec(single profiles.SingleCfg, argv, env []string, dir string,
+	stdio [3]*os.File) (int, error) {
+	msg, err := messages.ExecMsg(single.Path(), argv, env, dir)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.request(msg, stdio[:])
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(resp.Args["pid"])
+}
+
+// Disconnect stops openvpn
+func (c *Client) Disconnect() error {
+	_, err := c.Request(messages.SimpleMsg(consts.MsgDisconnect))
+	return err
+}
+
+// KillOpenvpn kills every running openvpn process
+func (c *Client) KillOpenvpn() error {
+	_, err := c.Request(messages.SimpleMsg(consts.MsgKillOpenvpn))
+	return err
+}
+
+// DisableKillSwitch removes the rules of the kill switch
+func (c *Client) DisableKillSwitch() error {
+	_, err := c.Request(messages.SimpleMsg(consts.MsgKillSwitchOff))
+	return err
+}
+
+// StopServer stops the daemon
+func (c *Client) StopServer() error {
+	_, err := c.Request(messages.SimpleMsg(consts.MsgStop))
+	return err
+}
+
+// Status returns a snapshot of the connection
+func (c *Client) Status() (Status, error) {
+	resp, err := c.Request(messages.SimpleMsg(consts.MsgGetStatus))
+	if err != nil {
+		return Status{}, err
+	}
+	return messages.ParseStatus(resp), nil
+}
+
+// Bytecount returns the traffic of the current connection
+func (c *Client) Bytecount() (Bytecount, error) {
+	resp, err := c.Request(messages.GetBytecountMsg())
+	if err != nil {
+		return Bytecount{}, err
+	}
+	return messages.ParseBytecount(resp), nil
+}
+
+// Logs returns the recent output of openvpn
+func (c *Client) Logs() ([]string, error) {
+	resp, err := c.Request(messages.SimpleMsg(consts.MsgGetLogs))
+	if err != nil {
+		return nil, err
+	}
+	if resp.Args["logs"] == "" {
+		return nil, nil
+	}
+	return strings.Split(resp.Args["logs"], "\n"), nil
+}
+
+func (c *Client) hello() error {
+	_, err := c.Request(messages.HelloMsg())
+	return err
+}
+
+// subscribe asks for the broadcasts of the daemon.
+// The snapshot that the daemon replies with is the first event after it
+func (c *Client) subscribe() error {
+	resp, err := c.Request(messages.SimpleMsg(consts.MsgSubscribe))
+	if err != nil {
+		return err
+	}
+	resp.ID = ""
+	c.emitWait(resp)
+	return nil
+}
+
+func (c *Client) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) emit(msg *messages.Message) {
+	if requestEvents[msg.Command] {
+		c.emitWait(msg)
+		return
+	}
+	c.eventsMtx.RLock()
+	defer c.eventsMtx.RUnlock()
+	select {
+	case c.events <- msg:
+	case <-c.closed:
+	default:
+		log.Printf("Client: event %s dropped, nobody is listening\n", msg.Command)
+	}
+}
+
+// emitWait sends an event that can't be dropped, it waits until there's room or the client is closed
+func (c *Client) emitWait(msg *messages.Message) {
+	c.eventsMtx.RLock()
+	defer c.eventsMtx.RUnlock()
+	select {
+	case c.events <- msg:
+	case <-c.closed:
+	}
+}
+
+func (c *Client) closeEvents() {
+	c.eventsMtx.Lock()
+	defer c.eventsMtx.Unlock()
+	close(c.events)
+}
+
+// Reads from the daemon and reconnects until the client is closed
+func (c *Client) run(conn net.Conn) {
+	defer c.closeEvents()
+	for {
+		c.read(conn)
+
+		c.mtx.Lock()
+		c.conn = nil
+		for id, ch := range c.pending {
+			close(ch)
+			delete(c.pending, id)
+		}
+		c.mtx.Unlock()
+
+		if c.isClosed() {
+			return
+		}
+		c.emit(messages.SimpleMsg(EventDisconnected))
+
+		conn = c.redial()
+		if conn == nil {
+			return
+		}
+		c.emit(messages.SimpleMsg(EventReconnected))
+		// The version is checked again because it could be a different daemon
+		go func() {
+			if err := c.hello(); err != nil {
+				log.Printf("Client: handshake failed: %v\n", err)
+				return
+			}
+			if err := c.subscribe(); err != nil {
+				log.Printf("Client: can't subscribe: %v\n", err)
+			}
+		}()
+	}
+}
+
+// Tries connecting until it succeeds, returns nil if the client is closed
+func (c *Client) redial() net.Conn {
+	for {
+		select {
+		case <-c.closed:
+			return nil
+		case <-time.After(reconnectDelay):
+		}
+		conn, err := net.Dial("unix", c.path)
+		if err != nil {
+			continue
+		}
+		c.mtx.Lock()
+		if c.isClosed() {
+			c.mtx.Unlock()
+			conn.Close()
+			return nil
+		}
+		c.conn = conn
+		c.mtx.Unlock()
+		return conn
+	}
+}
+
+// failPending answers every request that waits for a reply with msg
+func (c *Client) failPending(msg *messages.Message) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for id, ch := range c.pending {
+		ch <- msg
+		delete(c.pending, id)
+	}
+}
+
+func (c *Client) read(conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), maxMessageSize)
+	for scanner.Scan() {
+		msg, err := messages.UnmarshalMsg(scanner.Text())
+		if err != nil {
+			log.Printf("Client: invalid message from daemon: %v\n", err)
+			continue
+		}
+
+		if msg.ID == "" && msg.Command == consts.MsgError && msg.Args["error"] == consts.UnknownCmd {
+			// Daemons without protocol versions don't know HELLO and reply without an id
+			c.failPending(messages.ErrorCodeMsg(consts.ErrVersionMismatch, fmt.Sprintf(
+				"the daemon is too old, it doesn't speak the protocol version %d", consts.ProtocolVersion)))
+			continue
+		}
+
+		c.mtx.Lock()
+		ch, ok := c.pending[msg.ID]
+		if ok {
+			delete(c.pending, msg.ID)
+		}
+		c.mtx.Unlock()
+
+		if ok {
+			ch <- msg
+		} else {
+			c.emit(msg)
+		}
+	}
+	if err := scanner.Err(); err != nil && !c.isClosed() {
+		log.Printf("Client: can't read from the daemon: %v\n", err)
+	}
+}
@@ -0,0 +1,197 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/TheWeirdDev/Vodga/shared/consts"
+	"github.com/TheWeirdDev/Vodga/shared/messages"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A fake daemon that replies to HELLO, SUBSCRIBE, GET_STATUS, GET_BYTECOUNT and GET_LOGS.
+// Connections are closed when the listener is closed
+func serve(t *testing.T, ln net.Listener) {
+	var conns []net.Conn
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conns = append(conns, c)
+		go func(c net.Conn) {
+			defer c.Close()
+			scanner := bufio.NewScanner(c)
+			for scanner.Scan() {
+				msg, err := messages.UnmarshalMsg(scanner.Text())
+				if err != nil {
+					t.Errorf("invalid request: %v", err)
+					return
+				}
+				switch msg.Command {
+				case consts.MsgHello:
+					_ = messages.WriteMessage(messages.HelloMsg().Reply(msg), c)
+				case consts.MsgSubscribe, consts.MsgGetStatus:
+					_ = messages.WriteMessage(messages.StatusMsg(messages.Status{
+						State: consts.StateCONNECTED, LocalIP: "10.8.0.2"}).Reply(msg), c)
+				case consts.MsgGetBytecount:
+					// A broadcast before the reply must not be taken as the reply
+					_ = messages.WriteMessage(messages.StateMsg(consts.StateCONNECTED), c)
+					_ = messages.WriteMessage(messages.BytecountMsg(1, 2, 3, 4).Reply(msg), c)
+				case consts.MsgGetLogs:
+					// More broadcasts than the events channel holds, the request after them must not be dropped
+					for i := 0; i < 100; i++ {
+						_ = messages.WriteMessage(messages.StateMsg(consts.StateCONNECTED), c)
+					}
+					_ = messages.WriteMessage(messages.SignRequestMsg("ZGF0YQ==", "RSA_PKCS1_PADDING"), c)
+					logs := make([]string, 2000)
+					for i := range logs {
+						logs[i] = strings.Repeat("x", 100)
+					}
+					_ = messages.WriteMessage(messages.LogsMsg(logs).Reply(msg), c)
+				default:
+					_ = messages.WriteMessage(messages.ErrorMsg(consts.UnknownCmd).Reply(msg), c)
+				}
+			}
+		}(c)
+	}
+}
+
+func TestClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vodga-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "vodgad.sock")
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serve(t, ln)
+
+	c, err := Dial(path)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer c.Close()
+
+	if msg := <-c.Events(); msg.Command != consts.MsgStatus {
+		t.Fatalf("expected the snapshot of SUBSCRIBE as the first event, got %s", msg.Command)
+	}
+	status, err := c.Status()
+	if err != nil {
+		t.Fatalf("status failed: %v", err)
+	}
+	if status.State != consts.StateCONNECTED || status.LocalIP != "10.8.0.2" {
+		t.Errorf("wrong status: %+v", status)
+	}
+
+	bytecount, err := c.Bytecount()
+	if err != nil {
+		t.Fatalf("bytecount failed: %v", err)
+	}
+	if bytecount != (Bytecount{In: 1, Out: 2, TotalIn: 3, TotalOut: 4}) {
+		t.Errorf("wrong bytecount: %+v", bytecount)
+	}
+	if msg := <-c.Events(); msg.Command != consts.MsgStateChanged {
+		t.Errorf("expected the state broadcast as an event, got %s", msg.Command)
+	}
+	if _, err := c.Request(messages.SimpleMsg("NOT_A_COMMAND")); err == nil {
+		t.Errorf("error replies should be returned as errors")
+	}
+
+	// The reply is bigger than the default limit of bufio.Scanner
+	done := make(chan error, 1)
+	go func() {
+		logs, err := c.Logs()
+		if err == nil && len(logs) != 2000 {
+			err = fmt.Errorf("got %d log lines", len(logs))
+		}
+		done <- err
+	}()
+	for request := false; !request; {
+		select {
+		case msg := <-c.Events():
+			request = msg.Command == consts.MsgSignRequest
+		case <-time.After(5 * time.Second):
+			t.Fatal("the sign request was dropped")
+		}
+	}
+	if err := <-done; err != nil {
+		t.Errorf("logs failed: %v", err)
+	}
+
+	// Restart the daemon
+	ln.Close()
+	if msg := <-c.Events(); msg.Command != EventDisconnected {
+		t.Fatalf("expected %s, got %s", EventDisconnected, msg.Command)
+	}
+	ln, err = net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serve(t, ln)
+
+	select {
+	case msg := <-c.Events():
+		if msg.Command != EventReconnected {
+			t.Fatalf("expected %s, got %s", EventReconnected, msg.Command)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client didn't reconnect")
+	}
+	if msg := <-c.Events(); msg.Command != consts.MsgStatus {
+		t.Errorf("expected a new snapshot after reconnecting, got %s", msg.Command)
+	}
+	if _, err := c.Bytecount(); err != nil {
+		t.Errorf("bytecount after reconnecting failed: %v", err)
+	}
+}
+
+func TestOldDaemon(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vodga-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "vodgad.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		// Daemons before the protocol versions reply to unknown commands without an id
+		scanner := bufio.NewScanner(c)
+		for scanner.Scan() {
+			_, _ = c.Write([]byte(`{"cmd":"ERROR","args":{"error":"UNKNOWN_COMMAND"}}` + "\n"))
+		}
+	}()
+
+	start := time.Now()
+	_, err = Dial(path)
+	if daemonErr, ok := err.(*DaemonError); !ok || daemonErr.Code != consts.ErrVersionMismatch {
+		t.Errorf("Dial() = %v, want a version mismatch", err)
+	}
+	if time.Since(start) >= requestTimeout {
+		t.Error("the client waited for the timeout")
+	}
+}
@@ -4,12 +4,25 @@ const (
 	//TODO: Change These!
 	UIFilePath    = "/home/alireza/go/src/github.com/TheWeirdDev/Vodga/ui/data/vodga.ui"
 	AddSingelUI   = "/home/alireza/go/src/github.com/TheWeirdDev/Vodga/ui/data/import_single.ui"
+	SplitTunnelUI = "/home/alireza/go/src/github.com/TheWeirdDev/Vodga/ui/data/split_tunnel.ui"
 	UnixSocket    = "/tmp/vodgad.sock"
 	MgmtSocket    = "/tmp/vodgad_mgmt.sock"
+	ControlGroup  = "vodga"
+	MaxLogLines   = 1000
+	StateDir      = "/var/lib/vodga"
+	DNSStubIP     = "127.0.80.53"
+	Netns         = "vodga"
 	UnknownCmd    = "UNKNOWN_COMMAND"
-	IPRegex       = "^(?:(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\\.){3}(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)$"
 )
 
+// The SOCKS5 port of the proxy when a profile enables it without choosing any port
+const ProxySOCKSPort = 1080
+
+// ProtocolVersion is announced in HELLO messages.
+// Clients with a different version get a VERSION_MISMATCH error.
+// Version 3 replaced CHALLENGE and CHALLENGE_RESPONSE with PASSWORD_REQUEST and PASSWORD_RESPONSE
+const ProtocolVersion = 3
+
 const (
 	AuthNoAuth   = "NO_AUTH"
 	AuthUserPass = "AUTH_USER_PASS"
@@ -28,6 +41,69 @@ const (
 	MsgGetBytecount = "GET_BYTECOUNT"
 	MsgByteCount    = "BYTECOUNT"
 	MsgAuthFailed   = "AUTH_FAILED"
+	MsgDenied       = "PERMISSION_DENIED"
+	MsgHello        = "HELLO"
+	MsgOK           = "OK"
+	MsgGetLogs      = "GET_LOGS"
+	MsgLogs         = "LOGS"
+	MsgGetStatus    = "GET_STATUS"
+	MsgSubscribe    = "SUBSCRIBE"
+	MsgStatus       = "STATUS"
+)
+
+// Sent before openvpn is restarted by the reconnect policy
+const MsgReconnectScheduled = "RECONNECT_SCHEDULED"
+
+// Removes the rules of the kill switch
+const MsgKillSwitchOff = "KILLSWITCH_DISABLE"
+
+// Runs a command in the network namespace of the connection.
+// The stdin, stdout and stderr of the command are passed with the request
+const (
+	MsgExec        = "EXEC"
+	MsgExecStarted = "EXEC_STARTED"
+	MsgExecExited  = "EXEC_EXITED"
+)
+
+// PASSWORD_REQUEST is sent to the client that started the connection when openvpn needs
+// a secret that the daemon doesn't have, it replies with PASSWORD_RESPONSE
+const (
+	MsgPasswordRequest  = "PASSWORD_REQUEST"
+	MsgPasswordResponse = "PASSWORD_RESPONSE"
+)
+
+// The kinds of the secrets in PASSWORD_REQUEST
+const (
+	PasswordAuth       = "auth"
+	PasswordPrivateKey = "private_key"
+	PasswordHTTPProxy  = "http_proxy"
+	PasswordSOCKSProxy = "socks_proxy"
+	// The PIN of a PKCS#11 token, the type is the label of the token
+	PasswordToken = "token"
+	// A static or dynamic challenge of the server, like an OTP prompt
+	PasswordChallenge = "challenge"
+	PasswordOther     = "other"
+)
+
+// SIGN_REQUEST is sent to the client that started the connection when the profile has an external key.
+// The data is base64, the client signs it with the key and replies with SIGN_RESPONSE
+const (
+	MsgSignRequest  = "SIGN_REQUEST"
+	MsgSignResponse = "SIGN_RESPONSE"
+)
+
+// PKCS11_ID_REQUEST lists the certificates of the tokens when the profile has no stored choice
+// or its certificate is gone, the client replies with the chosen id in PKCS11_ID_RESPONSE
+const (
+	MsgPKCS11IDRequest  = "PKCS11_ID_REQUEST"
+	MsgPKCS11IDResponse = "PKCS11_ID_RESPONSE"
+)
+
+const (
+	ErrVersionMismatch = "VERSION_MISMATCH"
+	ErrInvalidState    = "INVALID_STATE"
+	// CONNECT without a kill switch while the kill switch of another profile is enabled
+	ErrKillSwitchActive = "KILLSWITCH_ACTIVE"
 )
 
 const (
@@ -41,3 +117,12 @@ const (
 	StateRECONNECTING = "RECONNECTING"
 	StateEXITING      = "EXITING"
 )
+
+// States of the daemon that are not openvpn states
+const (
+	StateIdle           = "IDLE"
+	StateStarting       = "STARTING"
+	StateAuthenticating = "AUTHENTICATING"
+	StateDisconnecting  = "DISCONNECTING"
+	StateFailed         = "FAILED"
+)
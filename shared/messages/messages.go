@@ -6,25 +6,32 @@ import (
 	"github.com/TheWeirdDev/Vodga/shared/auth"
 	"github.com/TheWeirdDev/Vodga/shared/consts"
 	"github.com/TheWeirdDev/Vodga/shared/utils"
-	"log"
-	"net"
+	"io"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// Message is a single line of JSON on the daemon socket.
+// Clients that send a HELLO with their protocol version may put an id on every request,
+// the daemon then answers each of them with exactly one reply that carries the same id:
+// OK, ERROR or a message with the requested data. Broadcasts never have an id.
+// Requests without an id get the same replies as the first version of the protocol
 type Message struct {
 	Command string            `json:"cmd"`
+	ID      string            `json:"id,omitempty"`
 	Args    map[string]string `json:"args"`
 }
 
-func SendMessage(msg *Message, c net.Conn) {
+// WriteMessage writes a message as a line of JSON
+func WriteMessage(msg *Message, w io.Writer) error {
 	data, err := json.Marshal(msg)
 	if err != nil {
-		log.Fatalf("Can't marshal message")
+		return err
 	}
 	data = append(data, '\n')
-	_, err = c.Write(data)
-	if err != nil {
-		log.Fatalf("Can't send message")
-	}
+	_, err = w.Write(data)
+	return err
 }
 
 func SimpleMsg(cmd string) *Message {
@@ -50,6 +57,110 @@ func StateMsg(state string) *Message {
 		Args: map[string]string{"state": state}}
 }
 
+// StateChangeMsg tells the clients about a transition of the daemon's state.
+// detail is the openvpn state that caused it, if any
+func StateChangeMsg(state, previous, reason, detail string) *Message {
+	msg := StateMsg(state)
+	msg.Args["previous"] = previous
+	msg.Args["reason"] = reason
+	if detail != "" {
+		msg.Args["detail"] = detail
+	}
+	return msg
+}
+
+// ReconnectMsg announces the next attempt of the reconnect policy
+func ReconnectMsg(attempt, maxAttempts int, delay time.Duration, reason string) *Message {
+	return &Message{Command: consts.MsgReconnectScheduled, Args: map[string]string{
+		"attempt":      strconv.Itoa(attempt),
+		"max_attempts": strconv.Itoa(maxAttempts),
+		"delay":        strconv.FormatInt(int64(delay.Round(time.Second)/time.Second), 10),
+		"reason":       reason,
+	}}
+}
+
+// Status is a snapshot of the connection, for clients that attach mid-session
+type Status struct {
+	State   string
+	Profile string
+	// Zero if the tunnel is not up
+	ConnectedSince time.Time
+	// The address of the tunnel and the server, from the last state of openvpn
+	LocalIP    string
+	LocalIPv6  string
+	RemoteIP   string
+	RemotePort string
+	Bytecount  Bytecount
+	// The rules of the kill switch are installed
+	KillSwitch bool
+	// The network namespace of the tunnel, empty if it's not in one
+	Namespace string
+	// The ports of the local proxy on 127.0.0.1, zero if it's not running
+	SOCKSPort int
+	HTTPPort  int
+}
+
+type Bytecount struct {
+	In       uint64
+	Out      uint64
+	TotalIn  uint64
+	TotalOut uint64
+}
+
+func StatusMsg(status Status) *Message {
+	msg := BytecountMsg(status.Bytecount.In, status.Bytecount.Out,
+		status.Bytecount.TotalIn, status.Bytecount.TotalOut)
+	msg.Command = consts.MsgStatus
+	msg.Args["state"] = status.State
+	msg.Args["profile"] = status.Profile
+	msg.Args["local_ip"] = status.LocalIP
+	msg.Args["local_ipv6"] = status.LocalIPv6
+	msg.Args["remote_ip"] = status.RemoteIP
+	msg.Args["remote_port"] = status.RemotePort
+	msg.Args["kill_switch"] = strconv.FormatBool(status.KillSwitch)
+	if status.Namespace != "" {
+		msg.Args["namespace"] = status.Namespace
+	}
+	if status.SOCKSPort != 0 {
+		msg.Args["socks_port"] = strconv.Itoa(status.SOCKSPort)
+	}
+	if status.HTTPPort != 0 {
+		msg.Args["http_port"] = strconv.Itoa(status.HTTPPort)
+	}
+	if !status.ConnectedSince.IsZero() {
+		msg.Args["connected_since"] = strconv.FormatInt(status.ConnectedSince.Unix(), 10)
+	}
+	return msg
+}
+
+// ParseStatus reads the snapshot of a STATUS message
+func ParseStatus(msg *Message) Status {
+	status := Status{
+		State:      msg.Args["state"],
+		Profile:    msg.Args["profile"],
+		LocalIP:    msg.Args["local_ip"],
+		LocalIPv6:  msg.Args["local_ipv6"],
+		RemoteIP:   msg.Args["remote_ip"],
+		RemotePort: msg.Args["remote_port"],
+		Namespace:  msg.Args["namespace"],
+	}
+	if since, err := strconv.ParseInt(msg.Args["connected_since"], 10, 64); err == nil {
+		status.ConnectedSince = time.Unix(since, 0)
+	}
+	status.KillSwitch, _ = strconv.ParseBool(msg.Args["kill_switch"])
+	status.SOCKSPort, _ = strconv.Atoi(msg.Args["socks_port"])
+	status.HTTPPort, _ = strconv.Atoi(msg.Args["http_port"])
+	status.Bytecount = ParseBytecount(msg)
+	return status
+}
+
+// ParseBytecount reads the counters of BYTECOUNT and STATUS messages
+func ParseBytecount(msg *Message) Bytecount {
+	in, out, tin, tout := utils.BytecountToUint(msg.Args["in"], msg.Args["out"],
+		msg.Args["tin"], msg.Args["tout"])
+	return Bytecount{In: in, Out: out, TotalIn: tin, TotalOut: tout}
+}
+
 func UnmarshalMsg(text string) (*Message, error) {
 	msg := &Message{}
 	err := json.Unmarshal([]byte(text), msg)
@@ -59,19 +170,162 @@ func UnmarshalMsg(text string) (*Message, error) {
 	return msg, err
 }
 
-func ConnectMsg(cfgPath string, authMethod auth.Auth, creds ...string) *Message {
+func ConnectMsg(cfgPath string, creds auth.Credentials) *Message {
 	msg := &Message{Command: consts.MsgConnect}
-	if authMethod == auth.USER_PASS {
-		msg.Args = map[string]string{"config": cfgPath, "auth": consts.AuthUserPass,
-			"username": creds[0], "password": creds[1]}
+	if creds.Auth == auth.USER_PASS {
+		msg.Args = map[string]string{"config": cfgPath, "authMethod": consts.AuthUserPass,
+			"username": creds.Username, "password": creds.Password}
+	} else {
+		msg.Args = map[string]string{"config": cfgPath, "authMethod": consts.AuthNoAuth}
 	}
 	return msg
 }
 
+// ExecMsg asks the daemon to run a command in the namespace of a config.
+// The command line and the environment are JSON lists
+func ExecMsg(cfgPath string, argv, env []string, dir string) (*Message, error) {
+	argvData, err := json.Marshal(argv)
+	if err != nil {
+		return nil, err
+	}
+	envData, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Command: consts.MsgExec, Args: map[string]string{"config": cfgPath,
+		"argv": string(argvData), "env": string(envData), "dir": dir}}, nil
+}
+
+// ParseExec reads the command line and the environment of an EXEC message
+func ParseExec(msg *Message) (argv, env []string, err error) {
+	if err := json.Unmarshal([]byte(msg.Args["argv"]), &argv); err != nil || len(argv) == 0 {
+		return nil, nil, errors.New("invalid command line")
+	}
+	if msg.Args["env"] != "" {
+		if err := json.Unmarshal([]byte(msg.Args["env"]), &env); err != nil {
+			return nil, nil, errors.New("invalid environment")
+		}
+	}
+	return argv, env, nil
+}
+
+func ExecStartedMsg(pid int) *Message {
+	return &Message{Command: consts.MsgExecStarted, Args: map[string]string{"pid": strconv.Itoa(pid)}}
+}
+
+// ExecExitedMsg is sent to the client that started a command when it exits
+func ExecExitedMsg(pid, code int) *Message {
+	return &Message{Command: consts.MsgExecExited, Args: map[string]string{"pid": strconv.Itoa(pid),
+		"code": strconv.Itoa(code)}}
+}
+
+// PasswordRequest is a secret that openvpn asks for
+type PasswordRequest struct {
+	// One of the consts.Password kinds
+	Kind string
+	// The name that openvpn uses, like "Private Key"
+	Type         string
+	NeedUsername bool
+	// The question of a challenge, the response is the password
+	Text string
+	// The answer can be shown while it's being typed
+	Echo bool
+	// Dynamic challenges come from the server after the password is checked,
+	// static ones come from the config before it's sent
+	Dynamic bool
+}
+
+func PasswordRequestMsg(req PasswordRequest) *Message {
+	return &Message{Command: consts.MsgPasswordRequest, Args: map[string]string{"kind": req.Kind,
+		"type": req.Type, "need_username": strconv.FormatBool(req.NeedUsername), "text": req.Text,
+		"echo": strconv.FormatBool(req.Echo), "dynamic": strconv.FormatBool(req.Dynamic)}}
+}
+
+// ParsePasswordRequest reads a PASSWORD_REQUEST message
+func ParsePasswordRequest(msg *Message) PasswordRequest {
+	return PasswordRequest{Kind: msg.Args["kind"], Type: msg.Args["type"],
+		NeedUsername: msg.Args["need_username"] == "true", Text: msg.Args["text"],
+		Echo: msg.Args["echo"] == "true", Dynamic: msg.Args["dynamic"] == "true"}
+}
+
+func PasswordResponseMsg(username, password string) *Message {
+	return &Message{Command: consts.MsgPasswordResponse,
+		Args: map[string]string{"username": username, "password": password}}
+}
+
+// SignRequestMsg asks the client to sign base64 data with an algorithm of signer.ParseAlgorithm
+func SignRequestMsg(data, algorithm string) *Message {
+	return &Message{Command: consts.MsgSignRequest, Args: map[string]string{"data": data, "algorithm": algorithm}}
+}
+
+// SignResponseMsg is the base64 signature of a SIGN_REQUEST, or why the client couldn't sign
+func SignResponseMsg(signature, errText string) *Message {
+	return &Message{Command: consts.MsgSignResponse, Args: map[string]string{"signature": signature, "error": errText}}
+}
+
+// PKCS11Cert is a certificate of a token that openvpn can use
+type PKCS11Cert struct {
+	// The serialized id of openvpn, it's stored in the profile
+	ID       string    `json:"id"`
+	Subject  string    `json:"subject"`
+	Issuer   string    `json:"issuer"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+// PKCS11IDRequestMsg asks the client to choose a certificate, the list is JSON
+func PKCS11IDRequestMsg(certs []PKCS11Cert) (*Message, error) {
+	data, err := json.Marshal(certs)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Command: consts.MsgPKCS11IDRequest, Args: map[string]string{"certs": string(data)}}, nil
+}
+
+// ParsePKCS11IDRequest reads the certificates of a PKCS11_ID_REQUEST message
+func ParsePKCS11IDRequest(msg *Message) ([]PKCS11Cert, error) {
+	var certs []PKCS11Cert
+	if err := json.Unmarshal([]byte(msg.Args["certs"]), &certs); err != nil {
+		return nil, errors.New("invalid certificate list")
+	}
+	return certs, nil
+}
+
+func PKCS11IDResponseMsg(id string) *Message {
+	return &Message{Command: consts.MsgPKCS11IDResponse, Args: map[string]string{"id": id}}
+}
+
 func ErrorMsg(msg string) *Message {
-	return &Message{consts.MsgError, map[string]string{"error": msg}}
+	return &Message{Command: consts.MsgError, Args: map[string]string{"error": msg}}
+}
+
+// ErrorCodeMsg is an error that clients can recognize without parsing the text
+func ErrorCodeMsg(code, msg string) *Message {
+	return &Message{Command: consts.MsgError, Args: map[string]string{"error": msg, "code": code}}
+}
+
+func OkMsg() *Message {
+	return &Message{Command: consts.MsgOK}
+}
+
+func HelloMsg() *Message {
+	return &Message{Command: consts.MsgHello,
+		Args: map[string]string{"version": strconv.Itoa(consts.ProtocolVersion)}}
+}
+
+// Reply marks a message as the reply to a request
+func (msg *Message) Reply(req *Message) *Message {
+	msg.ID = req.ID
+	return msg
+}
+
+func DeniedMsg(cmd, reason string) *Message {
+	return &Message{Command: consts.MsgDenied, Args: map[string]string{"cmd": cmd, "reason": reason}}
+}
+
+func LogsMsg(lines []string) *Message {
+	return &Message{Command: consts.MsgLogs, Args: map[string]string{"logs": strings.Join(lines, "\n")}}
 }
 
 func LogMsg(msg string) *Message {
-	return &Message{consts.MsgLog, map[string]string{"log": msg}}
+	return &Message{Command: consts.MsgLog, Args: map[string]string{"log": msg}}
 }
@@ -0,0 +1,209 @@
+package ovpn
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/TheWeirdDev/Vodga/shared/utils"
+	"io"
+	"strings"
+)
+
+// InlineTags are the blocks that openvpn reads inline instead of from a file.
+// The content of <connection> blocks is a config itself
+var InlineTags = map[string]bool{
+	"ca":                   true,
+	"cert":                 true,
+	"key":                  true,
+	"extra-certs":          true,
+	"pkcs12":               true,
+	"dh":                   true,
+	"crl-verify":           true,
+	"secret":               true,
+	"tls-auth":             true,
+	"tls-crypt":            true,
+	"tls-crypt-v2":         true,
+	"auth-user-pass":       true,
+	"http-proxy-user-pass": true,
+	"connection":           true,
+}
+
+// Directive is an option of a config or an inline block like <ca>
+type Directive struct {
+	Name string
+	Args []string
+	// The lines of the directive in the config, they are different for inline blocks
+	Line    int
+	EndLine int
+	// Inline blocks have the file between their tags as Content
+	Inline  bool
+	Content string
+	// The directives of a <connection> block
+	Children []Directive
+}
+
+// String writes the directive back in the config format
+func (d Directive) String() string {
+	if d.Inline {
+		content := d.Content
+		if content != "" && !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		return "<" + d.Name + ">\n" + content + "</" + d.Name + ">"
+	}
+	words := []string{d.Name}
+	for _, arg := range d.Args {
+		words = append(words, utils.OpenvpnEscape(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+// File is a parsed config, every directive is kept in order
+type File struct {
+	Directives []Directive
+}
+
+// Find returns the directives with a name in their order
+func (f *File) Find(name string) []Directive {
+	var found []Directive
+	for _, d := range f.Directives {
+		if d.Name == name {
+			found = append(found, d)
+		}
+	}
+	return found
+}
+
+// Flatten returns the directives with the ones of <connection> blocks in place of the blocks
+func (f *File) Flatten() []Directive {
+	var all []Directive
+	for _, d := range f.Directives {
+		if d.Name == "connection" {
+			all = append(all, d.Children...)
+		} else {
+			all = append(all, d)
+		}
+	}
+	return all
+}
+
+// Error points to the line of a config that openvpn can't read
+type Error struct {
+	Line int
+	Err  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+// inlineTag returns the tag of an opening line like <ca>, openvpn only
+// reads a block when the tag is the only argument of its line
+func inlineTag(args []string) (string, bool) {
+	if len(args) != 1 || len(args[0]) < 3 || args[0][0] != '<' || args[0][1] == '/' ||
+		args[0][len(args[0])-1] != '>' {
+		return "", false
+	}
+	return args[0][1 : len(args[0])-1], true
+}
+
+// Parse reads a config with the grammar of openvpn
+func Parse(r io.Reader) (*File, error) {
+	lines, err := readLines(r)
+	if err != nil {
+		return nil, err
+	}
+	directives, err := parseLines(lines, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &File{Directives: directives}, nil
+}
+
+// Rewrite parses a config and replaces the lines of its directives with what edit returns,
+// an empty replacement removes a directive. Comments, empty lines and the directives that
+// edit keeps are written as they were. Directives of <connection> blocks are not passed to edit
+func Rewrite(data []byte, edit func(d Directive) (replacement []string, keep bool)) ([]byte, error) {
+	lines, err := readLines(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	directives, err := parseLines(lines, 1)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	next := 0
+	for _, d := range directives {
+		replacement, keep := edit(d)
+		if keep {
+			continue
+		}
+		for ; next < d.Line-1; next++ {
+			out.WriteString(lines[next] + "\n")
+		}
+		for _, line := range replacement {
+			out.WriteString(line + "\n")
+		}
+		next = d.EndLine
+	}
+	for ; next < len(lines); next++ {
+		out.WriteString(lines[next] + "\n")
+	}
+	return out.Bytes(), nil
+}
+
+func readLines(r io.Reader) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	lines := []string{}
+	for scanner.Scan() {
+		// Configs from Windows end their lines with \r\n
+		lines = append(lines, strings.TrimSuffix(scanner.Text(), "\r"))
+	}
+	return lines, scanner.Err()
+}
+
+// parseLines parses the lines of a config or a <connection> block, first is the number of the first line
+func parseLines(lines []string, first int) ([]Directive, error) {
+	var directives []Directive
+	for i := 0; i < len(lines); i++ {
+		lineNum := first + i
+		args, err := SplitLine(lines[i])
+		if err != nil {
+			return nil, &Error{Line: lineNum, Err: err.Error()}
+		}
+		if len(args) == 0 {
+			continue
+		}
+		tag, ok := inlineTag(args)
+		if !ok {
+			directives = append(directives, Directive{Name: strings.TrimPrefix(args[0], "--"), Args: args[1:],
+				Line: lineNum, EndLine: lineNum})
+			continue
+		}
+		if !InlineTags[tag] {
+			return nil, &Error{Line: lineNum, Err: fmt.Sprintf("<%s> is not an inline block", tag)}
+		}
+
+		// The block ends at the line that starts with the closing tag, like openvpn does
+		end := i + 1
+		for end < len(lines) && !strings.HasPrefix(strings.TrimLeft(lines[end], " \t"), "</"+tag+">") {
+			end++
+		}
+		if end == len(lines) {
+			return nil, &Error{Line: lineNum, Err: fmt.Sprintf("<%s> is not closed", tag)}
+		}
+		d := Directive{Name: tag, Line: lineNum, EndLine: first + end, Inline: true}
+		if end > i+1 {
+			d.Content = strings.Join(lines[i+1:end], "\n") + "\n"
+		}
+		if tag == "connection" {
+			if d.Children, err = parseLines(lines[i+1:end], lineNum+1); err != nil {
+				return nil, err
+			}
+		}
+		directives = append(directives, d)
+		i = end
+	}
+	return directives, nil
+}
@@ -0,0 +1,129 @@
+// Package ovpn reads openvpn configs with the grammar of openvpn
+package ovpn
+
+import (
+	"errors"
+	"strings"
+)
+
+// Lexer states, they are the ones of parse_line in openvpn
+const (
+	stateInitial = iota
+	stateUnquoted
+	stateQuoted
+	stateSingleQuoted
+)
+
+func isSpace(c rune) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+// SplitLine splits a config line into its arguments like openvpn does.
+// Arguments are separated by spaces, "double quotes" allow spaces and backslash escapes,
+// 'single quotes' take everything literally and # or ; start a comment between arguments.
+// A backslash escapes a backslash, a double quote or a space, an escaped # or ; between arguments is still a comment
+func SplitLine(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	state := stateInitial
+	backslash := false
+
+	for _, c := range line {
+		if !backslash && c == '\\' && state != stateSingleQuoted {
+			backslash = true
+			continue
+		}
+		if backslash {
+			backslash = false
+			if state == stateInitial && (c == '#' || c == ';') {
+				return args, nil
+			}
+			if c != '\\' && c != '"' && !isSpace(c) {
+				return nil, errors.New("bad backslash usage, backslashes must be escaped with another backslash")
+			}
+			if state == stateInitial {
+				// openvpn skips escaped spaces between arguments
+				if isSpace(c) {
+					continue
+				}
+				state = stateUnquoted
+			}
+			arg.WriteRune(c)
+			continue
+		}
+		switch state {
+		case stateInitial:
+			switch {
+			case isSpace(c):
+			case c == '#' || c == ';':
+				return args, nil
+			case c == '"':
+				state = stateQuoted
+			case c == '\'':
+				state = stateSingleQuoted
+			default:
+				state = stateUnquoted
+				arg.WriteRune(c)
+			}
+		case stateUnquoted:
+			if isSpace(c) {
+				args = append(args, arg.String())
+				arg.Reset()
+				state = stateInitial
+			} else {
+				arg.WriteRune(c)
+			}
+		case stateQuoted:
+			if c == '"' {
+				args = append(args, arg.String())
+				arg.Reset()
+				state = stateInitial
+			} else {
+				arg.WriteRune(c)
+			}
+		case stateSingleQuoted:
+			if c == '\'' {
+				args = append(args, arg.String())
+				arg.Reset()
+				state = stateInitial
+			} else {
+				arg.WriteRune(c)
+			}
+		}
+	}
+
+	switch {
+	case backslash:
+		return nil, errors.New("the line ends with a backslash")
+	case state == stateQuoted:
+		return nil, errors.New("no closing quotation (\")")
+	case state == stateSingleQuoted:
+		return nil, errors.New("no closing single quotation (')")
+	case state == stateUnquoted:
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// Unescape returns the value of a single argument, it's the inverse of utils.OpenvpnEscape.
+// \n is the newline of OpenvpnEscape, openvpn doesn't read it so it's replaced before the argument is split
+func Unescape(escaped string) (string, error) {
+	var line strings.Builder
+	backslash := false
+	for _, c := range escaped {
+		if backslash && c == 'n' {
+			// An escaped newline is kept like an escaped space
+			c = '\n'
+		}
+		line.WriteRune(c)
+		backslash = !backslash && c == '\\'
+	}
+	args, err := SplitLine(line.String())
+	if err != nil {
+		return "", err
+	}
+	if len(args) != 1 {
+		return "", errors.New("not a single argument")
+	}
+	return args[0], nil
+}
@@ -0,0 +1,128 @@
+package ovpn
+
+import (
+	"github.com/TheWeirdDev/Vodga/shared/utils"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"remote vpn.example.com 1194 udp", []string{"remote", "vpn.example.com", "1194", "udp"}},
+		{"  verb\t3  # loud", []string{"verb", "3"}},
+		{"; remote commented", nil},
+		{"setenv NAME \"two words\"", []string{"setenv", "NAME", "two words"}},
+		{"ca 'C:\\certs\\ca.crt'", []string{"ca", "C:\\certs\\ca.crt"}},
+		{"ca C:\\\\certs\\\\ca.crt", []string{"ca", "C:\\certs\\ca.crt"}},
+		{"auth-user-pass my\\ file#1", []string{"auth-user-pass", "my file#1"}},
+		{"\"up\" /bin/sh", []string{"up", "/bin/sh"}},
+		{"pkcs11-id \"a\\\"b\" ''", []string{"pkcs11-id", "a\"b", ""}},
+		{"verb 3 \\# loud", []string{"verb", "3"}},
+		{"\\; remote commented", nil},
+	}
+	for _, test := range tests {
+		got, err := SplitLine(test.line)
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("SplitLine(%q) = %q, %v, want %q", test.line, got, err, test.want)
+		}
+	}
+	for _, line := range []string{"ca \"ca.crt", "ca 'ca.crt", "ca C:\\certs", "ca ca.crt\\", "ca \"ca\\n.crt\"",
+		"verb 3\\#"} {
+		if _, err := SplitLine(line); err == nil {
+			t.Errorf("SplitLine(%q) didn't fail", line)
+		}
+	}
+}
+
+func TestUnescape(t *testing.T) {
+	for _, value := range []string{"plain", "", "two words", "a\"quote", "back\\slash", "new\nline", "#hash", "semi;"} {
+		got, err := Unescape(utils.OpenvpnEscape(value))
+		if err != nil || got != value {
+			t.Errorf("Unescape(OpenvpnEscape(%q)) = %q, %v", value, got, err)
+		}
+	}
+	if got, err := Unescape("\"a\\\\nb\""); err != nil || got != "a\\nb" {
+		t.Errorf("an escaped backslash before n was unescaped to %q, %v", got, err)
+	}
+	if _, err := Unescape("two words"); err == nil {
+		t.Error("two arguments were unescaped as one")
+	}
+}
+
+func TestParse(t *testing.T) {
+	config := "client\n" +
+		"--remote vpn.example.com 1194\n" +
+		"<tls-crypt>\n" +
+		"# 2048 bit OpenVPN static key\n" +
+		"KEY\n" +
+		"  </tls-crypt> trailing\n" +
+		"<connection>\n" +
+		"remote 192.0.2.1 443 tcp\n" +
+		"</connection>\n" +
+		"<auth-user-pass>\n" +
+		"</auth-user-pass>\n"
+	file, err := Parse(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, d := range file.Directives {
+		names = append(names, d.Name)
+	}
+	if want := []string{"client", "remote", "tls-crypt", "connection", "auth-user-pass"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("directives = %q, want %q", names, want)
+	}
+	remote := file.Find("remote")[0]
+	if remote.Line != 2 || !reflect.DeepEqual(remote.Args, []string{"vpn.example.com", "1194"}) {
+		t.Errorf("wrong remote %+v", remote)
+	}
+	block := file.Directives[2]
+	if !block.Inline || block.Line != 3 || block.EndLine != 6 || block.Content != "# 2048 bit OpenVPN static key\nKEY\n" {
+		t.Errorf("wrong block %+v", block)
+	}
+	conn := file.Directives[3]
+	if len(conn.Children) != 1 || conn.Children[0].Name != "remote" || conn.Children[0].Line != 8 {
+		t.Errorf("wrong connection block %+v", conn)
+	}
+	if file.Directives[4].Content != "" || file.Directives[4].String() != "<auth-user-pass>\n</auth-user-pass>" {
+		t.Errorf("wrong empty block %+v", file.Directives[4])
+	}
+	if got := (Directive{Name: "setenv", Args: []string{"NAME", "two words"}}).String(); got != "setenv NAME \"two words\"" {
+		t.Errorf("String() = %q", got)
+	}
+
+	for config, line := range map[string]int{
+		"client\n<ca>\nCA\n":                2,
+		"client\n<script>\nrm\n</script>\n": 2,
+		"client\nca \"ca.crt\n":             2,
+	} {
+		_, err := Parse(strings.NewReader(config))
+		if parseErr, ok := err.(*Error); !ok || parseErr.Line != line {
+			t.Errorf("Parse(%q) = %v, want an error at line %d", config, err, line)
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	config := "client\n# a comment\nkey client.key\n<key>\nKEY\n</key>\nremote a.example.com 1194\n\n<ca>\nremote inline\n</ca>\n"
+	got, err := Rewrite([]byte(config), func(d Directive) ([]string, bool) {
+		switch d.Name {
+		case "key":
+			return nil, false
+		case "remote":
+			return []string{"remote 192.0.2.1 1194", "remote 192.0.2.2 1194"}, false
+		}
+		return nil, true
+	})
+	want := "client\n# a comment\nremote 192.0.2.1 1194\nremote 192.0.2.2 1194\n\n<ca>\nremote inline\n</ca>\n"
+	if err != nil || string(got) != want {
+		t.Errorf("Rewrite() = %q, %v, want %q", got, err, want)
+	}
+	if _, err := Rewrite([]byte("<ca>\nCA\n"), func(Directive) ([]string, bool) { return nil, true }); err == nil {
+		t.Error("an unclosed block was rewritten")
+	}
+}
@@ -0,0 +1,521 @@
+package profiles
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/TheWeirdDev/Vodga/shared/auth"
+	"github.com/TheWeirdDev/Vodga/shared/ovpn"
+	"github.com/TheWeirdDev/Vodga/shared/utils"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Proto string
+
+const (
+	UDP       Proto = "udp"
+	TCP       Proto = "tcp"
+	UDP4      Proto = "udp4"
+	UDP6      Proto = "udp6"
+	TCP4      Proto = "tcp4"
+	TCP6      Proto = "tcp6"
+	TCPClient Proto = "tcp-client"
+)
+
+// Transport returns "udp" or "tcp"
+func (p Proto) Transport() string {
+	return strings.TrimRight(strings.TrimSuffix(string(p), "-client"), "46")
+}
+
+// Family returns "4" or "6" if the protocol is limited to one address family, or ""
+func (p Proto) Family() string {
+	proto := strings.TrimSuffix(string(p), "-client")
+	if strings.HasSuffix(proto, "4") || strings.HasSuffix(proto, "6") {
+		return proto[len(proto)-1:]
+	}
+	return ""
+}
+
+// Allows tells if the protocol can connect to an address
+func (p Proto) Allows(ip net.IP) bool {
+	switch p.Family() {
+	case "4":
+		return ip.To4() != nil
+	case "6":
+		return ip.To4() == nil
+	}
+	return true
+}
+
+type Remote struct {
+	IPs        []string
+	Hostname   string
+	Country    string
+	CountryISO string
+	Port       uint
+	Proto      Proto
+}
+
+type Config struct {
+	Path    string
+	Remotes []Remote
+	Random  bool
+	Proto   Proto
+	Creds   auth.Credentials
+	CA      string
+	Cert    string
+	Key     string
+	TLSAuth string
+	// The libraries of the PKCS#11 tokens that hold the cert and the key
+	PKCS11Providers []string
+	// The certificate in the tokens, it's moved to the profile on import
+	PKCS11ID string
+	// The http-proxy or socks-proxy of the config, it's moved to the profile on import
+	Proxy *UpstreamProxy
+	// The other files of the config by their option, like tls-crypt, they are inlined by Render
+	Files map[string]string
+	Other string
+}
+
+// The options that name a file, the files are inlined by Render
+var fileOptions = map[string]bool{
+	"ca": true, "cert": true, "key": true, "tls-auth": true,
+	"extra-certs": true, "pkcs12": true, "dh": true, "crl-verify": true, "secret": true,
+	"tls-crypt": true, "tls-crypt-v2": true,
+}
+
+// setFile stores the content of a file option
+func (cfg *Config) setFile(option, data string) {
+	switch option {
+	case "ca":
+		cfg.CA = data
+	case "cert":
+		cfg.Cert = data
+	case "key":
+		cfg.Key = data
+	case "tls-auth":
+		cfg.TLSAuth = data
+	default:
+		if cfg.Files == nil {
+			cfg.Files = map[string]string{}
+		}
+		cfg.Files[option] = data
+	}
+}
+
+// ParseProto returns the protocols that openvpn accepts in client mode as they are, or ""
+func ParseProto(p string) Proto {
+	switch Proto(p) {
+	case UDP, UDP4, UDP6, TCP, TCP4, TCP6, TCPClient, "tcp4-client", "tcp6-client":
+		return Proto(p)
+	default:
+		return ""
+	}
+}
+
+// ParseRemote parses a 'remote' option without resolving its hostname.
+// IPs is only set if the remote is an IP address
+func ParseRemote(line string) (Remote, error) {
+	fields, err := ovpn.SplitLine(line)
+	if err != nil {
+		return Remote{}, err
+	}
+	if len(fields) < 2 {
+		return Remote{}, errors.New("unknown remote option")
+	}
+	return parseRemoteArgs(fields[1:])
+}
+
+// parseRemoteArgs parses the arguments of a 'remote' option: host [port [proto]]
+func parseRemoteArgs(args []string) (Remote, error) {
+	rmt := Remote{}
+	if len(args) < 1 {
+		return rmt, errors.New("unknown remote option")
+	}
+	if net.ParseIP(args[0]) != nil {
+		rmt.IPs = []string{args[0]}
+	} else {
+		rmt.Hostname = args[0]
+	}
+
+	// port is provided in remote option
+	if len(args) >= 2 {
+		port, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return Remote{}, err
+		}
+		rmt.Port = uint(port)
+	}
+
+	// proto is provided in remote option
+	if len(args) >= 3 {
+		rmt.Proto = ParseProto(args[2])
+		if rmt.Proto == "" {
+			return Remote{}, errors.New("unknown protocol")
+		}
+	}
+	return rmt, nil
+}
+
+// Parses the arguments of a 'remote' option into a struct, with its IPs and country
+func getRemote(args []string) (Remote, error) {
+	rmt, err := parseRemoteArgs(args)
+	if err != nil {
+		return rmt, err
+	}
+
+	var ips []net.IP
+	// Lookup ip address if remote is not an IP
+	if rmt.Hostname != "" {
+		addrs, err := net.LookupIP(rmt.Hostname)
+		if err != nil {
+			return rmt, err
+		}
+
+		for _, ip := range addrs {
+			if rmt.Proto.Allows(ip) {
+				ips = append(ips, ip)
+			}
+		}
+	} else {
+		ips = append(ips, net.ParseIP(rmt.IPs[0]))
+	}
+	if len(ips) == 0 {
+		return Remote{}, errors.New("can't resolve domain name")
+	}
+
+	rmt.IPs = nil
+	for _, ip := range ips {
+		rmt.IPs = append(rmt.IPs, ip.String())
+	}
+
+	// Fetch country info from remotes
+	// Only one is needed because we assume all of them are from the same country
+	var country, iso string
+	var geoipErr error
+	for _, ip := range ips {
+		country, iso, geoipErr = utils.GetGeoIPData(ip.String())
+		if geoipErr == nil {
+			rmt.Country = country
+			rmt.CountryISO = iso
+			break
+		}
+	}
+	if geoipErr != nil {
+		rmt.Country = ""
+		rmt.CountryISO = ""
+	}
+	// TODO: Check for empty country field while importing
+	return rmt, nil
+}
+
+// Read credentials from an external text file
+func readCredentials(path string, cfgPath string) (auth.Credentials, error) {
+	f, err := os.Open(path)
+	// If the path doesn't exist, check the relative path
+	if err != nil {
+		cfgPath += string(filepath.Separator)
+		f2, err2 := os.Open(cfgPath + path)
+		if err2 != nil {
+			return auth.Credentials{}, err
+		}
+		f = f2
+	}
+	defer f.Close()
+	return parseCredentials(f)
+}
+
+// parseCredentials reads the username and the password of an auth-user-pass file or block
+func parseCredentials(r io.Reader) (auth.Credentials, error) {
+	scanner := bufio.NewScanner(r)
+	var creds []string
+
+	// The first line is the username (mandatory)
+	// The second line is the password (optional)
+	// The rest of the file will be ignored just like openvpn does
+	for scanner.Scan() {
+		if len(creds) >= 2 {
+			break
+		}
+		text := scanner.Text()
+		creds = append(creds, text)
+	}
+	if err := scanner.Err(); err != nil {
+		return auth.Credentials{}, err
+	}
+	switch len(creds) {
+	case 0:
+		return auth.Credentials{Auth: auth.USER_PASS}, nil
+	case 1:
+		return auth.Credentials{Auth: auth.USER_PASS, Username: creds[0], Password: ""}, nil
+	case 2:
+		return auth.Credentials{Auth: auth.USER_PASS, Username: creds[0], Password: creds[1]}, nil
+	default:
+		return auth.Credentials{}, errors.New("unknown error while reading the credentials")
+	}
+}
+
+// Read external certificates
+func readCert(path string, cfgPath string) (string, error) {
+	f, err := os.Open(path)
+	// check the relative path
+	if err != nil {
+		cfgPath += string(filepath.Separator)
+		f2, err2 := os.Open(cfgPath + path)
+		if err2 != nil {
+			return "", err
+		}
+		f = f2
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// GetConfig reads the configuration file and gather all the info needed
+// and parses it into structures that we can store
+func GetConfig(file string, single bool) (Config, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return Config{}, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return Config{}, err
+	}
+	// The config file size shouldn't be more than "100 KB"
+	if stat.Size() > 100*1024 {
+		return Config{}, errors.New("the file is too big")
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(file))
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg := Config{}
+	cfg.Other = ""
+	cfg.Creds.Auth = auth.NO_AUTH
+
+	isClient := false
+
+	var proxyAuth []string
+
+	parsed, err := ovpn.Parse(f)
+	if err != nil {
+		return Config{}, err
+	}
+	for _, d := range parsed.Directives {
+		args := d.Args
+		if d.Inline {
+			switch d.Name {
+			case "http-proxy-user-pass":
+				proxyAuth = strings.Split(strings.TrimSuffix(d.Content, "\n"), "\n")
+			case "auth-user-pass", "connection":
+				if d.Name == "auth-user-pass" && single {
+					if cfg.Creds, err = parseCredentials(strings.NewReader(d.Content)); err != nil {
+						return Config{}, fmt.Errorf("unable to read the credentials: %v", err)
+					}
+				} else {
+					cfg.Other += d.String() + "\n"
+				}
+			default:
+				cfg.setFile(d.Name, d.Content)
+			}
+			continue
+		}
+
+		// Parse every option we need and save the rest in cfg.Other
+		switch {
+		case d.Name == "remote" && len(args) > 0:
+			rmt, err := getRemote(args)
+			if err != nil {
+				return Config{}, err
+			}
+			cfg.Remotes = append(cfg.Remotes, rmt)
+			if len(rmt.IPs) > 1 {
+				cfg.Random = true
+			}
+		case d.Name == "proto":
+			if len(args) < 1 {
+				return Config{}, errors.New("unknown proto option")
+			}
+			cfg.Proto = ParseProto(args[0])
+		case d.Name == "remote-random":
+			cfg.Random = true
+		case d.Name == "client":
+			isClient = true
+		case d.Name == "auth-user-pass" && single:
+			cfg.Creds = auth.Credentials{Auth: auth.USER_PASS}
+			if len(args) > 0 {
+				if cfg.Creds, err = readCredentials(args[0], dir); err != nil {
+					return Config{}, fmt.Errorf("unable to read the credentials: %v", err)
+				}
+			}
+		case fileOptions[d.Name] && len(args) > 0 &&
+			!(d.Name == "crl-verify" && len(args) > 1) && !(d.Name == "dh" && args[0] == "none"):
+			// A directory of CRLs and 'dh none' can't be inlined, they are kept as they are
+			data, err := readCert(args[0], dir)
+			if err != nil {
+				return Config{}, fmt.Errorf("unable to read the %s file: %v", d.Name, err)
+			}
+			if d.Name == "pkcs12" {
+				// Inline PKCS#12 files are base64 encoded
+				data = base64.StdEncoding.EncodeToString([]byte(data)) + "\n"
+			}
+			cfg.setFile(d.Name, data)
+			// The key direction is lost when the key is inlined, keep it as an option
+			if (d.Name == "tls-auth" || d.Name == "secret") && len(args) >= 2 {
+				cfg.Other += "key-direction " + args[1] + "\n"
+			}
+		case (d.Name == "http-proxy" || d.Name == "socks-proxy") && len(args) > 0:
+			typ := ProxyHTTP
+			if d.Name == "socks-proxy" {
+				typ = ProxySOCKS
+			}
+			proxy, rest, err := parseProxyOption(typ, args)
+			if err != nil {
+				return Config{}, err
+			}
+			// The authfile, 'auto' and 'auto-nct' ask for the credentials when the proxy wants them
+			if len(rest) > 0 {
+				proxy.Auth = true
+				if rest[0] != "stdin" && rest[0] != "auto" && rest[0] != "auto-nct" {
+					creds, err := readCredentials(rest[0], dir)
+					if err != nil {
+						return Config{}, fmt.Errorf("unable to read the proxy credentials: %v", err)
+					}
+					proxy.Username, proxy.Password = creds.Username, creds.Password
+				}
+			}
+			cfg.Proxy = proxy
+		case d.Name == "pkcs11-providers":
+			cfg.PKCS11Providers = append(cfg.PKCS11Providers, args...)
+		case d.Name == "pkcs11-id" && len(args) > 0:
+			cfg.PKCS11ID = args[0]
+		case d.Name == "pkcs11-id-management":
+			// The daemon asks for the id, it's added back by Render
+		case strings.HasPrefix(d.Name, "management"):
+			// Management options conflict with the daemon
+		default:
+			cfg.Other += d.String() + "\n"
+		}
+	}
+	if len(proxyAuth) > 0 && cfg.Proxy != nil {
+		cfg.Proxy.Auth = true
+		cfg.Proxy.Username = proxyAuth[0]
+		if len(proxyAuth) > 1 {
+			cfg.Proxy.Password = proxyAuth[1]
+		}
+	}
+	if !isClient {
+		return Config{}, errors.New("not a client configuration (no 'client' option found)")
+	}
+	cfg.Path = file
+
+ checkProto:
+	if cfg.Proto != "" {
+		// If config has a proto and some of it remotes don't, add it to them
+		for i := range cfg.Remotes {
+			rmt := &cfg.Remotes[i]
+			if rmt.Proto == "" {
+				rmt.Proto = cfg.Proto
+			}
+		}
+	} else {
+		// If config don't have a proto, get it from the first remote that has
+		for _, rmt := range cfg.Remotes {
+			if rmt.Proto != "" {
+				cfg.Proto = rmt.Proto
+				// Now add this proto to other remotes that don't have proto
+				goto checkProto
+			}
+		}
+	}
+	if cfg.CA == "" {
+		return Config{}, errors.New("no 'ca' option specified")
+	}
+	// A cert without a key is used with an external key
+	if cfg.Cert == "" && cfg.Key != "" {
+		return Config{}, errors.New("'key' option needs a 'cert'")
+	}
+	if len(cfg.PKCS11Providers) > 0 && (cfg.Cert != "" || cfg.Key != "") {
+		return Config{}, errors.New("'pkcs11-providers' can't be used with 'cert' or 'key'")
+	}
+	if len(cfg.Remotes) == 0 || cfg.Proto == "" {
+		return Config{}, errors.New("no 'remote' or 'proto' option specified")
+	}
+	return cfg, nil
+}
+
+// Render writes the config back in the openvpn format, with every file inlined
+func (cfg Config) Render() string {
+	var b strings.Builder
+	b.WriteString("client\n")
+	for _, rmt := range cfg.Remotes {
+		host := rmt.Hostname
+		if host == "" && len(rmt.IPs) > 0 {
+			host = rmt.IPs[0]
+		}
+		b.WriteString("remote " + host)
+		if rmt.Port != 0 {
+			b.WriteString(" " + strconv.FormatUint(uint64(rmt.Port), 10))
+			if rmt.Proto != "" {
+				b.WriteString(" " + string(rmt.Proto))
+			}
+		}
+		b.WriteString("\n")
+	}
+	if cfg.Random {
+		b.WriteString("remote-random\n")
+	}
+	if cfg.Proto != "" {
+		b.WriteString("proto " + string(cfg.Proto) + "\n")
+	}
+	// Credentials are given to openvpn by the daemon
+	if cfg.Creds.Auth == auth.USER_PASS {
+		b.WriteString("auth-user-pass\n")
+	}
+	if len(cfg.PKCS11Providers) > 0 {
+		// The certificate is chosen through the daemon, so the profile can change it
+		b.WriteString("pkcs11-providers " + strings.Join(cfg.PKCS11Providers, " ") + "\n")
+		b.WriteString("pkcs11-id-management\n")
+	}
+	b.WriteString(cfg.Other)
+
+	inline := []struct{ tag, data string }{
+		{"ca", cfg.CA}, {"cert", cfg.Cert}, {"key", cfg.Key}, {"tls-auth", cfg.TLSAuth},
+	}
+	var options []string
+	for option := range cfg.Files {
+		options = append(options, option)
+	}
+	sort.Strings(options)
+	for _, option := range options {
+		inline = append(inline, struct{ tag, data string }{option, cfg.Files[option]})
+	}
+	for _, block := range inline {
+		if block.data == "" {
+			continue
+		}
+		b.WriteString("<" + block.tag + ">\n" + block.data)
+		if !strings.HasSuffix(block.data, "\n") {
+			b.WriteString("\n")
+		}
+		b.WriteString("</" + block.tag + ">\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,196 @@
+package profiles
+
+import (
+	"github.com/TheWeirdDev/Vodga/shared/auth"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestGetConfig(t *testing.T) {
+	cfg, err := GetConfig("data/test/config_test.ovpn", true)
+
+	if err != nil {
+		t.Errorf("Test #1 failed: %v", err.Error())
+	}
+	if cfg.Proto != UDP {
+		t.Errorf("Test #1 failed: proto mismatch")
+	}
+	if len(cfg.Remotes) < 1 {
+		t.Errorf("Test #1 failed: remote not found")
+	} else {
+		if cfg.Remotes[0].Port != 2744 || cfg.Remotes[0].Proto != UDP {
+			t.Errorf("Test #1 failed: remote port or proto mismatch")
+		}
+		if cfg.Remotes[0].Hostname != "freedome-at-gw.freedome-vpn.net" {
+			t.Errorf("Test #1 failed: hostname mismatch")
+		}
+		if len(cfg.Remotes[0].IPs) != 3 {
+			t.Errorf("Test #1 Failed: invalid ips")
+		}
+
+		for _,ip := range cfg.Remotes[0].IPs {
+			match, _ := regexp.MatchString("^188\\.172\\.220\\.(70|71|69)$", ip)
+			if !match {
+				t.Errorf("Test #1 failed: ip mismatch")
+			}
+		}
+	}
+	if !cfg.Random {
+		t.Errorf("Test #1 failed: random should be true")
+	}
+	if cfg.Creds.Auth != auth.NO_AUTH {
+		t.Errorf("Test #1 failed: auth method is wrong")
+	}
+	//fmt.Printf("%v\n", cfg.Remotes)
+}
+
+func TestGetConfigWithCredentials(t *testing.T) {
+
+	cfg, err := GetConfig("data/test/config_test2.ovpn", true)
+
+	if err != nil {
+		t.Errorf("Test #2 failed: %v", err.Error())
+	}
+
+	if cfg.Creds.Auth != auth.USER_PASS {
+		t.Errorf("Test #2 failed: auth method is wrong")
+	}
+	if cfg.Creds.Username != "test_username" || cfg.Creds.Password != "test_password" {
+		t.Errorf("Test #2 failed: wrong credentials")
+	}
+	if !strings.Contains(cfg.CA, "TESTTESTTEST") {
+		t.Errorf("Test #2 failed: wrong ca")
+	}
+	if !strings.Contains(cfg.Cert, "TESTCERTTESTCERT") {
+		t.Errorf("Test #2 failed: wrong cert")
+	}
+	if !strings.Contains(cfg.Key, "TESTKEYTESTKEY") {
+		t.Errorf("Test #2 failed: wrong key")
+	}
+	if cfg.TLSAuth == "" {
+		t.Errorf("Test #2 failed: wrong tls auth")
+	}
+	//fmt.Printf("%v\n", cfg.Remotes)
+}
+
+func TestParseRemote(t *testing.T) {
+	rmt, err := ParseRemote("remote 2001:db8::1 1194 udp6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rmt.IPs) != 1 || rmt.IPs[0] != "2001:db8::1" || rmt.Port != 1194 || rmt.Proto != UDP6 {
+		t.Errorf("wrong remote: %+v", rmt)
+	}
+	if rmt.Proto.Transport() != "udp" || rmt.Proto.Family() != "6" {
+		t.Errorf("wrong protocol: %s %s", rmt.Proto.Transport(), rmt.Proto.Family())
+	}
+	rmt, err = ParseRemote("remote vpn.example.com 443 tcp-client")
+	if err != nil || rmt.Hostname != "vpn.example.com" || rmt.Proto.Transport() != "tcp" || rmt.Proto.Family() != "" {
+		t.Errorf("wrong remote: %+v, %v", rmt, err)
+	}
+	if _, err := ParseRemote("remote vpn.example.com 443 sctp"); err == nil {
+		t.Error("an unknown protocol was accepted")
+	}
+}
+
+func TestGetConfigPKCS11(t *testing.T) {
+	cfg, err := GetConfig("data/test/config_pkcs11.ovpn", true)
+	if err != nil {
+		t.Fatalf("PKCS#11 configs need no cert and key: %v", err)
+	}
+	if len(cfg.PKCS11Providers) != 1 || cfg.PKCS11Providers[0] != "/usr/lib/opensc-pkcs11.so" {
+		t.Errorf("wrong providers: %q", cfg.PKCS11Providers)
+	}
+	if cfg.PKCS11ID != `piv_II/PKCS\x2315\x20emulated/0123456789abcdef/PIV_II/01` {
+		t.Errorf("wrong id: %q", cfg.PKCS11ID)
+	}
+	// The id is stored in the profile, openvpn asks for it
+	rendered := cfg.Render()
+	if strings.Contains(rendered, "pkcs11-id ") || !strings.Contains(rendered, "pkcs11-id-management\n") ||
+		!strings.Contains(rendered, "pkcs11-providers /usr/lib/opensc-pkcs11.so\n") {
+		t.Errorf("wrong config:\n%s", rendered)
+	}
+}
+
+func TestGetConfigProxy(t *testing.T) {
+	cfg, err := GetConfig("data/test/config_proxy.ovpn", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := UpstreamProxy{Type: ProxyHTTP, Host: "proxy.example.com", Port: 3128, Auth: true,
+		Username: "alice", Password: "secret"}
+	if cfg.Proxy == nil || *cfg.Proxy != want {
+		t.Errorf("wrong proxy: %+v", cfg.Proxy)
+	}
+	// The proxy is in the profile, the daemon gives it to openvpn
+	if strings.Contains(cfg.Other, "http-proxy ") || strings.Contains(cfg.Render(), "secret") {
+		t.Errorf("the proxy is still in the config:\n%s", cfg.Other)
+	}
+	if !strings.Contains(cfg.Other, "http-proxy-retry\n") {
+		t.Errorf("other proxy options are lost:\n%s", cfg.Other)
+	}
+
+	proxy, rest, err := parseProxyOption(ProxySOCKS, []string{"10.0.0.1"})
+	if err != nil || *proxy != (UpstreamProxy{Type: ProxySOCKS, Host: "10.0.0.1", Port: 1080}) || len(rest) != 0 {
+		t.Errorf("parseProxyOption() = %+v, %q, %v", proxy, rest, err)
+	}
+	args := map[string]string{}
+	want.AddArgs(args)
+	if got, err := UpstreamFromArgs(args); err != nil || *got != want {
+		t.Errorf("UpstreamFromArgs() = %+v, %v", got, err)
+	}
+}
+
+func TestGetConfigInline(t *testing.T) {
+	cfg, err := GetConfig("data/test/config_inline.ovpn", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Remotes) != 1 || cfg.Remotes[0].Proto != UDP || cfg.Proto != UDP {
+		t.Errorf("wrong remotes: %+v", cfg.Remotes)
+	}
+	if cfg.Creds != (auth.Credentials{Auth: auth.USER_PASS, Username: "alice", Password: "secret"}) {
+		t.Errorf("wrong credentials: %+v", cfg.Creds)
+	}
+	if !strings.Contains(cfg.Files["tls-crypt"], "TESTKEYTESTKEY") || cfg.Files["extra-certs"] != "EXTRA\n" {
+		t.Errorf("wrong files: %q", cfg.Files)
+	}
+	want := "verb 3\nsetenv FRIENDLY_NAME \"Test server\"\ncrl-verify /etc/openvpn/crl dir\n"
+	if cfg.Other != want {
+		t.Errorf("Other = %q, want %q", cfg.Other, want)
+	}
+	rendered := cfg.Render()
+	if !strings.Contains(rendered, "<extra-certs>\nEXTRA\n</extra-certs>\n<tls-crypt>\n") {
+		t.Errorf("the files are not inlined:\n%s", rendered)
+	}
+}
+
+func TestLoadBrokenStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vodga-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldData, oldConfigs := dataPath, configsDir
+	defer func() {
+		dataPath, configsDir = oldData, oldConfigs
+	}()
+	dataPath, configsDir = filepath.Join(dir, "vodga.json"), filepath.Join(dir, "configs")+"/"
+
+	if data, err := Load(); err != nil || len(data.Singles) != 0 {
+		t.Fatalf("Load() of a new store = %+v, %v", data, err)
+	}
+	if err := ioutil.WriteFile(dataPath, []byte(`{"singles": [`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(); err == nil {
+		t.Error("a broken store was read as an empty one")
+	}
+	if contents, _ := ioutil.ReadFile(dataPath); string(contents) != `{"singles": [` {
+		t.Errorf("the broken store was changed: %q", contents)
+	}
+}
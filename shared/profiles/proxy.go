@@ -0,0 +1,116 @@
+package profiles
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ProxyType is the protocol of an upstream proxy
+type ProxyType string
+
+const (
+	ProxyHTTP  ProxyType = "http"
+	ProxySOCKS ProxyType = "socks"
+)
+
+// UpstreamProxy is a proxy that openvpn reaches the server through, like the egress proxy of a company
+type UpstreamProxy struct {
+	Type ProxyType `json:"type"`
+	Host string    `json:"host"`
+	Port uint16    `json:"port"`
+	// The proxy needs a username and a password, they are asked when they are empty
+	Auth     bool   `json:"auth,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// ParseProxyType converts a command line value into a proxy type
+func ParseProxyType(s string) (ProxyType, error) {
+	switch typ := ProxyType(strings.ToLower(s)); typ {
+	case ProxyHTTP, ProxySOCKS:
+		return typ, nil
+	}
+	return "", fmt.Errorf("unknown proxy type \"%s\", it should be http or socks", s)
+}
+
+// String is the address of the proxy as a URL
+func (p UpstreamProxy) String() string {
+	user := ""
+	if p.Username != "" {
+		user = p.Username + "@"
+	}
+	return fmt.Sprintf("%s://%s%s:%d", p.Type, user, p.Host, p.Port)
+}
+
+// AddArgs adds the proxy to the arguments of CONNECT
+func (p UpstreamProxy) AddArgs(args map[string]string) {
+	args["upstream_type"] = string(p.Type)
+	args["upstream_host"] = p.Host
+	args["upstream_port"] = strconv.Itoa(int(p.Port))
+	if p.Auth {
+		args["upstream_auth"] = "true"
+		args["upstream_username"] = p.Username
+		args["upstream_password"] = p.Password
+	}
+}
+
+// UpstreamFromArgs reads the proxy of CONNECT, nil if there's none
+func UpstreamFromArgs(args map[string]string) (*UpstreamProxy, error) {
+	if args["upstream_type"] == "" {
+		return nil, nil
+	}
+	typ, err := ParseProxyType(args["upstream_type"])
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(args["upstream_port"], 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("invalid proxy port %q", args["upstream_port"])
+	}
+	if !ValidHost(args["upstream_host"]) {
+		return nil, fmt.Errorf("invalid proxy host %q", args["upstream_host"])
+	}
+	return &UpstreamProxy{Type: typ, Host: args["upstream_host"], Port: uint16(port),
+		Auth: args["upstream_auth"] == "true", Username: args["upstream_username"],
+		Password: args["upstream_password"]}, nil
+}
+
+// ValidHost tells if a host is an IP address or a hostname, they are written into configs and commands of openvpn
+func ValidHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseProxyOption reads the arguments of an http-proxy or socks-proxy option, the ones after the port
+// are returned. openvpn uses 1080 for SOCKS proxies without a port
+func parseProxyOption(typ ProxyType, args []string) (*UpstreamProxy, []string, error) {
+	if !ValidHost(args[0]) {
+		return nil, nil, fmt.Errorf("invalid proxy host %q", args[0])
+	}
+	proxy := &UpstreamProxy{Type: typ, Host: args[0], Port: 1080}
+	if len(args) < 2 {
+		if typ == ProxyHTTP {
+			return nil, nil, errors.New("http-proxy needs a port")
+		}
+		return proxy, nil, nil
+	}
+	port, err := strconv.ParseUint(args[1], 10, 16)
+	if err != nil || port == 0 {
+		return nil, nil, fmt.Errorf("invalid proxy port %q", args[1])
+	}
+	proxy.Port = uint16(port)
+	return proxy, args[2:], nil
+}
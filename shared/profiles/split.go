@@ -0,0 +1,87 @@
+package profiles
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// SplitMode selects which destinations go through the tunnel
+type SplitMode string
+
+const (
+	// SplitOnly sends only the destinations of the rules through the tunnel
+	SplitOnly SplitMode = "only"
+	// SplitExcept sends everything through the tunnel, except the destinations of the rules
+	SplitExcept SplitMode = "except"
+)
+
+// SplitTunnel is the split tunneling setting of a config
+type SplitTunnel struct {
+	Mode SplitMode `json:"mode"`
+	// CIDRs, addresses or domain names
+	Rules []string `json:"rules"`
+}
+
+// ParseSplitMode converts a command line value into a mode
+func ParseSplitMode(s string) (SplitMode, error) {
+	switch mode := SplitMode(s); mode {
+	case SplitOnly, SplitExcept:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown split tunneling mode \"%s\"", s)
+	}
+}
+
+// SplitRuleCIDR returns the range of a rule, addresses are a single host.
+// ok is false if the rule is a domain name
+func SplitRuleCIDR(rule string) (*net.IPNet, bool) {
+	if _, cidr, err := net.ParseCIDR(rule); err == nil {
+		return cidr, true
+	}
+	if ip := net.ParseIP(rule); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, true
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, true
+	}
+	return nil, false
+}
+
+// CheckSplitRule returns an error if a rule is not a CIDR, an address or a domain name
+func CheckSplitRule(rule string) error {
+	if _, ok := SplitRuleCIDR(rule); ok {
+		return nil
+	}
+	if len(rule) == 0 || len(rule) > 253 || strings.HasPrefix(rule, ".") || strings.Contains(rule, "..") {
+		return fmt.Errorf("invalid split tunneling rule \"%s\"", rule)
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(rule, "."), ".") {
+		if len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return fmt.Errorf("invalid split tunneling rule \"%s\"", rule)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return fmt.Errorf("invalid split tunneling rule \"%s\"", rule)
+			}
+		}
+	}
+	return nil
+}
+
+// Check validates the mode and the rules
+func (s SplitTunnel) Check() error {
+	if _, err := ParseSplitMode(string(s.Mode)); err != nil {
+		return err
+	}
+	if len(s.Rules) == 0 {
+		return errors.New("split tunneling needs at least one rule")
+	}
+	for _, rule := range s.Rules {
+		if err := CheckSplitRule(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
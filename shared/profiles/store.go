@@ -0,0 +1,282 @@
+package profiles
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TheWeirdDev/Vodga/shared/auth"
+	"github.com/TheWeirdDev/Vodga/shared/reconnect"
+	"github.com/TheWeirdDev/Vodga/shared/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type Cfg struct {
+	Name  string           `json:"name"`
+	Creds auth.Credentials `json:"creds"`
+}
+
+type SingleCfg struct {
+	Cfg
+	Port       uint   `json:"port"`
+	Proto      Proto  `json:"proto"`
+	Country    string `json:"country"`
+	CountryISO string `json:"country_iso"`
+	// nil uses reconnect.Default
+	Reconnect *reconnect.Policy `json:"reconnect,omitempty"`
+	// Block all traffic outside the tunnel, except for the LAN ranges
+	KillSwitch bool     `json:"kill_switch,omitempty"`
+	LAN        []string `json:"lan,omitempty"`
+	// DNS servers that replace the pushed ones
+	DNS []string `json:"dns,omitempty"`
+	// Use the DNS stub of the daemon, it only answers while the tunnel is up
+	DNSStub bool `json:"dns_stub,omitempty"`
+	// nil sends everything through the tunnel
+	Split *SplitTunnel `json:"split,omitempty"`
+	// Keep the tunnel in a network namespace, only commands started with exec use it
+	Namespace bool `json:"namespace,omitempty"`
+	// Only these users go through the tunnel, see ResolveUsers
+	Users []string `json:"users,omitempty"`
+	// nil doesn't run the proxy of the daemon
+	Proxy *LocalProxy `json:"proxy,omitempty"`
+	// An otpauth:// URI, its codes answer the static challenges of the server
+	TOTP string `json:"totp,omitempty"`
+	// The passphrase of an encrypted private key or the PIN of the token of ExternalKey, it's asked when it's empty
+	KeyPassword string `json:"key_password,omitempty"`
+	// nil uses the key of the config, otherwise the client signs for openvpn
+	ExternalKey *ExternalKey `json:"external_key,omitempty"`
+	// The certificate in a PKCS#11 token that was chosen when connecting, or the pkcs11-id of the config
+	PKCS11ID string `json:"pkcs11_id,omitempty"`
+	// nil connects to the server directly
+	Upstream *UpstreamProxy `json:"upstream_proxy,omitempty"`
+	// nil lets openvpn connect by itself
+	Transport *Transport `json:"transport,omitempty"`
+}
+
+// ExternalKey is a private key that the daemon never reads, a file of the user or a key in a hardware token
+type ExternalKey struct {
+	// A PEM key file, its passphrase is KeyPassword
+	File string `json:"file,omitempty"`
+	// The PKCS#11 module of the token and the id of the key in it
+	Module string `json:"module,omitempty"`
+	ID     string `json:"id,omitempty"`
+}
+
+// LocalProxy is a SOCKS5 and HTTP CONNECT proxy on localhost whose connections leave through the tunnel
+type LocalProxy struct {
+	// Zero disables the proxy of that protocol
+	SOCKSPort uint16 `json:"socks_port,omitempty"`
+	HTTPPort  uint16 `json:"http_port,omitempty"`
+	// Ignore the pushed routes, so only the connections of the proxy use the tunnel
+	Only bool `json:"only,omitempty"`
+}
+
+type ProviderCfg struct {
+	Cfg
+	Configs []SingleCfg `json:"configs"`
+}
+
+type Data struct {
+	Singles   []SingleCfg   `json:"single_configs"`
+	Providers []ProviderCfg `json:"providers"`
+}
+
+var (
+	dataPath   = utils.UserHomeDir() + "/.config/vodga/vodga.json"
+	configsDir = utils.UserHomeDir() + "/.config/vodga/configs/"
+)
+
+// ReconnectPolicy returns the reconnect policy of the config
+func (s SingleCfg) ReconnectPolicy() reconnect.Policy {
+	if s.Reconnect == nil {
+		return reconnect.Default
+	}
+	return *s.Reconnect
+}
+
+// AddConnectArgs puts the settings that the daemon needs in the arguments of CONNECT
+func (s SingleCfg) AddConnectArgs(args map[string]string) {
+	s.ReconnectPolicy().AddArgs(args)
+	if s.KillSwitch {
+		args["kill_switch"] = "true"
+		args["lan"] = strings.Join(s.LAN, ",")
+	}
+	if len(s.DNS) > 0 {
+		args["dns"] = strings.Join(s.DNS, ",")
+	}
+	if s.DNSStub {
+		args["dns_stub"] = "true"
+	}
+	if s.Split != nil {
+		args["split_mode"] = string(s.Split.Mode)
+		args["split_rules"] = strings.Join(s.Split.Rules, ",")
+	}
+	if s.Namespace {
+		args["namespace"] = "true"
+	}
+	if len(s.Users) > 0 {
+		args["users"] = strings.Join(s.Users, ",")
+	}
+	if s.Proxy != nil {
+		args["proxy_socks"] = strconv.Itoa(int(s.Proxy.SOCKSPort))
+		args["proxy_http"] = strconv.Itoa(int(s.Proxy.HTTPPort))
+		if s.Proxy.Only {
+			args["proxy_only"] = "true"
+		}
+	}
+	if s.ExternalKey != nil {
+		args["external_key"] = "true"
+	}
+	if s.PKCS11ID != "" {
+		args["pkcs11_id"] = s.PKCS11ID
+	}
+	if s.Upstream != nil {
+		s.Upstream.AddArgs(args)
+	}
+	if s.Transport != nil {
+		s.Transport.AddArgs(args)
+	}
+}
+
+// Path is where the imported config is stored
+func (s SingleCfg) Path() string {
+	return configsDir + s.Name + ".ovpn"
+}
+
+func checkDataDirectory() error {
+	if _, err := os.Stat(configsDir); err == nil {
+		return nil
+	} else if os.IsNotExist(err) {
+		return os.MkdirAll(configsDir, 0755)
+	} else {
+		return err
+	}
+}
+
+// getOrCreateData reads the store, a store that can't be read is an error so it's never saved over
+func getOrCreateData() (Data, error) {
+	empty := Data{}
+	if _, err := os.Stat(dataPath); err == nil {
+		contents, err := ioutil.ReadFile(dataPath)
+		if err != nil {
+			return empty, fmt.Errorf("can't read the profiles: %v", err)
+		}
+		appData := Data{}
+		err = json.Unmarshal(contents, &appData)
+		if err != nil {
+			return empty, fmt.Errorf("can't read the profiles in %s: %v", dataPath, err)
+		}
+		return appData, nil
+	} else if os.IsNotExist(err) {
+		return empty, Save(empty)
+	} else {
+		return empty, err
+	}
+}
+
+// Load reads the profile store, it's created if it doesn't exist
+func Load() (Data, error) {
+	if err := checkDataDirectory(); err != nil {
+		return Data{}, err
+	}
+	return getOrCreateData()
+}
+
+func Save(appData Data) error {
+	cfg, err := json.Marshal(appData)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(dataPath, cfg, 0600)
+	return err
+}
+
+// FindSingle returns the index of a single config by its name, or -1
+func (d *Data) FindSingle(name string) int {
+	for i, single := range d.Singles {
+		if single.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// DefaultName is the name of a config before the user changes it
+func DefaultName(file string) string {
+	return strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+}
+
+// ImportSingle stores a parsed config under a name and saves the store
+func ImportSingle(cfg Config, name string, creds auth.Credentials) (SingleCfg, error) {
+	if name == "" || strings.ContainsAny(name, "/\\") || name[0] == '.' {
+		return SingleCfg{}, fmt.Errorf("invalid name \"%s\"", name)
+	}
+	if len(cfg.Remotes) == 0 {
+		return SingleCfg{}, errors.New("config has no remotes")
+	}
+	appData, err := Load()
+	if err != nil {
+		return SingleCfg{}, err
+	}
+	if appData.FindSingle(name) >= 0 {
+		return SingleCfg{}, fmt.Errorf("a config named \"%s\" already exists", name)
+	}
+
+	cfg.Creds = creds
+	single := SingleCfg{
+		Cfg:        Cfg{Name: name, Creds: creds},
+		Port:       cfg.Remotes[0].Port,
+		Proto:      cfg.Proto,
+		Country:    cfg.Remotes[0].Country,
+		CountryISO: cfg.Remotes[0].CountryISO,
+		PKCS11ID:   cfg.PKCS11ID,
+		Upstream:   cfg.Proxy,
+	}
+	if err := ioutil.WriteFile(single.Path(), []byte(cfg.Render()), 0600); err != nil {
+		return SingleCfg{}, err
+	}
+	appData.Singles = append(appData.Singles, single)
+	if err := Save(appData); err != nil {
+		os.Remove(single.Path())
+		return SingleCfg{}, err
+	}
+	return single, nil
+}
+
+// RemoveSingle deletes a single config and its file
+func RemoveSingle(name string) error {
+	appData, err := Load()
+	if err != nil {
+		return err
+	}
+	i := appData.FindSingle(name)
+	if i < 0 {
+		return fmt.Errorf("no config named \"%s\"", name)
+	}
+	path := appData.Singles[i].Path()
+	appData.Singles = append(appData.Singles[:i], appData.Singles[i+1:]...)
+	if err := Save(appData); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// UpdateSingle changes the settings of a single config and saves them
+func UpdateSingle(name string, update func(single *SingleCfg)) error {
+	appData, err := Load()
+	if err != nil {
+		return err
+	}
+	i := appData.FindSingle(name)
+	if i < 0 {
+		return fmt.Errorf("no config named \"%s\"", name)
+	}
+	update(&appData.Singles[i])
+	return Save(appData)
+}
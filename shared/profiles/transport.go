@@ -0,0 +1,113 @@
+package profiles
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// TransportType is the program that carries the openvpn connection
+type TransportType string
+
+const (
+	// TransportStunnel wraps the connection in TLS, the server runs stunnel too
+	TransportStunnel TransportType = "stunnel"
+	// TransportObfs4 makes the connection look like random bytes, the server runs obfs4proxy
+	TransportObfs4 TransportType = "obfs4"
+	// TransportSSH forwards the connection through an SSH server
+	TransportSSH TransportType = "ssh"
+)
+
+// Transport is a sidecar that the daemon starts before openvpn, for networks that block openvpn.
+// openvpn connects to its local endpoint, so the remotes must accept TCP
+type Transport struct {
+	Type TransportType `json:"type"`
+	// The stunnel, obfs4 or SSH server, host:port
+	Server string `json:"server"`
+	// The SSH user and its private key, empty uses the ssh config of the user
+	User     string `json:"user,omitempty"`
+	Identity string `json:"identity,omitempty"`
+	// SSH forwards with -D and openvpn uses it as a SOCKS proxy, otherwise -L forwards to the first remote
+	Dynamic bool `json:"dynamic,omitempty"`
+	// The cert and the iat-mode of the obfs4 bridge line
+	Cert    string `json:"cert,omitempty"`
+	IATMode int    `json:"iat_mode,omitempty"`
+}
+
+// ParseTransportType converts a command line value into a transport type
+func ParseTransportType(s string) (TransportType, error) {
+	switch typ := TransportType(s); typ {
+	case TransportStunnel, TransportObfs4, TransportSSH:
+		return typ, nil
+	}
+	return "", fmt.Errorf("unknown transport \"%s\", it should be stunnel, obfs4 or ssh", s)
+}
+
+// Check returns an error if the transport can't be started
+func (t Transport) Check() error {
+	if _, err := ParseTransportType(string(t.Type)); err != nil {
+		return err
+	}
+	host, port, err := net.SplitHostPort(t.Server)
+	if err != nil || !ValidHost(host) {
+		return fmt.Errorf("invalid server \"%s\", it should be host:port", t.Server)
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return fmt.Errorf("invalid port \"%s\"", port)
+	}
+	if t.Type == TransportObfs4 && t.Cert == "" {
+		return errors.New("obfs4 needs the cert of the bridge")
+	}
+	if t.IATMode < 0 || t.IATMode > 2 {
+		return fmt.Errorf("invalid iat-mode %d", t.IATMode)
+	}
+	if strings.ContainsAny(t.Server+t.User+t.Identity+t.Cert, "\n\r") {
+		return errors.New("the transport settings can't have line breaks")
+	}
+	return nil
+}
+
+// String describes the transport
+func (t Transport) String() string {
+	switch {
+	case t.Type == TransportSSH && t.Dynamic:
+		return "ssh -D via " + t.Server
+	case t.Type == TransportSSH:
+		return "ssh -L via " + t.Server
+	}
+	return string(t.Type) + " via " + t.Server
+}
+
+// AddArgs adds the transport to the arguments of CONNECT
+func (t Transport) AddArgs(args map[string]string) {
+	args["transport"] = string(t.Type)
+	args["transport_server"] = t.Server
+	args["transport_user"] = t.User
+	args["transport_identity"] = t.Identity
+	args["transport_dynamic"] = strconv.FormatBool(t.Dynamic)
+	args["transport_cert"] = t.Cert
+	args["transport_iat_mode"] = strconv.Itoa(t.IATMode)
+}
+
+// TransportFromArgs reads the transport of CONNECT, nil if there's none
+func TransportFromArgs(args map[string]string) (*Transport, error) {
+	if args["transport"] == "" {
+		return nil, nil
+	}
+	t := &Transport{Type: TransportType(args["transport"]), Server: args["transport_server"],
+		User: args["transport_user"], Identity: args["transport_identity"],
+		Dynamic: args["transport_dynamic"] == "true", Cert: args["transport_cert"]}
+	if args["transport_iat_mode"] != "" {
+		mode, err := strconv.Atoi(args["transport_iat_mode"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid iat-mode %q", args["transport_iat_mode"])
+		}
+		t.IATMode = mode
+	}
+	if err := t.Check(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
@@ -0,0 +1,61 @@
+package profiles
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// ResolveUsers converts the users of a config into uids and gids.
+// A rule is a user name or a uid, or a group name or a gid after "@".
+// root and its group can't be used, openvpn and the daemon would go through the tunnel
+func ResolveUsers(rules []string) (uids, gids []uint32, err error) {
+	for _, rule := range rules {
+		if group := strings.TrimPrefix(rule, "@"); group != rule {
+			gid, err := lookupID(group, func(name string) (string, error) {
+				grp, err := user.LookupGroup(name)
+				if err != nil {
+					return "", err
+				}
+				return grp.Gid, nil
+			})
+			if err != nil {
+				return nil, nil, fmt.Errorf("unknown group \"%s\"", group)
+			}
+			if gid == 0 {
+				return nil, nil, fmt.Errorf("the group \"%s\" is root's, it can't go through the tunnel", group)
+			}
+			gids = append(gids, gid)
+			continue
+		}
+		uid, err := lookupID(rule, func(name string) (string, error) {
+			usr, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return usr.Uid, nil
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("unknown user \"%s\"", rule)
+		}
+		if uid == 0 {
+			return nil, nil, fmt.Errorf("the user \"%s\" is root, it can't go through the tunnel", rule)
+		}
+		uids = append(uids, uid)
+	}
+	return uids, gids, nil
+}
+
+// lookupID returns numeric ids as they are, names are looked up
+func lookupID(name string, lookup func(string) (string, error)) (uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseUint(id, 10, 32)
+	return uint32(n), err
+}
@@ -0,0 +1,74 @@
+// Package reconnect describes how the daemon brings a connection back after openvpn exits
+package reconnect
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Policy is stored per profile and sent to the daemon with CONNECT
+type Policy struct {
+	// How many times openvpn is restarted before giving up, zero disables reconnecting
+	MaxAttempts int `json:"max_attempts"`
+	// The delay before the first attempt in seconds, it's doubled for each attempt
+	InitialDelay int `json:"initial_delay"`
+	// The maximum delay in seconds
+	MaxDelay int `json:"max_delay"`
+	// Failures of a remote before the next remote in the config is used, zero never skips
+	FailoverAfter int `json:"failover_after"`
+}
+
+var Default = Policy{MaxAttempts: 10, InitialDelay: 2, MaxDelay: 300, FailoverAfter: 2}
+
+// Delay returns the time to wait before an attempt, the first attempt is 1.
+// jitter is a random number in [0, 1), half of the delay is randomized by it
+// so that many clients don't reconnect to a server at the same time
+func (p Policy) Delay(attempt int, jitter float64) time.Duration {
+	delay := time.Duration(p.InitialDelay) * time.Second
+	max := time.Duration(p.MaxDelay) * time.Second
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay/2 + time.Duration(float64(delay/2)*jitter)
+}
+
+// AddArgs puts the policy in the arguments of a message
+func (p Policy) AddArgs(args map[string]string) {
+	args["max_attempts"] = strconv.Itoa(p.MaxAttempts)
+	args["initial_delay"] = strconv.Itoa(p.InitialDelay)
+	args["max_delay"] = strconv.Itoa(p.MaxDelay)
+	args["failover_after"] = strconv.Itoa(p.FailoverAfter)
+}
+
+// FromArgs reads the policy of a message, missing values are taken from Default
+func FromArgs(args map[string]string) (Policy, error) {
+	p := Default
+	fields := []struct {
+		key   string
+		value *int
+	}{
+		{"max_attempts", &p.MaxAttempts},
+		{"initial_delay", &p.InitialDelay},
+		{"max_delay", &p.MaxDelay},
+		{"failover_after", &p.FailoverAfter},
+	}
+	for _, f := range fields {
+		text, ok := args[f.key]
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(text)
+		if err != nil || n < 0 {
+			return Default, fmt.Errorf("invalid %s: %q", f.key, text)
+		}
+		*f.value = n
+	}
+	if p.MaxDelay < p.InitialDelay {
+		p.MaxDelay = p.InitialDelay
+	}
+	return p, nil
+}
@@ -0,0 +1,49 @@
+package reconnect
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	p := Policy{MaxAttempts: 10, InitialDelay: 2, MaxDelay: 20}
+	tests := []struct {
+		attempt int
+		jitter  float64
+		want    time.Duration
+	}{
+		{1, 0, time.Second},
+		{1, 0.5, 1500 * time.Millisecond},
+		{2, 0, 2 * time.Second},
+		{3, 0.99, 7960 * time.Millisecond},
+		// Capped by MaxDelay
+		{4, 0, 8 * time.Second},
+		{5, 0, 10 * time.Second},
+		{50, 0.5, 15 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := p.Delay(tt.attempt, tt.jitter); got != tt.want {
+			t.Errorf("Delay(%d, %v) = %v, want %v", tt.attempt, tt.jitter, got, tt.want)
+		}
+	}
+}
+
+func TestArgs(t *testing.T) {
+	p := Policy{MaxAttempts: 3, InitialDelay: 1, MaxDelay: 60, FailoverAfter: 0}
+	args := map[string]string{}
+	p.AddArgs(args)
+	got, err := FromArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != p {
+		t.Errorf("got %+v, want %+v", got, p)
+	}
+
+	if got, _ := FromArgs(map[string]string{}); got != Default {
+		t.Errorf("missing values should be the defaults, got %+v", got)
+	}
+	if _, err := FromArgs(map[string]string{"max_attempts": "-1"}); err == nil {
+		t.Errorf("negative values should be rejected")
+	}
+}
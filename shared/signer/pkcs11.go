@@ -0,0 +1,101 @@
+package signer
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// The environment variable that passes the PIN to pkcs11-tool, it's not visible in the process list
+const pinEnv = "VODGA_PKCS11_PIN"
+
+var pssHashes = map[crypto.Hash]string{
+	crypto.SHA1:   "SHA-1",
+	crypto.SHA224: "SHA224",
+	crypto.SHA256: "SHA256",
+	crypto.SHA384: "SHA384",
+	crypto.SHA512: "SHA512",
+}
+
+// pkcs11Signer signs with a key of a smart card or a hardware token through pkcs11-tool of OpenSC
+type pkcs11Signer struct {
+	module string
+	id     string
+	pin    func() (string, error)
+
+	mtx       sync.Mutex
+	cachedPin string
+}
+
+// PKCS11 returns a signer that uses the key with an id in a PKCS#11 module.
+// pin is called once, when the first signature needs it
+func PKCS11(module, id string, pin func() (string, error)) Signer {
+	return &pkcs11Signer{module: module, id: id, pin: pin}
+}
+
+// pkcs11Args returns the arguments of pkcs11-tool that sign with an algorithm
+func pkcs11Args(module, id string, alg Algorithm) ([]string, error) {
+	args := []string{"--module", module, "--id", id, "--sign", "--login", "--pin", "env:" + pinEnv}
+	switch alg.Padding {
+	case PaddingPKCS1:
+		args = append(args, "--mechanism", "RSA-PKCS")
+	case PaddingPSS:
+		hash, ok := pssHashes[alg.Hash]
+		if !ok {
+			return nil, fmt.Errorf("unsupported PSS hash %v", alg.Hash)
+		}
+		salt := "-1"
+		if alg.SaltLength == SaltMax {
+			salt = "-2"
+		}
+		args = append(args, "--mechanism", "RSA-PKCS-PSS", "--hash-algorithm", hash,
+			"--mgf", "MGF1-"+strings.Replace(hash, "-", "", 1), "--salt-len", salt)
+	case ECDSA:
+		args = append(args, "--mechanism", "ECDSA", "--signature-format", "openssl")
+	default:
+		return nil, fmt.Errorf("%s is not supported by pkcs11-tool", alg.Padding)
+	}
+	return args, nil
+}
+
+func (s *pkcs11Signer) getPin() (string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.cachedPin == "" {
+		pin, err := s.pin()
+		if err != nil {
+			return "", err
+		}
+		s.cachedPin = pin
+	}
+	return s.cachedPin, nil
+}
+
+func (s *pkcs11Signer) Sign(data []byte, alg Algorithm) ([]byte, error) {
+	args, err := pkcs11Args(s.module, s.id, alg)
+	if err != nil {
+		return nil, err
+	}
+	pin, err := s.getPin()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("pkcs11-tool", args...)
+	cmd.Env = append(os.Environ(), pinEnv+"="+pin)
+	cmd.Stdin = bytes.NewReader(data)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// A wrong PIN is asked again next time
+		s.mtx.Lock()
+		s.cachedPin = ""
+		s.mtx.Unlock()
+		return nil, fmt.Errorf("pkcs11-tool failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,182 @@
+// Package signer answers the PK_SIGN requests of openvpn with a key that stays in the session of the user.
+// The daemon runs openvpn with --management-external-key and only sees the signatures
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+)
+
+// The paddings of the PK_SIGN requests
+const (
+	PaddingPKCS1 = "RSA_PKCS1_PADDING"
+	PaddingPSS   = "RSA_PKCS1_PSS_PADDING"
+	PaddingNone  = "RSA_NO_PADDING"
+	ECDSA        = "ECDSA"
+)
+
+// The salt lengths of PSS
+const (
+	SaltDigest = -1
+	SaltMax    = -2
+)
+
+// Algorithm is the signature scheme of a PK_SIGN request
+type Algorithm struct {
+	Padding string
+	// The hash that the data is a digest of, only for PSS
+	Hash crypto.Hash
+	// SaltDigest or SaltMax
+	SaltLength int
+}
+
+// Signer signs the data of PK_SIGN requests, the data is already hashed by openvpn
+type Signer interface {
+	Sign(data []byte, alg Algorithm) ([]byte, error)
+}
+
+var hashes = map[string]crypto.Hash{
+	"SHA1":   crypto.SHA1,
+	"SHA224": crypto.SHA224,
+	"SHA256": crypto.SHA256,
+	"SHA384": crypto.SHA384,
+	"SHA512": crypto.SHA512,
+}
+
+// ParseAlgorithm reads the algorithm of a request, like
+// "RSA_PKCS1_PSS_PADDING,hashalg=SHA256,saltlen=digest". openvpn 2.4 doesn't send it, that's PKCS1
+func ParseAlgorithm(s string) (Algorithm, error) {
+	fields := strings.Split(s, ",")
+	alg := Algorithm{Padding: fields[0]}
+	switch alg.Padding {
+	case "":
+		alg.Padding = PaddingPKCS1
+	case PaddingPKCS1, PaddingNone, ECDSA:
+	case PaddingPSS:
+		alg.SaltLength = SaltDigest
+		for _, param := range fields[1:] {
+			kv := strings.SplitN(param, "=", 2)
+			if len(kv) != 2 {
+				return Algorithm{}, fmt.Errorf("invalid parameter %q", param)
+			}
+			switch kv[0] {
+			case "hashalg":
+				hash, ok := hashes[strings.ToUpper(kv[1])]
+				if !ok {
+					return Algorithm{}, fmt.Errorf("unknown hash %q", kv[1])
+				}
+				alg.Hash = hash
+			case "saltlen":
+				if kv[1] == "max" {
+					alg.SaltLength = SaltMax
+				} else if kv[1] != "digest" {
+					return Algorithm{}, fmt.Errorf("unknown salt length %q", kv[1])
+				}
+			}
+		}
+		if alg.Hash == 0 {
+			return Algorithm{}, errors.New("PSS needs a hash")
+		}
+	default:
+		return Algorithm{}, fmt.Errorf("unknown algorithm %q", s)
+	}
+	return alg, nil
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// keySigner signs with a key that is loaded into memory
+type keySigner struct {
+	key crypto.Signer
+}
+
+// LoadKey reads a PEM key file, PKCS#1, PKCS#8 or SEC 1. passphrase is called if the key is encrypted
+func LoadKey(path string, passphrase func() (string, error)) (Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("the key is not in the PEM format")
+	}
+	der := block.Bytes
+	// Keys of openvpn configs are usually encrypted with the old PEM headers
+	if x509.IsEncryptedPEMBlock(block) {
+		pass, err := passphrase()
+		if err != nil {
+			return nil, err
+		}
+		if der, err = x509.DecryptPEMBlock(block, []byte(pass)); err != nil {
+			return nil, errors.New("wrong passphrase")
+		}
+	}
+	key, err := parseKey(block.Type, der)
+	if err != nil {
+		return nil, err
+	}
+	return &keySigner{key: key}, nil
+}
+
+func parseKey(typ string, der []byte) (crypto.Signer, error) {
+	switch typ {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(der)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return nil, err
+		}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return key, nil
+		case *ecdsa.PrivateKey:
+			return key, nil
+		}
+		return nil, errors.New("only RSA and ECDSA keys are supported")
+	case "ENCRYPTED PRIVATE KEY":
+		return nil, errors.New("encrypted PKCS#8 keys are not supported, convert the key with openssl")
+	}
+	return nil, fmt.Errorf("unknown key type %q", typ)
+}
+
+func (s *keySigner) Sign(data []byte, alg Algorithm) ([]byte, error) {
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		switch alg.Padding {
+		case PaddingPKCS1:
+			// The data is a DigestInfo, only the padding is added
+			return rsa.SignPKCS1v15(rand.Reader, key, 0, data)
+		case PaddingPSS:
+			salt := rsa.PSSSaltLengthEqualsHash
+			if alg.SaltLength == SaltMax {
+				salt = rsa.PSSSaltLengthAuto
+			}
+			return rsa.SignPSS(rand.Reader, key, alg.Hash, data, &rsa.PSSOptions{SaltLength: salt})
+		}
+	case *ecdsa.PrivateKey:
+		if alg.Padding == ECDSA {
+			r, ss, err := ecdsa.Sign(rand.Reader, key, data)
+			if err != nil {
+				return nil, err
+			}
+			// ASN.1 DER, like openvpn expects
+			return asn1.Marshal(ecdsaSignature{R: r, S: ss})
+		}
+	}
+	return nil, fmt.Errorf("%s is not supported by the key", alg.Padding)
+}
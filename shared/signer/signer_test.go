@@ -0,0 +1,282 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseAlgorithm(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Algorithm
+	}{
+		{"", Algorithm{Padding: PaddingPKCS1}},
+		{"RSA_PKCS1_PADDING", Algorithm{Padding: PaddingPKCS1}},
+		{"ECDSA", Algorithm{Padding: ECDSA}},
+		{"RSA_PKCS1_PSS_PADDING,hashalg=SHA256,saltlen=digest",
+			Algorithm{Padding: PaddingPSS, Hash: crypto.SHA256, SaltLength: SaltDigest}},
+		{"RSA_PKCS1_PSS_PADDING,hashalg=SHA384,saltlen=max",
+			Algorithm{Padding: PaddingPSS, Hash: crypto.SHA384, SaltLength: SaltMax}},
+	}
+	for _, test := range tests {
+		got, err := ParseAlgorithm(test.in)
+		if err != nil {
+			t.Errorf("ParseAlgorithm(%q): %v", test.in, err)
+		} else if got != test.want {
+			t.Errorf("ParseAlgorithm(%q) = %+v, want %+v", test.in, got, test.want)
+		}
+	}
+	for _, in := range []string{"RSA_PKCS1_PSS_PADDING", "RSA_PKCS1_PSS_PADDING,hashalg=MD5", "DSA"} {
+		if _, err := ParseAlgorithm(in); err == nil {
+			t.Errorf("ParseAlgorithm(%q) didn't fail", in)
+		}
+	}
+}
+
+func writeKey(t *testing.T, dir string, block *pem.Block) string {
+	path := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func noPassphrase() (string, error) {
+	return "", errors.New("the key is not encrypted")
+}
+
+func TestKeySigner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vodga-signer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	digest := sha256.Sum256([]byte("data"))
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey),
+		[]byte("secret"), x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeKey(t, dir, block)
+	if _, err := LoadKey(path, func() (string, error) { return "wrong", nil }); err == nil {
+		t.Error("LoadKey accepted a wrong passphrase")
+	}
+	s, err := LoadKey(path, func() (string, error) { return "secret", nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// openvpn sends the DigestInfo of PKCS1 signatures
+	prefix := []byte{0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02,
+		0x01, 0x05, 0x00, 0x04, 0x20}
+	sig, err := s.Sign(append(prefix, digest[:]...), Algorithm{Padding: PaddingPKCS1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+		t.Errorf("PKCS1 signature: %v", err)
+	}
+
+	for _, salt := range []int{SaltDigest, SaltMax} {
+		sig, err = s.Sign(digest[:], Algorithm{Padding: PaddingPSS, Hash: crypto.SHA256, SaltLength: salt})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rsa.VerifyPSS(&rsaKey.PublicKey, crypto.SHA256, digest[:], sig, nil); err != nil {
+			t.Errorf("PSS signature with salt %d: %v", salt, err)
+		}
+	}
+	if _, err := s.Sign(digest[:], Algorithm{Padding: ECDSA}); err == nil {
+		t.Error("an RSA key signed with ECDSA")
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = LoadKey(writeKey(t, dir, &pem.Block{Type: "PRIVATE KEY", Bytes: der}), noPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err = s.Sign(digest[:], Algorithm{Padding: ECDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ecSig ecdsaSignature
+	if _, err := asn1.Unmarshal(sig, &ecSig); err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.Verify(&ecKey.PublicKey, digest[:], ecSig.R, ecSig.S) {
+		t.Error("invalid ECDSA signature")
+	}
+}
+
+func TestPKCS11Args(t *testing.T) {
+	base := []string{"--module", "/usr/lib/opensc-pkcs11.so", "--id", "01", "--sign", "--login", "--pin",
+		"env:VODGA_PKCS11_PIN"}
+	tests := []struct {
+		alg  Algorithm
+		want []string
+	}{
+		{Algorithm{Padding: PaddingPKCS1}, []string{"--mechanism", "RSA-PKCS"}},
+		{Algorithm{Padding: PaddingPSS, Hash: crypto.SHA1, SaltLength: SaltMax},
+			[]string{"--mechanism", "RSA-PKCS-PSS", "--hash-algorithm", "SHA-1", "--mgf", "MGF1-SHA1",
+				"--salt-len", "-2"}},
+		{Algorithm{Padding: PaddingPSS, Hash: crypto.SHA256, SaltLength: SaltDigest},
+			[]string{"--mechanism", "RSA-PKCS-PSS", "--hash-algorithm", "SHA256", "--mgf", "MGF1-SHA256",
+				"--salt-len", "-1"}},
+		{Algorithm{Padding: ECDSA}, []string{"--mechanism", "ECDSA", "--signature-format", "openssl"}},
+	}
+	for _, test := range tests {
+		got, err := pkcs11Args("/usr/lib/opensc-pkcs11.so", "01", test.alg)
+		if err != nil {
+			t.Errorf("pkcs11Args(%+v): %v", test.alg, err)
+			continue
+		}
+		if want := append(append([]string{}, base...), test.want...); !reflect.DeepEqual(got, want) {
+			t.Errorf("pkcs11Args(%+v) = %q, want %q", test.alg, got, want)
+		}
+	}
+	if _, err := pkcs11Args("m", "01", Algorithm{Padding: PaddingNone}); err == nil {
+		t.Error("pkcs11Args accepted RSA_NO_PADDING")
+	}
+}
+
+// softHSMModule returns the module of SoftHSM, the test is skipped if it or the tools are not installed
+func softHSMModule(t *testing.T) string {
+	for _, tool := range []string{"softhsm2-util", "pkcs11-tool"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is not installed", tool)
+		}
+	}
+	var module string
+	for _, pattern := range []string{"/usr/lib/softhsm/libsofthsm2.so", "/usr/lib/*/softhsm/libsofthsm2.so",
+		"/usr/lib64/softhsm/libsofthsm2.so", "/usr/lib*/pkcs11/libsofthsm2.so", "/usr/local/lib/softhsm/libsofthsm2.so"} {
+		if matches, _ := filepath.Glob(pattern); len(matches) > 0 {
+			module = matches[0]
+			break
+		}
+	}
+	if module == "" {
+		t.Skip("the module of SoftHSM is not installed")
+	}
+	return module
+}
+
+// softHSM makes a SoftHSM token in dir with the keys under their ids
+func softHSM(t *testing.T, dir string, keys map[string]crypto.Signer) {
+	tokens := filepath.Join(dir, "tokens")
+	if err := os.Mkdir(tokens, 0700); err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "softhsm2.conf")
+	if err := ioutil.WriteFile(conf, []byte("directories.tokendir = "+tokens+"\nobjectstore.backend = file\n"),
+		0600); err != nil {
+		t.Fatal(err)
+	}
+	// pkcs11-tool gets the environment of the test
+	if err := os.Setenv("SOFTHSM2_CONF", conf); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(args ...string) {
+		if out, err := exec.Command("softhsm2-util", args...).CombinedOutput(); err != nil {
+			t.Fatalf("softhsm2-util %s: %v: %s", args[0], err, out)
+		}
+	}
+	run("--init-token", "--free", "--label", "vodga", "--pin", "1234", "--so-pin", "5678")
+	for id, key := range keys {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, id+".pem")
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+			0600); err != nil {
+			t.Fatal(err)
+		}
+		run("--import", path, "--token", "vodga", "--label", "key"+id, "--id", id, "--pin", "1234")
+	}
+}
+
+func TestPKCS11SoftHSM(t *testing.T) {
+	module := softHSMModule(t)
+	dir, err := ioutil.TempDir("", "vodga-softhsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Unsetenv("SOFTHSM2_CONF")
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	softHSM(t, dir, map[string]crypto.Signer{"01": rsaKey, "02": ecKey})
+	pin := func() (string, error) { return "1234", nil }
+	digest := sha256.Sum256([]byte("data"))
+
+	s := PKCS11(module, "01", pin)
+	prefix := []byte{0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02,
+		0x01, 0x05, 0x00, 0x04, 0x20}
+	sig, err := s.Sign(append(prefix, digest[:]...), Algorithm{Padding: PaddingPKCS1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+		t.Errorf("PKCS1 signature: %v", err)
+	}
+	for _, salt := range []int{SaltDigest, SaltMax} {
+		sig, err = s.Sign(digest[:], Algorithm{Padding: PaddingPSS, Hash: crypto.SHA256, SaltLength: salt})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rsa.VerifyPSS(&rsaKey.PublicKey, crypto.SHA256, digest[:], sig, nil); err != nil {
+			t.Errorf("PSS signature with salt %d: %v", salt, err)
+		}
+	}
+
+	sig, err = PKCS11(module, "02", pin).Sign(digest[:], Algorithm{Padding: ECDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ecSig ecdsaSignature
+	if _, err := asn1.Unmarshal(sig, &ecSig); err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.Verify(&ecKey.PublicKey, digest[:], ecSig.R, ecSig.S) {
+		t.Error("invalid ECDSA signature")
+	}
+
+	if _, err := PKCS11(module, "01", func() (string, error) { return "0000", nil }).Sign(digest[:],
+		Algorithm{Padding: PaddingPKCS1}); err == nil {
+		t.Error("a wrong PIN signed")
+	}
+}
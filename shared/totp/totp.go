@@ -0,0 +1,136 @@
+// Package totp generates the time-based one-time passwords of RFC 6238, the codes of authenticator apps
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Key is the secret of an account and the parameters of its codes
+type Key struct {
+	Secret []byte
+	// SHA1, SHA256 or SHA512
+	Algorithm string
+	Digits    int
+	// How long a code is valid
+	Period  time.Duration
+	Issuer  string
+	Account string
+}
+
+// ParseURI reads a key from an otpauth://totp/ URI, the format of the QR codes of the providers.
+// The missing parameters get the defaults of Google Authenticator: SHA1, 6 digits and 30 seconds
+func ParseURI(uri string) (*Key, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "otpauth" {
+		return nil, errors.New("not an otpauth:// URI")
+	}
+	if u.Host != "totp" {
+		return nil, fmt.Errorf("%q keys are not supported, only totp", u.Host)
+	}
+
+	q := u.Query()
+	key := &Key{Algorithm: "SHA1", Digits: 6, Period: 30 * time.Second}
+	if key.Secret, err = decodeSecret(q.Get("secret")); err != nil {
+		return nil, err
+	}
+	if alg := q.Get("algorithm"); alg != "" {
+		key.Algorithm = strings.ToUpper(alg)
+		if key.hash() == nil {
+			return nil, fmt.Errorf("unknown algorithm %q", alg)
+		}
+	}
+	if digits := q.Get("digits"); digits != "" {
+		if key.Digits, err = strconv.Atoi(digits); err != nil || key.Digits < 6 || key.Digits > 10 {
+			return nil, fmt.Errorf("invalid number of digits %q", digits)
+		}
+	}
+	if period := q.Get("period"); period != "" {
+		seconds, err := strconv.Atoi(period)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("invalid period %q", period)
+		}
+		key.Period = time.Duration(seconds) * time.Second
+	}
+
+	// The label is "issuer:account" or just the account
+	label := strings.TrimPrefix(u.Path, "/")
+	if i := strings.Index(label, ":"); i >= 0 {
+		key.Issuer, key.Account = label[:i], strings.TrimSpace(label[i+1:])
+	} else {
+		key.Account = label
+	}
+	if issuer := q.Get("issuer"); issuer != "" {
+		key.Issuer = issuer
+	}
+	return key, nil
+}
+
+// decodeSecret reads a base32 secret, the padding is optional and spaces are ignored
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	if secret == "" {
+		return nil, errors.New("the URI has no secret")
+	}
+	data, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return nil, errors.New("the secret is not base32")
+	}
+	return data, nil
+}
+
+func (k *Key) hash() func() hash.Hash {
+	switch k.Algorithm {
+	case "SHA1":
+		return sha1.New
+	case "SHA256":
+		return sha256.New
+	case "SHA512":
+		return sha512.New
+	}
+	return nil
+}
+
+// Code returns the code that is valid at a time
+func (k *Key) Code(t time.Time) string {
+	counter := uint64(t.Unix()) / uint64(k.Period/time.Second)
+	return hotp(k.hash(), k.Secret, counter, k.Digits)
+}
+
+// Remaining returns how long the code of a time stays valid
+func (k *Key) Remaining(t time.Time) time.Duration {
+	period := int64(k.Period / time.Second)
+	return time.Duration(period-t.Unix()%period) * time.Second
+}
+
+// hotp is the HMAC-based code of RFC 4226
+func hotp(h func() hash.Hash, secret []byte, counter uint64, digits int) string {
+	mac := hmac.New(h, secret)
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0xf
+	code := uint64(binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff)
+	mod := uint64(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
@@ -0,0 +1,66 @@
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// The test vectors of RFC 6238
+func TestCode(t *testing.T) {
+	seed := "1234567890"
+	secrets := map[string]string{
+		"SHA1":   seed + seed,
+		"SHA256": seed + seed + seed + "12",
+		"SHA512": seed + seed + seed + seed + seed + seed + "1234",
+	}
+	tests := []struct {
+		time int64
+		alg  string
+		want string
+	}{
+		{59, "SHA1", "94287082"},
+		{59, "SHA256", "46119246"},
+		{59, "SHA512", "90693936"},
+		{1111111109, "SHA1", "07081804"},
+		{1234567890, "SHA256", "91819424"},
+		{20000000000, "SHA512", "47863826"},
+	}
+	for _, tt := range tests {
+		uri := "otpauth://totp/Example:alice@example.com?digits=8&algorithm=" + tt.alg + "&secret=" +
+			base32.StdEncoding.EncodeToString([]byte(secrets[tt.alg]))
+		key, err := ParseURI(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := key.Code(time.Unix(tt.time, 0)); got != tt.want {
+			t.Errorf("%s at %d = %s, want %s", tt.alg, tt.time, got, tt.want)
+		}
+	}
+}
+
+func TestParseURI(t *testing.T) {
+	key, err := ParseURI("otpauth://totp/ACME%20VPN:alice?secret=jbswy3dpehpk3pxp&issuer=ACME")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key.Secret) != "Hello!\xde\xad\xbe\xef" || key.Algorithm != "SHA1" || key.Digits != 6 ||
+		key.Period != 30*time.Second || key.Issuer != "ACME" || key.Account != "alice" {
+		t.Errorf("wrong key: %+v", key)
+	}
+	if r := key.Remaining(time.Unix(61, 0)); r != 29*time.Second {
+		t.Errorf("remaining is %v", r)
+	}
+	for _, uri := range []string{
+		"https://example.com/?secret=JBSWY3DPEHPK3PXP",
+		"otpauth://hotp/alice?secret=JBSWY3DPEHPK3PXP",
+		"otpauth://totp/alice",
+		"otpauth://totp/alice?secret=not-base32",
+		"otpauth://totp/alice?secret=JBSWY3DPEHPK3PXP&algorithm=MD5",
+		"otpauth://totp/alice?secret=JBSWY3DPEHPK3PXP&period=0",
+	} {
+		if _, err := ParseURI(uri); err == nil {
+			t.Errorf("%s was accepted", uri)
+		}
+	}
+}
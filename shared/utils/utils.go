@@ -2,6 +2,7 @@ package utils
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"os/exec"
 	"os/user"
@@ -24,6 +25,24 @@ func BytecountToUint(in, out, tin, tout string)(uint64, uint64, uint64, uint64){
 	return i, o, ti, to
 }
 
+// FormatSize formats a size like glib's g_format_size_full with IEC units
+func FormatSize(size uint64) string {
+	if size < 1024 {
+		if size == 1 {
+			return "1 byte"
+		}
+		return strconv.FormatUint(size, 10) + " bytes"
+	}
+	units := []string{"KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	value := float64(size) / 1024
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
 func OpenvpnEscape(unescaped string) string {
 	escapedString := strings.ReplaceAll(unescaped, "\\", "\\\\")
 	escapedString = strings.ReplaceAll(escapedString, "\"", "\\\"")
@@ -39,11 +58,15 @@ func OpenvpnEscape(unescaped string) string {
 }
 
 func GetGeoIPData(ip string) (string, string, error) {
-	o, err := exec.Command("geoiplookup", ip).Output()
+	lookup, text := "geoiplookup", "GeoIP Country Edition: "
+	if strings.Contains(ip, ":") {
+		lookup, text = "geoiplookup6", "GeoIP Country V6 Edition: "
+	}
+	o, err := exec.Command(lookup, ip).Output()
 	if err != nil {
 		return "", "", err
 	}
-	text, out := "GeoIP Country Edition: ", string(o)
+	out := string(o)
 	if strings.Contains(out, text) {
 		start := strings.Index(out, text) + len(text)
 		end := start + strings.Index(out[start:], "\n")
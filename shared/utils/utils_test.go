@@ -11,4 +11,21 @@ func TestGetGeoIPData(t *testing.T) {
 		t.Errorf("GeoIPLookup failed: %s", err.Error())
 	}
 	fmt.Printf("%s , %s\n", c, iso)
-}
\ No newline at end of file
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := map[uint64]string{
+		0:               "0 bytes",
+		1:               "1 byte",
+		1023:            "1023 bytes",
+		1024:            "1.0 KiB",
+		1536:            "1.5 KiB",
+		5 * 1024 * 1024: "5.0 MiB",
+		3 << 30:         "3.0 GiB",
+	}
+	for size, want := range tests {
+		if got := FormatSize(size); got != want {
+			t.Errorf("FormatSize(%d) = %s, want %s", size, got, want)
+		}
+	}
+}
@@ -1,5 +0,0 @@
-package ui
-
-type Client struct {
-
-}
\ No newline at end of file
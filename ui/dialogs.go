@@ -3,9 +3,11 @@ package ui
 import (
 	"github.com/TheWeirdDev/Vodga/shared/auth"
 	"github.com/TheWeirdDev/Vodga/shared/consts"
+	"github.com/TheWeirdDev/Vodga/shared/profiles"
 	"github.com/gotk3/gotk3/gtk"
 	"log"
 	"strconv"
+	"strings"
 )
 
 func (gui *mainGUI) showImportSingleDialog() {
@@ -14,7 +16,7 @@ func (gui *mainGUI) showImportSingleDialog() {
 		log.Fatalf("Error: %v", err)
 	}
 
-	var cfg config
+	var cfg profiles.Config
 	selected := false
 
 	errorBar, _ := (*GetWidget(builder, "bar_error")).(*gtk.InfoBar)
@@ -26,16 +28,6 @@ func (gui *mainGUI) showImportSingleDialog() {
 		dialog.Close()
 	})
 
-	importBtn, _ := (*GetWidget(builder, "btn_import")).(*gtk.Button)
-	_, _ = importBtn.Connect("clicked", func() {
-		if selected {
-			dialog.Close()
-		} else {
-			errorBar.SetProperty("revealed", true)
-			errorLabel.SetText("No config file is selected")
-		}
-	})
-
 	pathEntry, _ := (*GetWidget(builder, "entry_path")).(*gtk.Entry)
 	errorBar.Connect("response", func() {
 		errorBar.SetProperty("revealed", false)
@@ -52,6 +44,29 @@ func (gui *mainGUI) showImportSingleDialog() {
 	userEntrry, _ := (*GetWidget(builder, "entry_username")).(*gtk.Entry)
 	passEntry, _ := (*GetWidget(builder, "entry_password")).(*gtk.Entry)
 
+	importBtn, _ := (*GetWidget(builder, "btn_import")).(*gtk.Button)
+	_, _ = importBtn.Connect("clicked", func() {
+		if !selected {
+			errorBar.SetProperty("revealed", true)
+			errorLabel.SetText("No config file is selected")
+			return
+		}
+		creds := auth.Credentials{Auth: auth.NO_AUTH}
+		if authCheckbox.GetActive() {
+			username, _ := userEntrry.GetText()
+			password, _ := passEntry.GetText()
+			creds = auth.Credentials{Auth: auth.USER_PASS, Username: username, Password: password}
+		}
+		single, err := profiles.ImportSingle(cfg, profiles.DefaultName(cfg.Path), creds)
+		if err != nil {
+			errorBar.SetProperty("revealed", true)
+			errorLabel.SetText("Error: " + err.Error())
+			return
+		}
+		gui.appData.Singles = append(gui.appData.Singles, single)
+		dialog.Close()
+	})
+
 	browseBtn, _ := (*GetWidget(builder, "btn_browse")).(*gtk.Button)
 	_, _ = browseBtn.Connect("clicked", func() {
 		errorBar.SetProperty("revealed", false)
@@ -78,7 +93,7 @@ func (gui *mainGUI) showImportSingleDialog() {
 		}
 
 		filePath := fileChooser.GetFilename()
-		cfg, err = getConfig(filePath, true)
+		cfg, err = profiles.GetConfig(filePath, true)
 		if err != nil {
 			errorBar.SetProperty("revealed", true)
 			pathEntry.SetText("")
@@ -89,18 +104,18 @@ func (gui *mainGUI) showImportSingleDialog() {
 		}
 
 		selected = true
-		remoteLabel.SetText(cfg.remotes[0].ips[0] + ":" + strconv.FormatUint(uint64(cfg.remotes[0].port), 10))
-		countryLabel.SetText(cfg.remotes[0].countryIso + ", " + cfg.remotes[0].country)
-		protoLabel.SetText(string(cfg.proto))
+		remoteLabel.SetText(cfg.Remotes[0].IPs[0] + ":" + strconv.FormatUint(uint64(cfg.Remotes[0].Port), 10))
+		countryLabel.SetText(cfg.Remotes[0].CountryISO + ", " + cfg.Remotes[0].Country)
+		protoLabel.SetText(string(cfg.Proto))
 		authCheckbox.Connect("toggled", func() {
 			authBox.SetVisible(authCheckbox.GetActive())
 		})
-		showAuth := cfg.creds.Auth == auth.USER_PASS
+		showAuth := cfg.Creds.Auth == auth.USER_PASS
 		authCheckbox.SetActive(showAuth)
 		authBox.SetVisible(showAuth)
 		if showAuth {
-			userEntrry.SetText(cfg.creds.Username)
-			passEntry.SetText(cfg.creds.Password)
+			userEntrry.SetText(cfg.Creds.Username)
+			passEntry.SetText(cfg.Creds.Password)
 		}
 		
 		detailsGrid.SetVisible(true)
@@ -112,4 +127,90 @@ func (gui *mainGUI) showImportSingleDialog() {
 	dialog.SetTransientFor(gui.window)
 	dialog.ShowAll()
 	dialog.Run()
-}
\ No newline at end of file
+}
+func (gui *mainGUI) showSplitTunnelDialog() {
+	builder, err := gtk.BuilderNewFromFile(consts.SplitTunnelUI)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	errorBar, _ := (*GetWidget(builder, "bar_error")).(*gtk.InfoBar)
+	errorLabel, _ := (*GetWidget(builder, "lbl_error")).(*gtk.Label)
+	errorBar.Connect("response", func() {
+		errorBar.SetProperty("revealed", false)
+	})
+	showError := func(msg string) {
+		errorBar.SetProperty("revealed", true)
+		errorLabel.SetText(msg)
+	}
+
+	dialog, _ := (*GetWidget(builder, "split_tunnel_dialog")).(*gtk.Dialog)
+	cancelBtn, _ := (*GetWidget(builder, "btn_cancel")).(*gtk.Button)
+	_, _ = cancelBtn.Connect("clicked", func() {
+		dialog.Close()
+	})
+
+	configCombo, _ := (*GetWidget(builder, "combo_config")).(*gtk.ComboBoxText)
+	modeCombo, _ := (*GetWidget(builder, "combo_mode")).(*gtk.ComboBoxText)
+	rulesView, _ := (*GetWidget(builder, "text_rules")).(*gtk.TextView)
+	rulesBuffer, err := rulesView.GetBuffer()
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	for _, single := range gui.appData.Singles {
+		configCombo.Append(single.Name, single.Name)
+	}
+	// Show the rules of the selected config
+	_, _ = configCombo.Connect("changed", func() {
+		i := gui.appData.FindSingle(configCombo.GetActiveID())
+		if i < 0 {
+			return
+		}
+		split := gui.appData.Singles[i].Split
+		if split == nil {
+			modeCombo.SetActiveID("off")
+			rulesBuffer.SetText("")
+			return
+		}
+		modeCombo.SetActiveID(string(split.Mode))
+		rulesBuffer.SetText(strings.Join(split.Rules, "\n"))
+	})
+	if len(gui.appData.Singles) > 0 {
+		configCombo.SetActive(0)
+	}
+
+	saveBtn, _ := (*GetWidget(builder, "btn_save")).(*gtk.Button)
+	_, _ = saveBtn.Connect("clicked", func() {
+		name := configCombo.GetActiveID()
+		i := gui.appData.FindSingle(name)
+		if i < 0 {
+			showError("No config is selected")
+			return
+		}
+		var split *profiles.SplitTunnel
+		if mode := modeCombo.GetActiveID(); mode != "off" {
+			start, end := rulesBuffer.GetBounds()
+			text, _ := rulesBuffer.GetText(start, end, false)
+			split = &profiles.SplitTunnel{Mode: profiles.SplitMode(mode), Rules: strings.Fields(text)}
+			if err := split.Check(); err != nil {
+				showError("Error: " + err.Error())
+				return
+			}
+		}
+		err := profiles.UpdateSingle(name, func(single *profiles.SingleCfg) {
+			single.Split = split
+		})
+		if err != nil {
+			showError("Error: " + err.Error())
+			return
+		}
+		gui.appData.Singles[i].Split = split
+		dialog.Close()
+	})
+
+	defer dialog.Destroy()
+	dialog.SetTransientFor(gui.window)
+	dialog.ShowAll()
+	dialog.Run()
+}
@@ -1,18 +1,17 @@
 package ui
 
 import (
-	"bufio"
 	"fmt"
+	"github.com/TheWeirdDev/Vodga/shared/client"
 	"github.com/TheWeirdDev/Vodga/shared/consts"
 	"github.com/TheWeirdDev/Vodga/shared/messages"
+	"github.com/TheWeirdDev/Vodga/shared/profiles"
 	"github.com/TheWeirdDev/Vodga/shared/utils"
 	"github.com/TheWeirdDev/Vodga/ui/gtk_deprecated"
 //	"github.com/gotk3/gotk3/gdk"
 	"github.com/gotk3/gotk3/glib"
 	"github.com/gotk3/gotk3/gtk"
-	"io"
 	"log"
-	"net"
 	"os"
 	"os/exec"
 	"time"
@@ -24,10 +23,10 @@ type mainGUI struct {
 	trayIcon     *gtk_deprecated.StatusIcon
 	trayMenu     *gtk.Menu
 	trayMenuItem *gtk.MenuItem
-	server       net.Conn
+	client       *client.Client
 	state        string
 	quit         chan struct{}
-	appData		 data
+	appData		 profiles.Data
 }
 
 func CreateGUI() *mainGUI {
@@ -80,6 +79,7 @@ func (gui *mainGUI) Run() {
 	menu.AppendItem(addInd)
 	menu.AppendItem(addProvider)
 	menu.AppendItem(importExport)
+	menu.AppendItem(glib.MenuItemNew("Split tunneling", "win.splitTunnel"))
 
 	importAction := glib.SimpleActionNew("addSingle", nil)
 	_, _ = importAction.Connect("activate", func() {
@@ -87,6 +87,12 @@ func (gui *mainGUI) Run() {
 	})
 	gui.window.AddAction(importAction)
 
+	splitAction := glib.SimpleActionNew("splitTunnel", nil)
+	_, _ = splitAction.Connect("activate", func() {
+		gui.showSplitTunnelDialog()
+	})
+	gui.window.AddAction(splitAction)
+
 	importBtn , _ := (*GetWidget(builder, "btn_import")).(*gtk.MenuButton)
 	importBtn.SetMenuModel(&menu.MenuModel)
 
@@ -100,8 +106,15 @@ func (gui *mainGUI) Run() {
 		// Check for bandwidth usage every 1 second
 		tck := time.Tick(time.Second)
 		for range tck {
-			if gui.server != nil && gui.state == consts.StateCONNECTED {
-				messages.SendMessage(messages.GetBytecountMsg(), gui.server)
+			if gui.client != nil && gui.state == consts.StateCONNECTED {
+				bytecount, err := gui.client.Bytecount()
+				if err != nil {
+					log.Printf("Can't get the bytecount: %v\n", err)
+					continue
+				}
+				//TODO: Finish this
+				fmt.Println("Got bytecount:", utils.FormatSize(bytecount.In), utils.FormatSize(bytecount.Out),
+					utils.FormatSize(bytecount.TotalIn), utils.FormatSize(bytecount.TotalOut))
 			}
 		}
 	}()
@@ -109,24 +122,8 @@ func (gui *mainGUI) Run() {
 
 // Listen for daemon broadcast messages (should be a goroutine)
 func (gui *mainGUI) listenToDaemon() {
-	scanner := bufio.NewScanner(gui.server)
-
-	for scanner.Scan() {
-		text := scanner.Text()
-		msg, err := messages.UnmarshalMsg(text)
-		if err != nil {
-			log.Printf("Error unmarshaling the message: %v\n", err)
-		}
-
+	for msg := range gui.client.Events() {
 		switch msg.Command {
-		case consts.MsgByteCount:
-			//TODO: Finish this
-			in, out, tin, tout := utils.BytecountToUint(msg.Args["in"], msg.Args["out"],
-				msg.Args["tin"], msg.Args["tout"])
-
-			fmt.Println("Got bytecount:", utils.FormatSize(in), utils.FormatSize(out),
-				utils.FormatSize(tin), utils.FormatSize(tout))
-
 		case consts.MsgStateChanged:
 			state, ok := msg.Args["state"]
 			if !ok {
@@ -137,38 +134,37 @@ func (gui *mainGUI) listenToDaemon() {
 			//TODO: Update the program status
 			fmt.Println("Got state:", state)
 
+		case consts.MsgStatus:
+			// The snapshot that is sent when we subscribe
+			status := messages.ParseStatus(msg)
+			gui.state = status.State
+			fmt.Println("Got status:", status.State, status.Profile, status.LocalIP)
+
+		case consts.MsgReconnectScheduled:
+			//TODO: Show it in the status bar
+			fmt.Printf("Reconnecting in %ss (attempt %s/%s)\n", msg.Args["delay"],
+				msg.Args["attempt"], msg.Args["max_attempts"])
+
 		case consts.MsgDisconnected:
 			//TODO: Update text
 		case consts.MsgError:
 			// TODO: Show error
 			fmt.Println("Got error")
-		}
-
-	}
-	select {
-	case <-gui.quit:
-		log.Println("Closed")
-		return
-
-	default:
-		if err := scanner.Err(); err != nil && err != io.EOF {
-			log.Printf("Read error: %v", err)
+		case client.EventDisconnected:
+			// The client reconnects when the daemon is back
+			// TODO: Reset everything
+			gui.state = ""
+			log.Println("Lost connection to the daemon")
+		case client.EventReconnected:
+			log.Println("Reconnected to the daemon")
 		}
 	}
-
-	// TODO: Reset everything
-	gui.server = nil
-	// Wait if the daemon is restarting, then try connecting again
-	time.Sleep(500 * time.Millisecond)
-
-	// IMPORTANT: You can't show dialogs in goroutines
-	glib.IdleAdd(gui.connectToDaemon)
-
+	log.Println("Closed")
 }
 
 func (gui *mainGUI) connectToDaemon() {
 firstDialog:
-	c, err := net.Dial("unix", consts.UnixSocket)
+	c, err := client.Dial(consts.UnixSocket)
 	if err != nil {
 
 		// We use this label to repeat the dialog if systemctl returns an error
@@ -199,6 +195,9 @@ firstDialog:
 					log.Fatalf("cmd.Wait: %v", err)
 				}
 			}
+			// Wait for the daemon to create its socket
+			time.Sleep(500 * time.Millisecond)
+			goto firstDialog
 		} else {
 			gui.window.Close()
 			os.Exit(0)
@@ -206,7 +205,7 @@ firstDialog:
 		}
 	}
 	log.Println("Connected to daemon")
-	gui.server = c
+	gui.client = c
 	go gui.listenToDaemon()
 }
 
@@ -233,8 +232,8 @@ func (gui *mainGUI) initWidgets() {
 
 	_, _ = menuItemExit.Connect("activate", func() {
 		close(gui.quit)
-		if gui.server != nil {
-			gui.server.Close()
+		if gui.client != nil {
+			gui.client.Close()
 		}
 		time.Sleep(20 * time.Millisecond)
 		gtk.MainQuit()
@@ -269,7 +268,7 @@ func (gui *mainGUI) showMainWindow() {
 // We load every imported config and provider
 // TODO: add the config list
 func (gui *mainGUI) loadAppData() {
-	appData, err := loadData()
+	appData, err := profiles.Load()
 	if err != nil {
 		log.Fatalf("Error: %v", err)
 	}